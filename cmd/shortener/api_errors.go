@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+)
+
+// Codes of the api errors. Clients should match on them, messages are meant
+// for humans and may change.
+const (
+	errCodeInvalidContentType = "invalid_content_type"
+	errCodeInvalidEncoding    = "invalid_encoding"
+	errCodeInvalidJSON        = "invalid_json"
+	errCodeInvalidParameter   = "invalid_parameter"
+	errCodeInvalidField       = "invalid_field"
+	errCodeInvalidURL         = "invalid_url"
+	errCodeInvalidImport      = "invalid_import"
+	errCodeBlockedDomain      = "blocked_domain"
+	errCodeUnauthorized       = "unauthorized"
+	errCodeNotFound           = "not_found"
+	errCodeMethodNotAllowed   = "method_not_allowed"
+	errCodeRequestTooLarge    = "request_too_large"
+	errCodeRateLimited        = "rate_limited"
+	errCodeInternal           = "internal_error"
+	// an Idempotency-Key sent with another request or with a retry while
+	// the first request is handled
+	errCodeIdempotencyKeyReused = "idempotency_key_reused"
+	errCodeIdempotencyKeyInUse  = "idempotency_key_in_use"
+	// a password protected link asked for a url shortened before without
+	// the password
+	errCodeURLTaken = "url_taken"
+)
+
+// Codes of the rows failing an import besides the ones of invalid fields.
+const (
+	errCodeInvalidRow = "invalid_row"
+	errCodeDuplicate  = "duplicate"
+)
+
+type ErrorJSON struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type ErrorJSONResponse struct {
+	Error ErrorJSON `json:"error"`
+}
+
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code string, message string, details map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorJSONResponse{Error: ErrorJSON{
+		Code:    code,
+		Message: message,
+		Details: details,
+	}})
+}
+
+// writeError is for code shared by the api and the plain text endpoints,
+// only requests to /api/ get the JSON error.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string, details map[string]interface{}) {
+	if isAPIRequest(r) {
+		writeAPIError(w, status, code, message, details)
+		return
+	}
+	http.Error(w, message, status)
+}
+
+func writeNotFound(w http.ResponseWriter) {
+	writeAPIError(w, http.StatusNotFound, errCodeNotFound, "No such short url", nil)
+}
+
+func writeInvalidContentType(w http.ResponseWriter) {
+	writeAPIError(w, http.StatusBadRequest, errCodeInvalidContentType, "Bad Content-Type", map[string]interface{}{
+		"expected": "application/json",
+	})
+}
+
+func writeBatchTooLarge(w http.ResponseWriter, limit int) {
+	writeAPIError(w, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge, fmt.Sprintf("Batch is larger than %d urls", limit), map[string]interface{}{"limit": limit})
+}
+
+func writeInvalidJSON(w http.ResponseWriter, err error) {
+	writeAPIError(w, http.StatusBadRequest, errCodeInvalidJSON, err.Error(), nil)
+}
+
+// writeFieldError reports an invalid field of the request body. Errors of
+// url validation keep their own codes. The field is left out when empty.
+func writeFieldError(w http.ResponseWriter, field string, err error) {
+	fieldErr := fieldError(field, err)
+	writeAPIError(w, http.StatusBadRequest, fieldErr.Code, fieldErr.Message, fieldErr.Details)
+}
+
+func fieldError(field string, err error) ErrorJSON {
+	details := make(map[string]interface{})
+	if len(field) > 0 {
+		details["field"] = field
+	}
+	code := errCodeInvalidField
+	var invalidURLErr *app.InvalidURLError
+	var blockedDomainErr *app.BlockedDomainError
+	switch {
+	case errors.As(err, &invalidURLErr):
+		code = errCodeInvalidURL
+		details["reason"] = invalidURLErr.Reason
+	case errors.As(err, &blockedDomainErr):
+		code = errCodeBlockedDomain
+		details["host"] = blockedDomainErr.Host
+	}
+	if len(details) == 0 {
+		details = nil
+	}
+	return ErrorJSON{Code: code, Message: err.Error(), Details: details}
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAPIRequest(r) {
+		http.NotFound(w, r)
+		return
+	}
+	writeAPIError(w, http.StatusNotFound, errCodeNotFound, "No such endpoint", nil)
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAPIRequest(r) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, r.Method+" is not allowed here", nil)
+}
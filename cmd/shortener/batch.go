@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+)
+
+const (
+	// batchChunkSize is how many items of a streamed batch are saved and
+	// answered at once.
+	batchChunkSize = 100
+	// maxBatchLineLength bounds a line of a streamed batch.
+	maxBatchLineLength = 64 * 1024
+)
+
+var errBatchLineTooLong = fmt.Errorf("line is longer than %d bytes", maxBatchLineLength)
+
+var errFullDuplexUnsupported = errors.New("response writer can't be full duplex")
+
+// fullDuplexer is a response writer which can be written while the request
+// body is still read. HTTP/1 servers close the body on the first write
+// otherwise.
+type fullDuplexer interface {
+	EnableFullDuplex() error
+}
+
+// ndjsonReader reads one JSON value per line, skipping empty lines.
+type ndjsonReader struct {
+	reader *bufio.Reader
+}
+
+func newNDJSONReader(r io.Reader) *ndjsonReader {
+	return &ndjsonReader{reader: bufio.NewReaderSize(r, maxBatchLineLength)}
+}
+
+func (r *ndjsonReader) next(v interface{}) error {
+	for {
+		data, err := r.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return errBatchLineTooLong
+		}
+		if err != nil && (err != io.EOF || len(data) == 0) {
+			return err
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		return json.Unmarshal(data, v)
+	}
+}
+
+// batchStream answers a streamed batch chunk by chunk. Errors found before
+// the first chunk was answered get a regular error response, later ones end
+// the stream with a ShortenBatchNDJSONError line.
+type batchStream struct {
+	w       http.ResponseWriter
+	encoder *json.Encoder
+	started bool
+}
+
+func (s *batchStream) start() {
+	if !s.started {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+		s.w.WriteHeader(http.StatusOK)
+		s.encoder = json.NewEncoder(s.w)
+		s.started = true
+	}
+}
+
+func (s *batchStream) write(lines []ShortenBatchNDJSONResponse) {
+	s.start()
+	for _, line := range lines {
+		s.encoder.Encode(line)
+	}
+	flushResponse(s.w)
+}
+
+func (s *batchStream) fail(status int, code string, message string, details map[string]interface{}) {
+	if !s.started {
+		writeAPIError(s.w, status, code, message, details)
+		return
+	}
+	s.encoder.Encode(ShortenBatchNDJSONError{Error: ErrorJSON{Code: code, Message: message, Details: details}})
+}
+
+// shortenBatchNDJSON shortens a batch sent as one item per line. Items are
+// read and saved in chunks and answered in their order as each chunk is
+// saved, so the batch is never held in memory as a whole. Every chunk is
+// counted against the create rate limit.
+func (h *Handler) shortenBatchNDJSON(w http.ResponseWriter, r *http.Request) {
+	qrFormat, qrOpts, err := h.parseQRRequest(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error(), nil)
+		return
+	}
+	chunkSize := batchChunkSize
+	if h.createLimit.Enabled() && h.createLimit.Burst < chunkSize {
+		chunkSize = h.createLimit.Burst
+	}
+	if duplexer, ok := w.(fullDuplexer); ok {
+		duplexer.EnableFullDuplex()
+	}
+	userID := getUserTokenFromWriter(w)
+	defaults := h.defaultLinkOptions(r.Context(), userID)
+	reader := newNDJSONReader(r.Body)
+	stream := &batchStream{w: w}
+	items := make([]ShortenBatchItemJSON, 0, chunkSize)
+	read := 0
+	for {
+		item := ShortenBatchItemJSON{}
+		err := reader.next(&item)
+		if err != nil && err != io.EOF {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			code := errCodeInvalidJSON
+			if errors.Is(err, errBatchLineTooLong) {
+				code = errCodeRequestTooLarge
+			} else if !errors.As(err, &syntaxErr) && !errors.As(err, &typeErr) {
+				panic(err)
+			}
+			stream.fail(http.StatusBadRequest, code, fmt.Sprintf("Item %d: %v", read, err), map[string]interface{}{"item": read})
+			return
+		}
+		if err == nil {
+			if h.maxBatchSize > 0 && read >= h.maxBatchSize {
+				stream.fail(http.StatusRequestEntityTooLarge, errCodeRequestTooLarge, fmt.Sprintf("Batch is larger than %d urls", h.maxBatchSize), map[string]interface{}{"limit": h.maxBatchSize})
+				return
+			}
+			items = append(items, item)
+			read++
+		}
+		if len(items) == chunkSize || (err == io.EOF && len(items) > 0) {
+			// the request itself has already been counted
+			cost := len(items)
+			if !stream.started {
+				if !h.takeRateLimit(w, r, rateLimitCreate, h.createLimit, cost-1) {
+					return
+				}
+			} else if h.rateLimiter != nil && h.createLimit.Enabled() {
+				if result := h.allowRateLimit(r, rateLimitCreate, h.createLimit, cost); result != nil && !result.Allowed {
+					retryAfter := ceilSeconds(result.RetryAfter)
+					stream.fail(http.StatusTooManyRequests, errCodeRateLimited, "Too many requests", map[string]interface{}{"retry_after": retryAfter})
+					return
+				}
+			}
+			stream.write(h.shortenBatchChunk(r.Context(), items, userID, defaults, qrFormat, qrOpts))
+			items = items[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	stream.start()
+}
+
+// shortenBatchChunk validates and saves items of a streamed batch and
+// returns their answers in the same order.
+func (h *Handler) shortenBatchChunk(ctx context.Context, items []ShortenBatchItemJSON, userID uint32, defaults app.LinkOptions, qrFormat string, qrOpts app.QROptions) []ShortenBatchNDJSONResponse {
+	lines := make([]ShortenBatchNDJSONResponse, len(items))
+	links := make([]app.ImportedLink, 0, len(items))
+	// linkItems maps the links to the items they were made of
+	linkItems := make([]int, 0, len(items))
+	for i, item := range items {
+		lines[i].CorrelationID = item.CorrelationID
+		longURL, err := h.validateURL(ctx, item.OrginalURL)
+		if err != nil {
+			fieldErr := fieldError("original_url", err)
+			lines[i].Error = &fieldErr
+			continue
+		}
+		links = append(links, app.ImportedLink{Short: app.GenShort(longURL.String()), LongURL: longURL.String(), Options: defaults})
+		linkItems = append(linkItems, i)
+	}
+	skipped, err := h.storage.ImportLinks(ctx, links, userID)
+	if err != nil {
+		panic(err)
+	}
+	existed := make(map[int]bool, len(skipped))
+	for _, i := range skipped {
+		existed[i] = true
+	}
+	for i, link := range links {
+		line := &lines[linkItems[i]]
+		if existed[i] {
+			if longURL, exists := h.storage.GetURLFromShort(ctx, link.Short); !exists || longURL != link.LongURL {
+				line.Error = &ErrorJSON{Code: errCodeDuplicate, Message: "Url is shortened under another code"}
+				continue
+			}
+			line.Existed = true
+		}
+		line.ShortURL = strings.Join([]string{h.baseServerURL, link.Short}, "/")
+		qr, err := qrDataURI(line.ShortURL, qrFormat, qrOpts)
+		if err != nil {
+			panic(err)
+		}
+		line.QR = qr
+	}
+	return lines
+}
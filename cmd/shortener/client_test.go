@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+	"github.com/evgenspj/url-shortener/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordedRequest is what requestRecorder saw of a request before the
+// middlewares.
+type recordedRequest struct {
+	contentEncoding string
+	acceptEncoding  string
+	bodySize        int
+}
+
+type requestRecorder struct {
+	mu       sync.Mutex
+	requests []recordedRequest
+}
+
+func (rec *requestRecorder) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, recordedRequest{
+			contentEncoding: r.Header.Get("Content-Encoding"),
+			acceptEncoding:  r.Header.Get("Accept-Encoding"),
+			bodySize:        len(body),
+		})
+		rec.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rec *requestRecorder) last() recordedRequest {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.requests[len(rec.requests)-1]
+}
+
+func newTestClient(t *testing.T, url string, opts ...client.Option) *client.Client {
+	opts = append([]client.Option{client.WithRetries(3, time.Millisecond, 10*time.Millisecond)}, opts...)
+	c, err := client.New(url, opts...)
+	require.NoError(t, err)
+	return c
+}
+
+func TestClient(t *testing.T) {
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+		adminToken:    "admin-secret",
+	}
+	recorder := &requestRecorder{}
+	ts := httptest.NewServer(recorder.handle(middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle)))
+	defer ts.Close()
+	ctx := context.Background()
+
+	tokenFile := filepath.Join(t.TempDir(), "shortener", "token")
+	c := newTestClient(t, ts.URL, client.WithTokenStore(client.FileTokenStore(tokenFile)))
+	assert.Empty(t, c.UserToken())
+
+	short := app.GenShort("http://example.com/client")
+	shortURL := defaultBaseURL + "/" + short
+
+	t.Run("shorten", func(t *testing.T) {
+		result, err := c.Shorten(ctx, "http://example.com/client")
+		require.NoError(t, err)
+		assert.Equal(t, shortURL, result)
+		require.NotEmpty(t, c.UserToken())
+		assert.True(t, isValidToken(c.UserToken()))
+		assert.Equal(t, "gzip", recorder.last().acceptEncoding)
+
+		result, err = c.Shorten(ctx, "http://example.com/client")
+		assert.True(t, errors.Is(err, client.ErrConflict), "got %v", err)
+		assert.Equal(t, shortURL, result, "the existing short url is returned with the conflict")
+
+		_, err = c.Shorten(ctx, "not an url")
+		assert.True(t, errors.Is(err, client.ErrBadRequest), "got %v", err)
+	})
+
+	t.Run("token store", func(t *testing.T) {
+		saved, err := client.FileTokenStore(tokenFile).LoadToken()
+		require.NoError(t, err)
+		assert.Equal(t, c.UserToken(), saved)
+
+		restored := newTestClient(t, ts.URL, client.WithTokenStore(client.FileTokenStore(tokenFile)))
+		assert.Equal(t, c.UserToken(), restored.UserToken())
+		urls, err := restored.UserURLs(ctx)
+		require.NoError(t, err)
+		require.Len(t, urls, 1)
+		assert.Equal(t, shortURL, urls[0].ShortURL)
+
+		stranger := newTestClient(t, ts.URL)
+		urls, err = stranger.UserURLs(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, urls)
+		assert.NotEqual(t, c.UserToken(), stranger.UserToken())
+	})
+
+	t.Run("shorten json", func(t *testing.T) {
+		result, err := c.ShortenJSON(ctx, client.ShortenRequest{
+			URL:   "http://example.com/client/json",
+			Title: "Client",
+			QR:    &client.QROptions{Format: client.QRFormatSVG},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, defaultBaseURL+"/"+app.GenShort("http://example.com/client/json"), result.Result)
+		assert.True(t, strings.HasPrefix(result.QR, "data:image/svg+xml;base64,"), result.QR)
+
+		result, err = c.ShortenJSON(ctx, client.ShortenRequest{URL: "http://example.com/client/json"})
+		assert.True(t, errors.Is(err, client.ErrConflict), "got %v", err)
+		assert.Equal(t, defaultBaseURL+"/"+app.GenShort("http://example.com/client/json"), result.Result)
+
+		_, err = c.ShortenJSON(ctx, client.ShortenRequest{URL: "http://example.com/client/bad", MaxClicks: -1})
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr), "got %v", err)
+		assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+		assert.Equal(t, errCodeInvalidField, apiErr.Code)
+		assert.Equal(t, "max_clicks", apiErr.Details["field"])
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		items := []client.BatchItem{
+			{CorrelationID: "1", OriginalURL: "http://example.com/client/batch/1"},
+			{CorrelationID: "2", OriginalURL: "http://example.com/client/batch/2"},
+		}
+		results, err := c.ShortenBatch(ctx, items, nil)
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []client.BatchResult{
+			{CorrelationID: "1", ShortURL: defaultBaseURL + "/" + app.GenShort(items[0].OriginalURL)},
+			{CorrelationID: "2", ShortURL: defaultBaseURL + "/" + app.GenShort(items[1].OriginalURL)},
+		}, results)
+
+		results, err = c.ShortenBatch(ctx, items[:1], &client.QROptions{})
+		assert.True(t, errors.Is(err, client.ErrConflict), "got %v", err)
+		require.Len(t, results, 1)
+		assert.True(t, strings.HasPrefix(results[0].QR, "data:image/png;base64,"), results[0].QR)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		result, err := c.ImportUserURLs(ctx, client.ImportJSONL, []byte(`{"short": "client-import", "original_url": "http://example.com/client/import"}`+"\n"+`{"original_url": "bad"}`))
+		require.NoError(t, err)
+		assert.Equal(t, 1, result.Imported)
+		require.Len(t, result.Errors, 1)
+		assert.Equal(t, 2, result.Errors[0].Line)
+		assert.Equal(t, "invalid_url", result.Errors[0].Code)
+
+		_, err = c.ImportUserURLs(ctx, client.ImportCSV, []byte("url\nhttp://example.com/client/import\n"))
+		assert.True(t, errors.Is(err, client.ErrBadRequest), "got %v", err)
+	})
+
+	t.Run("gzip requests", func(t *testing.T) {
+		items := make([]client.BatchItem, 40)
+		for i := range items {
+			items[i] = client.BatchItem{CorrelationID: strings.Repeat("x", i+1), OriginalURL: "http://example.com/client/gzip/" + strings.Repeat("y", i+1)}
+		}
+		results, err := c.ShortenBatch(ctx, items, nil)
+		require.NoError(t, err)
+		assert.Len(t, results, len(items))
+		sent := recorder.last()
+		assert.Equal(t, "gzip", sent.contentEncoding)
+		data, err := json.Marshal(items)
+		require.NoError(t, err)
+		assert.Less(t, sent.bodySize, len(data))
+
+		_, err = c.Shorten(ctx, "http://example.com/client/small")
+		require.NoError(t, err)
+		assert.Empty(t, recorder.last().contentEncoding, "small bodies are sent as is")
+	})
+
+	t.Run("link settings", func(t *testing.T) {
+		rules, err := c.SetLinkRules(ctx, short, []client.RedirectRule{{Device: "mobile", URL: "http://m.example.com"}})
+		require.NoError(t, err)
+		assert.Equal(t, []client.RedirectRule{{Device: "mobile", URL: "http://m.example.com"}}, rules)
+		rules, err = c.LinkRules(ctx, short)
+		require.NoError(t, err)
+		assert.Len(t, rules, 1)
+
+		variants := []client.Variant{
+			{Name: "a", URL: "http://example.com/a", Weight: 1},
+			{Name: "b", URL: "http://example.com/b", Weight: 1},
+		}
+		saved, err := c.SetLinkVariants(ctx, short, variants)
+		require.NoError(t, err)
+		assert.Equal(t, variants, saved)
+		saved, err = c.LinkVariants(ctx, short)
+		require.NoError(t, err)
+		assert.Equal(t, variants, saved)
+
+		stats, err := c.LinkStats(ctx, short)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), stats.Total)
+
+		info, err := c.LinkInfo(ctx, short)
+		require.NoError(t, err)
+		assert.True(t, info.Owner)
+		assert.Equal(t, &stats, info.Clicks)
+
+		_, err = c.LinkRules(ctx, "missing")
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr), "got %v", err)
+		assert.True(t, errors.Is(err, client.ErrNotFound))
+		assert.Equal(t, errCodeNotFound, apiErr.Code)
+
+		_, err = c.LinkRules(ctx, "a/b c")
+		assert.True(t, errors.Is(err, client.ErrNotFound), "ids are escaped, got %v", err)
+	})
+
+	t.Run("user settings", func(t *testing.T) {
+		settings, err := c.SetUserSettings(ctx, client.UserSettings{DefaultUTM: &client.UTMParams{Source: "client"}})
+		require.NoError(t, err)
+		assert.Equal(t, "client", settings.DefaultUTM.Source)
+		settings, err = c.UserSettings(ctx)
+		require.NoError(t, err)
+		require.NotNil(t, settings.DefaultUTM)
+		assert.Equal(t, "client", settings.DefaultUTM.Source)
+		_, err = c.SetUserSettings(ctx, client.UserSettings{})
+		require.NoError(t, err)
+	})
+
+	t.Run("qr code", func(t *testing.T) {
+		png, err := c.QRCode(ctx, short, client.QROptions{Size: 128})
+		require.NoError(t, err)
+		assert.True(t, bytes.HasPrefix(png, []byte("\x89PNG")))
+		svg, err := c.QRCode(ctx, short, client.QROptions{Format: client.QRFormatSVG})
+		require.NoError(t, err)
+		assert.Contains(t, string(svg), "<svg")
+		_, err = c.QRCode(ctx, "missing", client.QROptions{})
+		assert.True(t, errors.Is(err, client.ErrNotFound), "got %v", err)
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		reportID, err := c.Report(ctx, short, "phishing")
+		require.NoError(t, err)
+		assert.NotZero(t, reportID)
+
+		_, err = c.AbuseReports(ctx)
+		assert.True(t, errors.Is(err, client.ErrUnauthorized), "got %v", err)
+
+		admin := newTestClient(t, ts.URL, client.WithAdminToken("admin-secret"))
+		reports, err := admin.AbuseReports(ctx)
+		require.NoError(t, err)
+		require.Len(t, reports, 1)
+		assert.Equal(t, reportID, reports[0].ID)
+		assert.Equal(t, shortURL, reports[0].ShortURL)
+
+		takedown, err := admin.DisableLink(ctx, short, http.StatusUnavailableForLegalReasons, "court order")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnavailableForLegalReasons, takedown.Status)
+		linkStatus := func() string {
+			urls, err := c.UserURLs(ctx)
+			require.NoError(t, err)
+			for _, url := range urls {
+				if url.ShortURL == shortURL {
+					return url.Status
+				}
+			}
+			return ""
+		}
+		assert.Equal(t, linkStatusDisabled, linkStatus())
+		require.NoError(t, admin.EnableLink(ctx, short))
+		assert.Equal(t, linkStatusActive, linkStatus())
+
+		require.NoError(t, admin.DismissReports(ctx, short))
+		reports, err = admin.AbuseReports(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, reports)
+
+		tokenData, err := hex.DecodeString(c.UserToken())
+		require.NoError(t, err)
+		userID := binary.BigEndian.Uint32(tokenData[:4])
+		require.NoError(t, admin.SetUserTrust(ctx, userID, true))
+		require.NoError(t, admin.SetUserTrust(ctx, userID, false))
+		assert.True(t, errors.Is(admin.EnableLink(ctx, "missing"), client.ErrNotFound))
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		deleted := app.GenShort("http://example.com/client/small")
+		require.NoError(t, c.DeleteUserURLs(ctx, []string{deleted}))
+		urls, err := c.UserURLs(ctx)
+		require.NoError(t, err)
+		for _, url := range urls {
+			assert.NotEqual(t, defaultBaseURL+"/"+deleted, url.ShortURL)
+		}
+	})
+
+	t.Run("misc", func(t *testing.T) {
+		require.NoError(t, c.Ping(ctx))
+		spec, err := c.OpenAPI(ctx)
+		require.NoError(t, err)
+		assert.True(t, json.Valid(spec))
+	})
+}
+
+func TestClientRetries(t *testing.T) {
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL:  defaultBaseURL,
+		idempotency:    &app.MemoryIdempotencyStore{},
+		idempotencyTTL: time.Hour,
+	}
+	router := middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle)
+	var mu sync.Mutex
+	failures := 0
+	failure := http.StatusServiceUnavailable
+	// lostResponses are handled, but answered with a 502 as if a proxy lost
+	// the response.
+	lostResponses := 0
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		fail := failures > 0
+		if fail {
+			failures--
+		}
+		lost := lostResponses > 0
+		if lost {
+			lostResponses--
+		}
+		mu.Unlock()
+		if lost {
+			router.ServeHTTP(httptest.NewRecorder(), r)
+			writeAPIError(w, http.StatusBadGateway, errCodeInternal, http.StatusText(http.StatusBadGateway), nil)
+			return
+		}
+		if !fail {
+			router.ServeHTTP(w, r)
+			return
+		}
+		if failure == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		// The body is gzipped, so failed attempts must not read it halfway.
+		io.Copy(io.Discard, r.Body)
+		writeAPIError(w, failure, errCodeInternal, http.StatusText(failure), nil)
+	}))
+	defer ts.Close()
+	c := newTestClient(t, ts.URL, client.WithGzipRequests(1))
+	ctx := context.Background()
+	setFailures := func(n int, status int) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures, failure, attempts = n, status, 0
+	}
+	loseResponses := func(n int) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures, lostResponses, attempts = 0, n, 0
+	}
+
+	setFailures(2, http.StatusServiceUnavailable)
+	_, err := c.Shorten(ctx, "http://example.com/retry")
+	require.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	setFailures(1, http.StatusTooManyRequests)
+	_, err = c.ShortenJSON(ctx, client.ShortenRequest{URL: "http://example.com/retry/json"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+
+	setFailures(10, http.StatusInternalServerError)
+	_, err = c.UserURLs(ctx)
+	var apiErr *client.Error
+	require.True(t, errors.As(err, &apiErr), "got %v", err)
+	assert.True(t, errors.Is(err, client.ErrServer))
+	assert.Equal(t, errCodeInternal, apiErr.Code)
+	assert.Equal(t, 4, attempts, "the first attempt and 3 retries")
+
+	t.Run("lost response", func(t *testing.T) {
+		loseResponses(1)
+		_, err := c.ShortenJSON(ctx, client.ShortenRequest{URL: "http://example.com/retry/lost"})
+		require.NoError(t, err, "the retry gets the answer of the attempt that shortened the url")
+		assert.Equal(t, 2, attempts)
+
+		loseResponses(1)
+		_, err = c.ShortenBatch(ctx, []client.BatchItem{{CorrelationID: "1", OriginalURL: "http://example.com/retry/lost/batch"}}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+	})
+
+	setFailures(10, http.StatusInternalServerError)
+	_, err = c.ImportUserURLs(ctx, client.ImportJSONL, []byte(`{"original_url": "http://example.com/retry/import"}`))
+	assert.True(t, errors.Is(err, client.ErrServer), "got %v", err)
+	assert.Equal(t, 1, attempts, "requests without an idempotency key are not repeated")
+
+	setFailures(10, http.StatusServiceUnavailable)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = c.UserURLs(cancelled)
+	assert.True(t, errors.Is(err, context.Canceled), "got %v", err)
+
+	t.Run("rate limit", func(t *testing.T) {
+		limitedHandler := Handler{
+			storage:       handler.storage,
+			baseServerURL: defaultBaseURL,
+			rateLimiter:   &app.MemoryRateLimiter{},
+			createLimit:   app.RateLimit{Rate: 1.0 / 60, Burst: 1},
+		}
+		ts := httptest.NewServer(middlewareConveyor(NewRouter(&limitedHandler), gzipHandle, userTokenCookieHandle))
+		defer ts.Close()
+		c := newTestClient(t, ts.URL)
+		_, err := c.ShortenJSON(ctx, client.ShortenRequest{URL: "http://example.com/limited/1"})
+		require.NoError(t, err)
+		start := time.Now()
+		_, err = c.ShortenJSON(ctx, client.ShortenRequest{URL: "http://example.com/limited/2"})
+		var apiErr *client.Error
+		require.True(t, errors.As(err, &apiErr), "got %v", err)
+		assert.True(t, errors.Is(err, client.ErrRateLimited))
+		assert.Equal(t, errCodeRateLimited, apiErr.Code)
+		assert.Greater(t, apiErr.RetryAfter, 10*time.Millisecond)
+		assert.Less(t, time.Since(start), time.Second, "a Retry-After above the max backoff isn't waited for")
+	})
+}
+
+func TestClientGzipResponses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		json.NewEncoder(gz).Encode([]client.UserURL{{ShortURL: "http://localhost:8080/abc", OriginalURL: "http://example.com"}})
+	}))
+	defer ts.Close()
+	c := newTestClient(t, ts.URL)
+	urls, err := c.UserURLs(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []client.UserURL{{ShortURL: "http://localhost:8080/abc", OriginalURL: "http://example.com"}}, urls)
+}
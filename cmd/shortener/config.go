@@ -0,0 +1,298 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/evgenspj/url-shortener/internal/app"
+)
+
+const (
+	defaultBaseURL       = "http://localhost:8080"
+	defaultServerAddress = "localhost:8080"
+	defaultRedirectCode  = http.StatusTemporaryRedirect
+	defaultMaxURLLength  = 2048
+	// requests per minute and bursts, the limits are off unless a rate is
+	// set, negative values disable them. With the create limit on JSON
+	// batches may not be larger than its burst.
+	defaultCreateRate    = -1
+	defaultCreateBurst   = 500
+	defaultRedirectRate  = -1
+	defaultRedirectBurst = 200
+	// urls of a batch, negative values disable the limit
+	defaultMaxBatchSize = 10000
+	// how long responses are replayed to retries with the same
+	// Idempotency-Key, negative values disable the keys
+	defaultIdempotencyTTL = 24 * time.Hour
+)
+
+const (
+	rateLimitStoreMemory   = "memory"
+	rateLimitStorePostgres = "postgres"
+)
+
+type EnvConfig struct {
+	BaseURL         string        `env:"BASE_URL"`
+	ServerAddress   string        `env:"SERVER_ADDRESS"`
+	FileStoragePath string        `env:"FILE_STORAGE_PATH"`
+	PostgresConStr  string        `env:"DATABASE_DSN"`
+	RedirectCode    int           `env:"REDIRECT_STATUS_CODE"`
+	AllowedSchemes  []string      `env:"ALLOWED_SCHEMES"`
+	MaxURLLength    int           `env:"MAX_URL_LENGTH"`
+	AllowSelfLinks  bool          `env:"ALLOW_SELF_LINKS"`
+	BlocklistFile   string        `env:"BLOCKLIST_FILE"`
+	AllowlistFile   string        `env:"ALLOWLIST_FILE"`
+	CreateRate      int           `env:"CREATE_RATE_LIMIT"`
+	CreateBurst     int           `env:"CREATE_RATE_BURST"`
+	RedirectRate    int           `env:"REDIRECT_RATE_LIMIT"`
+	RedirectBurst   int           `env:"REDIRECT_RATE_BURST"`
+	TrustedProxies  []string      `env:"TRUSTED_PROXIES"`
+	RateLimitStore  string        `env:"RATE_LIMIT_STORE"`
+	AdminToken      string        `env:"ADMIN_TOKEN"`
+	GRPCAddress     string        `env:"GRPC_ADDRESS"`
+	MaxBatchSize    int           `env:"MAX_BATCH_SIZE"`
+	IdempotencyTTL  time.Duration `env:"IDEMPOTENCY_TTL"`
+}
+
+// Config is the resolved server configuration. Command line arguments take
+// precedence over environment variables, which take precedence over defaults.
+type Config struct {
+	ServerAddress   string
+	BaseURL         string
+	FileStoragePath string
+	PostgresConStr  string
+	RedirectCode    int
+	AllowedSchemes  []string
+	MaxURLLength    int
+	AllowSelfLinks  bool
+	BlocklistFile   string
+	AllowlistFile   string
+	CreateLimit     app.RateLimit
+	RedirectLimit   app.RateLimit
+	TrustedProxies  []*net.IPNet
+	RateLimitStore  string
+	AdminToken      string
+	// GRPCAddress is where the gRPC API listens, it is off when empty.
+	GRPCAddress string
+	// MaxBatchSize caps the urls of a batch, it is off when not positive.
+	MaxBatchSize int
+	// IdempotencyTTL is how long responses are kept for retries, the
+	// Idempotency-Key header is ignored when it is not positive.
+	IdempotencyTTL time.Duration
+}
+
+func parseConfig() (Config, error) {
+	// comand line args
+	argServerAddress := flag.String("a", "", "usage")
+	argBaseURL := flag.String("b", "", "usage")
+	argFileStoragePath := flag.String("f", "", "usage")
+	argPostgresConStr := flag.String("d", "", "usage")
+	argRedirectCode := flag.Int("redirect-code", 0, "default redirect status code: 301, 302, 303, 307 or 308")
+	argAllowedSchemes := flag.String("allowed-schemes", "", "comma separated url schemes allowed for destinations")
+	argMaxURLLength := flag.Int("max-url-length", 0, "maximum destination url length")
+	argAllowSelfLinks := flag.Bool("allow-self-links", false, "allow destinations pointing at the base url")
+	argBlocklistFile := flag.String("blocklist", "", "file with blocked domains")
+	argAllowlistFile := flag.String("allowlist", "", "file with the only allowed domains")
+	argCreateRate := flag.Int("create-rate", 0, "links created per minute by a user or an ip, off by default")
+	argCreateBurst := flag.Int("create-burst", 0, "links created at once by a user or an ip")
+	argRedirectRate := flag.Int("redirect-rate", 0, "redirects per minute for a user or an ip, off by default")
+	argRedirectBurst := flag.Int("redirect-burst", 0, "redirects at once for a user or an ip")
+	argTrustedProxies := flag.String("trusted-proxies", "", "comma separated networks of proxies allowed to set X-Forwarded-For")
+	argRateLimitStore := flag.String("rate-limit-store", "", "where rate limits are kept: memory or postgres")
+	argAdminToken := flag.String("admin-token", "", "bearer token of the admin api, the api is disabled without it")
+	argGRPCAddress := flag.String("grpc-address", "", "address of the gRPC server, disabled if empty")
+	argMaxBatchSize := flag.Int("max-batch-size", 0, "maximum urls of a batch, negative to disable")
+	argIdempotencyTTL := flag.Duration("idempotency-ttl", 0, "how long responses are replayed to retries with the same Idempotency-Key, negative to disable")
+	flag.Parse()
+
+	// environment variables
+	var envCfg EnvConfig
+	if err := env.Parse(&envCfg); err != nil {
+		return Config{}, err
+	}
+
+	var cfg Config
+	switch {
+	case len(*argServerAddress) > 0:
+		cfg.ServerAddress = *argServerAddress
+	case len(envCfg.ServerAddress) > 0:
+		cfg.ServerAddress = envCfg.ServerAddress
+	default:
+		cfg.ServerAddress = defaultServerAddress
+	}
+
+	switch {
+	case len(*argBaseURL) > 0:
+		cfg.BaseURL = *argBaseURL
+	case len(envCfg.BaseURL) > 0:
+		cfg.BaseURL = envCfg.BaseURL
+	default:
+		cfg.BaseURL = defaultBaseURL
+	}
+
+	// only one storage is used, arguments win over environment
+	switch {
+	case len(*argPostgresConStr) > 0:
+		cfg.PostgresConStr = *argPostgresConStr
+	case len(*argFileStoragePath) > 0:
+		cfg.FileStoragePath = *argFileStoragePath
+	case len(envCfg.PostgresConStr) > 0:
+		cfg.PostgresConStr = envCfg.PostgresConStr
+	case len(envCfg.FileStoragePath) > 0:
+		cfg.FileStoragePath = envCfg.FileStoragePath
+	}
+
+	switch {
+	case *argRedirectCode > 0:
+		cfg.RedirectCode = *argRedirectCode
+	case envCfg.RedirectCode > 0:
+		cfg.RedirectCode = envCfg.RedirectCode
+	default:
+		cfg.RedirectCode = defaultRedirectCode
+	}
+	if !app.IsValidRedirectCode(cfg.RedirectCode) {
+		return Config{}, fmt.Errorf("invalid redirect status code %d", cfg.RedirectCode)
+	}
+
+	switch {
+	case len(*argAllowedSchemes) > 0:
+		cfg.AllowedSchemes = strings.Split(*argAllowedSchemes, ",")
+	case len(envCfg.AllowedSchemes) > 0:
+		cfg.AllowedSchemes = envCfg.AllowedSchemes
+	default:
+		cfg.AllowedSchemes = []string{"http", "https"}
+	}
+
+	switch {
+	case *argMaxURLLength > 0:
+		cfg.MaxURLLength = *argMaxURLLength
+	case envCfg.MaxURLLength > 0:
+		cfg.MaxURLLength = envCfg.MaxURLLength
+	default:
+		cfg.MaxURLLength = defaultMaxURLLength
+	}
+
+	cfg.AllowSelfLinks = *argAllowSelfLinks || envCfg.AllowSelfLinks
+
+	switch {
+	case len(*argBlocklistFile) > 0:
+		cfg.BlocklistFile = *argBlocklistFile
+	case len(envCfg.BlocklistFile) > 0:
+		cfg.BlocklistFile = envCfg.BlocklistFile
+	}
+
+	switch {
+	case len(*argAllowlistFile) > 0:
+		cfg.AllowlistFile = *argAllowlistFile
+	case len(envCfg.AllowlistFile) > 0:
+		cfg.AllowlistFile = envCfg.AllowlistFile
+	}
+
+	cfg.CreateLimit = app.RateLimit{
+		Rate:  perMinute(firstNonZero(*argCreateRate, envCfg.CreateRate, defaultCreateRate)),
+		Burst: firstNonZero(*argCreateBurst, envCfg.CreateBurst, defaultCreateBurst),
+	}
+	cfg.RedirectLimit = app.RateLimit{
+		Rate:  perMinute(firstNonZero(*argRedirectRate, envCfg.RedirectRate, defaultRedirectRate)),
+		Burst: firstNonZero(*argRedirectBurst, envCfg.RedirectBurst, defaultRedirectBurst),
+	}
+
+	var trustedProxies []string
+	switch {
+	case len(*argTrustedProxies) > 0:
+		trustedProxies = strings.Split(*argTrustedProxies, ",")
+	case len(envCfg.TrustedProxies) > 0:
+		trustedProxies = envCfg.TrustedProxies
+	}
+	for _, proxy := range trustedProxies {
+		network, err := parseNetwork(strings.TrimSpace(proxy))
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, network)
+	}
+
+	switch {
+	case len(*argRateLimitStore) > 0:
+		cfg.RateLimitStore = *argRateLimitStore
+	case len(envCfg.RateLimitStore) > 0:
+		cfg.RateLimitStore = envCfg.RateLimitStore
+	default:
+		cfg.RateLimitStore = rateLimitStoreMemory
+	}
+	switch cfg.RateLimitStore {
+	case rateLimitStoreMemory:
+	case rateLimitStorePostgres:
+		if len(cfg.PostgresConStr) == 0 {
+			return Config{}, fmt.Errorf("rate limit store %s needs a database dsn", cfg.RateLimitStore)
+		}
+	default:
+		return Config{}, fmt.Errorf("unknown rate limit store %s", cfg.RateLimitStore)
+	}
+
+	switch {
+	case len(*argAdminToken) > 0:
+		cfg.AdminToken = *argAdminToken
+	case len(envCfg.AdminToken) > 0:
+		cfg.AdminToken = envCfg.AdminToken
+	}
+
+	switch {
+	case len(*argGRPCAddress) > 0:
+		cfg.GRPCAddress = *argGRPCAddress
+	case len(envCfg.GRPCAddress) > 0:
+		cfg.GRPCAddress = envCfg.GRPCAddress
+	}
+
+	cfg.MaxBatchSize = firstNonZero(*argMaxBatchSize, envCfg.MaxBatchSize, defaultMaxBatchSize)
+
+	switch {
+	case *argIdempotencyTTL != 0:
+		cfg.IdempotencyTTL = *argIdempotencyTTL
+	case envCfg.IdempotencyTTL != 0:
+		cfg.IdempotencyTTL = envCfg.IdempotencyTTL
+	default:
+		cfg.IdempotencyTTL = defaultIdempotencyTTL
+	}
+
+	return cfg, nil
+}
+
+func firstNonZero(values ...int) int {
+	for _, value := range values {
+		if value != 0 {
+			return value
+		}
+	}
+	return 0
+}
+
+func perMinute(rate int) float64 {
+	return float64(rate) / 60
+}
+
+// parseNetwork accepts both networks and single addresses.
+func parseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy %s: %w", s, err)
+	}
+	return network, nil
+}
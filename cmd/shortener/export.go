@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+)
+
+// Formats of /api/user/urls/export.
+const (
+	exportFormatCSV   = "csv"
+	exportFormatJSON  = "json"
+	exportFormatJSONL = "jsonl"
+)
+
+// exportFlushLinks is how many links are written between flushes, so large
+// exports reach the client while they are read.
+const exportFlushLinks = 100
+
+// exportCSVHeader are the columns of CSV exports. The file can be imported
+// again, the columns about the state of the links are skipped then.
+var exportCSVHeader = []string{"short", "short_url", "original_url", "created_at", "title", "status", "takedown_reason", "clicks", "metadata"}
+
+type ExportedURLJSON struct {
+	Short          string            `json:"short"`
+	ShortURL       string            `json:"short_url"`
+	OriginalURL    string            `json:"original_url"`
+	Status         string            `json:"status"`
+	TakedownReason string            `json:"takedown_reason,omitempty"`
+	CreatedAt      *time.Time        `json:"created_at,omitempty"`
+	Title          string            `json:"title,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Clicks         app.ClickStats    `json:"clicks"`
+}
+
+// linkExporter writes the links of an export one by one.
+type linkExporter interface {
+	write(link ExportedURLJSON) error
+	// close ends the export, the response is complete after it.
+	close() error
+}
+
+type exportFormat struct {
+	contentType string
+	extension   string
+	new         func(w io.Writer) linkExporter
+}
+
+var exportFormats = map[string]exportFormat{
+	exportFormatCSV:   {"text/csv; charset=utf-8", "csv", newCSVExporter},
+	exportFormatJSON:  {"application/json", "json", newJSONExporter},
+	exportFormatJSONL: {"application/x-ndjson", "jsonl", newJSONLExporter},
+}
+
+type csvExporter struct {
+	writer *csv.Writer
+}
+
+func newCSVExporter(w io.Writer) linkExporter {
+	writer := csv.NewWriter(w)
+	writer.Write(exportCSVHeader)
+	return csvExporter{writer: writer}
+}
+
+func (e csvExporter) write(link ExportedURLJSON) error {
+	createdAt := ""
+	if link.CreatedAt != nil {
+		createdAt = link.CreatedAt.Format(time.RFC3339)
+	}
+	metadata := ""
+	if len(link.Metadata) > 0 {
+		data, err := json.Marshal(link.Metadata)
+		if err != nil {
+			return err
+		}
+		metadata = string(data)
+	}
+	return e.writer.Write([]string{
+		link.Short,
+		link.ShortURL,
+		link.OriginalURL,
+		createdAt,
+		link.Title,
+		link.Status,
+		link.TakedownReason,
+		strconv.FormatInt(link.Clicks.Total, 10),
+		metadata,
+	})
+}
+
+func (e csvExporter) close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+// jsonExporter writes a JSON array an element at a time.
+type jsonExporter struct {
+	w       io.Writer
+	encoder *json.Encoder
+	written bool
+}
+
+func newJSONExporter(w io.Writer) linkExporter {
+	return &jsonExporter{w: w, encoder: json.NewEncoder(w)}
+}
+
+func (e *jsonExporter) write(link ExportedURLJSON) error {
+	separator := ","
+	if !e.written {
+		separator = "["
+		e.written = true
+	}
+	if _, err := io.WriteString(e.w, separator); err != nil {
+		return err
+	}
+	return e.encoder.Encode(link)
+}
+
+func (e *jsonExporter) close() error {
+	end := "]\n"
+	if !e.written {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+type jsonlExporter struct {
+	encoder *json.Encoder
+}
+
+func newJSONLExporter(w io.Writer) linkExporter {
+	return jsonlExporter{encoder: json.NewEncoder(w)}
+}
+
+func (e jsonlExporter) write(link ExportedURLJSON) error {
+	return e.encoder.Encode(link)
+}
+
+func (e jsonlExporter) close() error {
+	return nil
+}
+
+// flushResponse sends what was written so far, through the gzip writer if any.
+func flushResponse(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
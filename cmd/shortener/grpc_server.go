@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+	pb "github.com/evgenspj/url-shortener/internal/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// userTokenMetadataKey carries the user token in both directions, like the
+// user_token cookie of the HTTP API.
+const userTokenMetadataKey = "user_token"
+
+type userIDContextKey struct{}
+
+// GRPCServer serves the gRPC API with the storage and checks of the HTTP
+// handler.
+type GRPCServer struct {
+	pb.UnimplementedShortenerServer
+	handler *Handler
+}
+
+func NewGRPCServer(handler *Handler) *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(recoverInterceptor, userTokenInterceptor, handler.rateLimitInterceptor))
+	pb.RegisterShortenerServer(server, &GRPCServer{handler: handler})
+	return server
+}
+
+// recoverInterceptor turns panics of the storage into Internal errors, a
+// panic would take the whole server down otherwise.
+func recoverInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("panic serving %s: %v\n%s", info.FullMethod, recovered, debug.Stack())
+			err = status.Error(codes.Internal, "internal server error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// userTokenInterceptor is the gRPC counterpart of userTokenCookieHandle, a
+// new token is issued in the header metadata if the request has no valid one.
+func userTokenInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var userToken string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if tokens := md.Get(userTokenMetadataKey); len(tokens) > 0 && isValidToken(tokens[0]) {
+			userToken = tokens[0]
+		}
+	}
+	if len(userToken) == 0 {
+		userToken = genUserToken()
+	}
+	if err := grpc.SetHeader(ctx, metadata.Pairs(userTokenMetadataKey, userToken)); err != nil {
+		return nil, err
+	}
+	ctx = context.WithValue(ctx, userIDContextKey{}, app.GetUserIDFromToken(userToken))
+	return handler(ctx, req)
+}
+
+// rateLimitInterceptor takes the create rate limit of the HTTP API for the
+// links created over gRPC, a token per item for batches. Buckets are shared
+// with the HTTP API.
+func (h *Handler) rateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var cost int
+	switch req := req.(type) {
+	case *pb.ShortenRequest:
+		cost = 1
+	case *pb.ShortenBatchRequest:
+		cost = len(req.GetItems())
+	}
+	limit := h.createLimit
+	if h.rateLimiter == nil || !limit.Enabled() || cost <= 0 {
+		return handler(ctx, req)
+	}
+	if cost > limit.Burst {
+		return nil, status.Errorf(codes.InvalidArgument, "request costs more than %d requests allowed at once", limit.Burst)
+	}
+	keys := []string{
+		ipRateLimitKey(rateLimitCreate, h.grpcClientIP(ctx)),
+		userRateLimitKey(rateLimitCreate, userIDFromContext(ctx)),
+	}
+	strictest := h.allowRateLimitKeys(ctx, keys, limit, cost)
+	if strictest != nil && !strictest.Allowed {
+		retryAfter := ceilSeconds(strictest.RetryAfter)
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(retryAfter)))
+		return nil, status.Errorf(codes.ResourceExhausted, "too many requests, retry after %d seconds", retryAfter)
+	}
+	return handler(ctx, req)
+}
+
+// grpcClientIP is the gRPC counterpart of clientIP, x-forwarded-for is read
+// from the metadata.
+func (h *Handler) grpcClientIP(ctx context.Context) string {
+	var remoteAddr string
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	return h.clientIPFrom(remoteAddr, md.Get("x-forwarded-for"))
+}
+
+func userIDFromContext(ctx context.Context) uint32 {
+	return ctx.Value(userIDContextKey{}).(uint32)
+}
+
+func (s *GRPCServer) Shorten(ctx context.Context, req *pb.ShortenRequest) (*pb.ShortenResponse, error) {
+	url, err := s.handler.validateURL(ctx, req.GetUrl())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	longURL := url.String()
+	short := app.GenShort(longURL)
+	userID := userIDFromContext(ctx)
+	err = s.handler.storage.SaveLink(ctx, short, longURL, userID, s.handler.defaultLinkOptions(ctx, userID))
+	var duplicateErr *app.DuplicateError
+	existed := errors.As(err, &duplicateErr)
+	if err != nil && !existed {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.ShortenResponse{
+		Result:  strings.Join([]string{s.handler.baseServerURL, short}, "/"),
+		Existed: existed,
+	}, nil
+}
+
+func (s *GRPCServer) ShortenBatch(ctx context.Context, req *pb.ShortenBatchRequest) (*pb.ShortenBatchResponse, error) {
+	response := &pb.ShortenBatchResponse{}
+	shortToLong := make(map[string]string)
+	for i, item := range req.GetItems() {
+		url, err := s.handler.validateURL(ctx, item.GetOriginalUrl())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "item %d: %v", i, err)
+		}
+		short := app.GenShort(url.String())
+		shortToLong[short] = url.String()
+		response.Items = append(response.Items, &pb.ShortenBatchResponse_Item{
+			CorrelationId: item.GetCorrelationId(),
+			ShortUrl:      strings.Join([]string{s.handler.baseServerURL, short}, "/"),
+		})
+	}
+	if len(shortToLong) == 0 {
+		return response, nil
+	}
+	userID := userIDFromContext(ctx)
+	err := s.handler.storage.SaveLinkMulti(ctx, shortToLong, userID, s.handler.defaultLinkOptions(ctx, userID))
+	var duplicateErr *app.DuplicateError
+	response.Existed = errors.As(err, &duplicateErr)
+	if err != nil && !response.Existed {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return response, nil
+}
+
+// Resolve returns where a redirect of the link goes, after the same checks,
+// but doesn't count a click. Rules and A/B variants depend on the visitor
+// and are left out. Links outside their activation window resolve to their
+// fallback url. Protected links need their password, wrong passwords count
+// against the same attempt limit as the unlock page.
+func (s *GRPCServer) Resolve(ctx context.Context, req *pb.ResolveRequest) (*pb.ResolveResponse, error) {
+	short := req.GetId()
+	longURL, exists := s.handler.storage.GetURLFromShort(ctx, short)
+	if !exists {
+		return nil, status.Error(codes.NotFound, "no such short url")
+	}
+	opts, err := s.handler.storage.GetLinkOptions(ctx, short)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	destination, err := app.BuildDestination(longURL, opts, "", nil)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	state, fallbackURL, err := s.handler.checkLink(ctx, short, destination, opts)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	switch {
+	case state == linkDeleted:
+		return nil, status.Error(codes.NotFound, "link was deleted")
+	case state == linkDisabled:
+		return nil, status.Errorf(codes.FailedPrecondition, "link was taken down: %s", opts.Takedown.Reason)
+	case state == linkBlocked:
+		return nil, status.Error(codes.PermissionDenied, "destination is blocked")
+	case len(fallbackURL) > 0:
+		return &pb.ResolveResponse{OriginalUrl: fallbackURL}, nil
+	case state == linkNotStarted:
+		return nil, status.Errorf(codes.FailedPrecondition, "link is not active until %s", opts.ActiveFrom.UTC().Format(time.RFC3339))
+	case state == linkEnded:
+		return nil, status.Error(codes.FailedPrecondition, "link is no longer active")
+	case state == linkExhausted:
+		return nil, status.Error(codes.ResourceExhausted, "link has used up its clicks")
+	}
+	if opts.IsProtected() {
+		ip := s.handler.grpcClientIP(ctx)
+		allowed, _ := s.handler.acquireUnlock(short, ip)
+		if !allowed {
+			return nil, status.Error(codes.ResourceExhausted, "too many failed attempts, try again later")
+		}
+		if !app.CheckPassword(opts.PasswordHash, req.GetPassword()) {
+			return nil, status.Error(codes.PermissionDenied, "wrong password")
+		}
+		s.handler.releaseUnlock(short, ip)
+	}
+	return &pb.ResolveResponse{OriginalUrl: destination}, nil
+}
+
+func (s *GRPCServer) ListUserURLs(ctx context.Context, req *pb.ListUserURLsRequest) (*pb.ListUserURLsResponse, error) {
+	userURLs, err := s.handler.userURLs(ctx, userIDFromContext(ctx))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	response := &pb.ListUserURLsResponse{}
+	for _, userURL := range userURLs {
+		response.Urls = append(response.Urls, &pb.UserURL{
+			ShortUrl:       userURL.ShortURL,
+			OriginalUrl:    userURL.LongURL,
+			Status:         userURL.Status,
+			TakedownReason: userURL.TakedownReason,
+		})
+	}
+	return response, nil
+}
+
+func (s *GRPCServer) DeleteUserURLs(ctx context.Context, req *pb.DeleteUserURLsRequest) (*pb.DeleteUserURLsResponse, error) {
+	if err := s.handler.deleteUserURLs(ctx, userIDFromContext(ctx), req.GetIds()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.DeleteUserURLsResponse{}, nil
+}
+
+func (s *GRPCServer) Ping(ctx context.Context, req *pb.PingRequest) (*pb.PingResponse, error) {
+	if err := s.handler.pingStorage(ctx); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.PingResponse{}, nil
+}
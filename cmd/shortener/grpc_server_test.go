@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+	pb "github.com/evgenspj/url-shortener/internal/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestGRPCClient(t *testing.T, handler *Handler) pb.ShortenerClient {
+	listener := bufconn.Listen(1024 * 1024)
+	server := NewGRPCServer(handler)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.DialContext(
+		context.Background(),
+		"bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewShortenerClient(conn)
+}
+
+func withUserToken(userToken string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), userTokenMetadataKey, userToken)
+}
+
+func TestGRPCServer(t *testing.T) {
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL:  defaultBaseURL,
+		unlockAttempts: app.AttemptLimiter{MaxAttempts: 2},
+	}
+	client := newTestGRPCClient(t, &handler)
+	ts := httptest.NewServer(middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	var header metadata.MD
+	shortened, err := client.Shorten(context.Background(), &pb.ShortenRequest{Url: "http://example.com/grpc"}, grpc.Header(&header))
+	require.NoError(t, err)
+	short := app.GenShort("http://example.com/grpc")
+	assert.Equal(t, defaultBaseURL+"/"+short, shortened.GetResult())
+	assert.False(t, shortened.GetExisted())
+	require.Len(t, header.Get(userTokenMetadataKey), 1, "a user token is issued")
+	userToken := header.Get(userTokenMetadataKey)[0]
+	assert.True(t, isValidToken(userToken))
+
+	t.Run("auth", func(t *testing.T) {
+		var header metadata.MD
+		shortened, err := client.Shorten(withUserToken(userToken), &pb.ShortenRequest{Url: "http://example.com/grpc"}, grpc.Header(&header))
+		require.NoError(t, err)
+		assert.True(t, shortened.GetExisted())
+		assert.Equal(t, []string{userToken}, header.Get(userTokenMetadataKey), "a valid token is kept")
+
+		_, err = client.Ping(withUserToken("ab"), &pb.PingRequest{}, grpc.Header(&header))
+		require.NoError(t, err)
+		assert.NotEqual(t, []string{"ab"}, header.Get(userTokenMetadataKey), "an invalid token is replaced")
+	})
+
+	t.Run("shorten", func(t *testing.T) {
+		_, err := client.Shorten(context.Background(), &pb.ShortenRequest{Url: "not an url"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("shorten batch", func(t *testing.T) {
+		batch, err := client.ShortenBatch(withUserToken(userToken), &pb.ShortenBatchRequest{Items: []*pb.ShortenBatchRequest_Item{
+			{CorrelationId: "b", OriginalUrl: "http://example.com/grpc/b"},
+			{CorrelationId: "a", OriginalUrl: "http://example.com/grpc/a"},
+		}})
+		require.NoError(t, err)
+		require.Len(t, batch.GetItems(), 2)
+		assert.Equal(t, "b", batch.GetItems()[0].GetCorrelationId())
+		assert.Equal(t, defaultBaseURL+"/"+app.GenShort("http://example.com/grpc/b"), batch.GetItems()[0].GetShortUrl())
+		assert.Equal(t, "a", batch.GetItems()[1].GetCorrelationId())
+		assert.False(t, batch.GetExisted())
+
+		_, err = client.ShortenBatch(context.Background(), &pb.ShortenBatchRequest{Items: []*pb.ShortenBatchRequest_Item{
+			{CorrelationId: "1", OriginalUrl: "http://example.com/grpc/1"},
+			{CorrelationId: "2", OriginalUrl: "ftp://example.com/grpc/2"},
+		}})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, exists := handler.storage.GetURLFromShort(context.Background(), app.GenShort("http://example.com/grpc/1"))
+		assert.False(t, exists, "nothing is saved from an invalid batch")
+	})
+
+	t.Run("resolve", func(t *testing.T) {
+		resolved, err := client.Resolve(context.Background(), &pb.ResolveRequest{Id: short})
+		require.NoError(t, err)
+		assert.Equal(t, "http://example.com/grpc", resolved.GetOriginalUrl())
+
+		_, err = client.Resolve(context.Background(), &pb.ResolveRequest{Id: "unknown"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+
+		passwordHash, err := app.HashPassword("secret")
+		require.NoError(t, err)
+		protected := app.GenShort("http://example.com/grpc/protected")
+		require.NoError(t, handler.storage.SaveLink(context.Background(), protected, "http://example.com/grpc/protected", 1, app.LinkOptions{PasswordHash: passwordHash}))
+		_, err = client.Resolve(context.Background(), &pb.ResolveRequest{Id: protected})
+		assert.Equal(t, codes.PermissionDenied, status.Code(err))
+		resolved, err = client.Resolve(context.Background(), &pb.ResolveRequest{Id: protected, Password: "secret"})
+		require.NoError(t, err)
+		assert.Equal(t, "http://example.com/grpc/protected", resolved.GetOriginalUrl())
+		for i := 0; i < 2; i++ {
+			client.Resolve(context.Background(), &pb.ResolveRequest{Id: protected, Password: "wrong"})
+		}
+		_, err = client.Resolve(context.Background(), &pb.ResolveRequest{Id: protected, Password: "secret"})
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	})
+
+	t.Run("list and delete", func(t *testing.T) {
+		list, err := client.ListUserURLs(withUserToken(userToken), &pb.ListUserURLsRequest{})
+		require.NoError(t, err)
+		assert.Len(t, list.GetUrls(), 3)
+		assert.Equal(t, linkStatusActive, list.GetUrls()[0].GetStatus())
+
+		list, err = client.ListUserURLs(context.Background(), &pb.ListUserURLsRequest{})
+		require.NoError(t, err)
+		assert.Empty(t, list.GetUrls(), "new users have no links")
+
+		_, err = client.DeleteUserURLs(withUserToken(genUserToken()), &pb.DeleteUserURLsRequest{Ids: []string{short}})
+		require.NoError(t, err)
+		_, err = client.Resolve(context.Background(), &pb.ResolveRequest{Id: short})
+		require.NoError(t, err, "links of other users are not deleted")
+
+		_, err = client.DeleteUserURLs(withUserToken(userToken), &pb.DeleteUserURLsRequest{Ids: []string{short, "unknown"}})
+		require.NoError(t, err)
+		_, err = client.Resolve(context.Background(), &pb.ResolveRequest{Id: short})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		list, err = client.ListUserURLs(withUserToken(userToken), &pb.ListUserURLsRequest{})
+		require.NoError(t, err)
+		assert.Len(t, list.GetUrls(), 2)
+
+		resp := testRequest(testRequestArgs{
+			t:      t,
+			ts:     ts,
+			method: http.MethodGet,
+			path:   "/" + short,
+		})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusGone, resp.StatusCode, "deleted links don't redirect")
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		_, err := client.Ping(context.Background(), &pb.PingRequest{})
+		assert.NoError(t, err)
+	})
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+		rateLimiter:   &app.MemoryRateLimiter{},
+		createLimit:   app.RateLimit{Rate: 1.0 / 60, Burst: 3},
+	}
+	client := newTestGRPCClient(t, &handler)
+	batch := func(size int) *pb.ShortenBatchRequest {
+		req := &pb.ShortenBatchRequest{}
+		for i := 0; i < size; i++ {
+			req.Items = append(req.Items, &pb.ShortenBatchRequest_Item{
+				CorrelationId: strconv.Itoa(i),
+				OriginalUrl:   "http://example.com/grpc/limited/" + strconv.Itoa(i),
+			})
+		}
+		return req
+	}
+
+	_, err := client.ShortenBatch(context.Background(), batch(4))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "a batch larger than the burst never passes")
+	_, err = client.ShortenBatch(context.Background(), batch(2))
+	require.NoError(t, err)
+	_, err = client.Shorten(context.Background(), &pb.ShortenRequest{Url: "http://example.com/grpc/limited"})
+	require.NoError(t, err)
+
+	var header metadata.MD
+	_, err = client.Shorten(context.Background(), &pb.ShortenRequest{Url: "http://example.com/grpc/limited"}, grpc.Header(&header))
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "each item of a batch takes a token")
+	assert.NotEmpty(t, header.Get("retry-after"))
+	_, err = client.Ping(context.Background(), &pb.PingRequest{})
+	assert.NoError(t, err, "only creating links is limited")
+}
+
+func TestGRPCResolveChecks(t *testing.T) {
+	blocklistFile := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("evil.com\n"), 0644))
+	domainFilter := &app.DomainFilter{BlocklistFile: blocklistFile}
+	require.NoError(t, domainFilter.Reload())
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+		domainFilter:  domainFilter,
+	}
+	client := newTestGRPCClient(t, &handler)
+	ctx := context.Background()
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	links := map[string]app.LinkOptions{
+		"later":     {ActiveFrom: &future},
+		"ended":     {ActiveUntil: &past, AfterURL: "http://example.com/after"},
+		"limited":   {MaxClicks: 1},
+		"blocked":   {},
+		"fallback":  {ActiveUntil: &past, AfterURL: "http://evil.com/after"},
+		"tagged":    {UTM: &app.UTMParams{Source: "grpc"}},
+		"taken":     {Takedown: &app.Takedown{Status: http.StatusUnavailableForLegalReasons, Reason: "spam"}},
+		"available": {MaxClicks: 2},
+	}
+	for short, opts := range links {
+		longURL := "http://example.com/" + short
+		if short == "blocked" {
+			longURL = "http://evil.com/"
+		}
+		require.NoError(t, handler.storage.SaveLink(ctx, short, longURL, 1, opts))
+	}
+	ok, err := handler.storage.ConsumeClick(ctx, "limited")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	tests := []struct {
+		short string
+		code  codes.Code
+		url   string
+	}{
+		{short: "later", code: codes.FailedPrecondition},
+		{short: "ended", code: codes.OK, url: "http://example.com/after"},
+		{short: "limited", code: codes.ResourceExhausted},
+		{short: "blocked", code: codes.PermissionDenied},
+		{short: "fallback", code: codes.PermissionDenied},
+		{short: "tagged", code: codes.OK, url: "http://example.com/tagged?utm_source=grpc"},
+		{short: "taken", code: codes.FailedPrecondition},
+		{short: "available", code: codes.OK, url: "http://example.com/available"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.short, func(t *testing.T) {
+			resolved, err := client.Resolve(ctx, &pb.ResolveRequest{Id: tt.short})
+			require.Equal(t, tt.code, status.Code(err), "%v", err)
+			assert.Equal(t, tt.url, resolved.GetOriginalUrl())
+		})
+	}
+	clicksLeft, _, err := handler.storage.ClicksLeft(ctx, "available")
+	require.NoError(t, err)
+	assert.Equal(t, 2, clicksLeft, "resolving doesn't take a click")
+}
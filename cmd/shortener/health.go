@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+)
+
+// Statuses of /healthz, /readyz and their components.
+const (
+	healthStatusOK           = "ok"
+	healthStatusUnavailable  = "unavailable"
+	healthStatusShuttingDown = "shutting_down"
+)
+
+// healthCheckTimeout bounds the check of a single component.
+const healthCheckTimeout = 2 * time.Second
+
+type HealthJSONResponse struct {
+	Status     string                         `json:"status"`
+	Components map[string]ComponentHealthJSON `json:"components,omitempty"`
+}
+
+type ComponentHealthJSON struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// LivenessHandler answers as long as the server is able to handle requests
+// at all, restarting it is the only cure otherwise.
+func (h *Handler) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, HealthJSONResponse{Status: healthStatusOK})
+}
+
+// ReadinessHandler tells whether the server should get traffic. It checks
+// every component implementing app.HealthChecker and reports not ready
+// during a graceful shutdown.
+func (h *Handler) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	response := HealthJSONResponse{Status: healthStatusOK, Components: h.checkComponents(r.Context())}
+	for _, component := range response.Components {
+		if component.Status != healthStatusOK {
+			response.Status = healthStatusUnavailable
+		}
+	}
+	if h.isShuttingDown() {
+		response.Status = healthStatusShuttingDown
+	}
+	status := http.StatusOK
+	if response.Status != healthStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, status, response)
+}
+
+// checkComponents checks the components able to tell their health, the
+// others are left out.
+func (h *Handler) checkComponents(ctx context.Context) map[string]ComponentHealthJSON {
+	components := map[string]interface{}{
+		"storage":      h.storage,
+		"rate_limiter": h.rateLimiter,
+		"idempotency":  h.idempotency,
+	}
+	health := make(map[string]ComponentHealthJSON)
+	for name, component := range components {
+		checker, ok := component.(app.HealthChecker)
+		if !ok {
+			continue
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := checker.CheckHealth(checkCtx)
+		cancel()
+		if err != nil {
+			health[name] = ComponentHealthJSON{Status: healthStatusUnavailable, Error: err.Error()}
+		} else {
+			health[name] = ComponentHealthJSON{Status: healthStatusOK}
+		}
+	}
+	return health
+}
+
+func writeHealth(w http.ResponseWriter, status int, response HealthJSONResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// beginShutdown makes the server report not ready, so load balancers stop
+// sending traffic before it stops.
+func (h *Handler) beginShutdown() {
+	atomic.StoreInt32(&h.shuttingDown, 1)
+}
+
+func (h *Handler) isShuttingDown() bool {
+	return atomic.LoadInt32(&h.shuttingDown) == 1
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	// idempotencyLockTTL is how long a key stays claimed by a request that
+	// never finished, e.g. because the server stopped.
+	idempotencyLockTTL = 5 * time.Minute
+	// maxIdempotentRequestSize bounds the bodies of requests with a key, they
+	// are read at once to be compared with the retries.
+	maxIdempotentRequestSize = 10 << 20
+	// maxIdempotentResponseSize bounds the responses kept for retries, larger
+	// ones are not kept and retries are handled again.
+	maxIdempotentResponseSize = 10 << 20
+)
+
+// idempotencyHandle replays the response of a request sent with an
+// Idempotency-Key to retries of it, so retrying a request that succeeded
+// doesn't shorten the urls again. Keys are per user. A key reused for
+// another request is refused, as is a retry while the request is still
+// handled. Server errors and rate limited requests are not kept.
+//
+// Streamed requests are handled as they come, without a replay.
+//
+// Requests without a user token get a new user on every try, so their keys
+// are scoped by the request instead.
+func (h *Handler) idempotencyHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if len(key) == 0 || h.idempotency == nil || h.idempotencyTTL <= 0 || isStreamed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, r, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("%s is longer than %d characters", idempotencyKeyHeader, maxIdempotencyKeyLength), map[string]interface{}{
+				"header": idempotencyKeyHeader,
+			})
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentRequestSize+1))
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, errCodeInvalidEncoding, "Can't read the request body: "+err.Error(), nil)
+			return
+		}
+		if len(body) > maxIdempotentRequestSize {
+			writeError(w, r, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge, fmt.Sprintf("Requests with an %s may have up to %d bytes", idempotencyKeyHeader, maxIdempotentRequestSize), map[string]interface{}{
+				"limit": maxIdempotentRequestSize,
+			})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := requestFingerprint(r, body)
+		storeKey := idempotencyStoreKey(r, w, key, fingerprint)
+		record, reserved, err := h.idempotency.Reserve(r.Context(), storeKey, fingerprint, idempotencyLockTTL)
+		if err != nil {
+			// the request is handled as if it had no key
+			log.Printf("can't reserve idempotency key: %v", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !reserved {
+			switch {
+			case record.Fingerprint != fingerprint:
+				writeError(w, r, http.StatusUnprocessableEntity, errCodeIdempotencyKeyReused, idempotencyKeyHeader+" was used for another request", nil)
+			case record.Response == nil:
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusConflict, errCodeIdempotencyKeyInUse, "The request with this "+idempotencyKeyHeader+" is still being handled", nil)
+			default:
+				replayResponse(w, *record.Response)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		completed := false
+		defer func() {
+			// also run when the handler panics
+			if !completed {
+				if err := h.idempotency.Release(r.Context(), storeKey); err != nil {
+					log.Printf("can't release idempotency key: %v", err)
+				}
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests || recorder.overflow {
+			return
+		}
+		response := app.IdempotentResponse{
+			Status:      status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		}
+		if err := h.idempotency.Complete(r.Context(), storeKey, response, h.idempotencyTTL); err != nil {
+			log.Printf("can't keep idempotent response: %v", err)
+			return
+		}
+		completed = true
+	})
+}
+
+// isStreamed tells if the request is an NDJSON stream, whose response is
+// written while it is read.
+func isStreamed(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-ndjson"
+}
+
+// idempotencyStoreKey scopes the key by the user sending it. A request
+// without a valid user token gets a new user, its retry would get another
+// one, so the key is scoped by the request itself.
+func idempotencyStoreKey(r *http.Request, w http.ResponseWriter, key string, fingerprint string) string {
+	if cookie, err := r.Cookie("user_token"); err != nil || !isValidToken(cookie.Value) {
+		return "anonymous:" + fingerprint + ":" + key
+	}
+	userID := getUserTokenFromWriter(w)
+	return strconv.FormatUint(uint64(userID), 10) + ":" + key
+}
+
+// requestFingerprint tells apart requests reusing an idempotency key.
+func requestFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s?%s\n%s\n", r.Method, r.URL.Path, r.URL.RawQuery, r.Header.Get("Content-Type"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func replayResponse(w http.ResponseWriter, response app.IdempotentResponse) {
+	if len(response.ContentType) > 0 {
+		w.Header().Set("Content-Type", response.ContentType)
+	}
+	w.Header().Set(idempotencyReplayedHeader, "true")
+	w.WriteHeader(response.Status)
+	w.Write(response.Body)
+}
+
+// responseRecorder keeps a copy of the response written through it, up to
+// maxIdempotentResponseSize.
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *responseRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.overflow {
+		if w.body.Len()+len(b) > maxIdempotentResponseSize {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseRecorder) Flush() {
+	flushResponse(w.ResponseWriter)
+}
+
+func (w *responseRecorder) EnableFullDuplex() error {
+	if duplexer, ok := w.ResponseWriter.(fullDuplexer); ok {
+		return duplexer.EnableFullDuplex()
+	}
+	return errFullDuplexUnsupported
+}
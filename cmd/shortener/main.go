@@ -3,78 +3,83 @@ package main
 import (
 	"context"
 	"database/sql"
-	"flag"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	"github.com/caarlos0/env/v6"
 	"github.com/evgenspj/url-shortener/internal/app"
 	"github.com/go-chi/chi/v5"
 	_ "github.com/jackc/pgx/stdlib"
+	"google.golang.org/grpc"
 )
 
 func NewRouter(handler *Handler) chi.Router {
 	r := chi.NewRouter()
-	r.Post("/", handler.ShortenHandler)
-	r.Post("/api/shorten", handler.ShortenHandlerJSON)
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
+	r.Use(recoverHandle)
+	createLimited := r.With(handler.rateLimitHandle(rateLimitCreate, handler.createLimit))
+	// replays don't count against the rate limit
+	idempotentCreate := r.With(handler.idempotencyHandle, handler.rateLimitHandle(rateLimitCreate, handler.createLimit))
+	redirectLimited := r.With(handler.rateLimitHandle(rateLimitRedirect, handler.redirectLimit))
+	idempotentCreate.Post("/", handler.ShortenHandler)
+	idempotentCreate.Post("/api/shorten", handler.ShortenHandlerJSON)
 	r.Get("/api/user/urls", handler.UserURLs)
-	r.Get("/{ID}", handler.GetFromShortHandler)
+	r.Delete("/api/user/urls", handler.DeleteUserURLs)
+	r.Get("/api/user/urls/export", handler.ExportUserURLs)
+	createLimited.Post("/api/user/import", handler.ImportUserURLs)
+	r.Get("/api/user/urls/{ID}/rules", handler.GetLinkRules)
+	r.Put("/api/user/urls/{ID}/rules", handler.UpdateLinkRules)
+	r.Get("/api/user/urls/{ID}/variants", handler.GetLinkVariants)
+	r.Put("/api/user/urls/{ID}/variants", handler.UpdateLinkVariants)
+	r.Get("/api/user/urls/{ID}/stats", handler.GetLinkStats)
+	redirectLimited.Get("/api/urls/{ID}", handler.GetLinkInfo)
+	r.Get("/api/user/settings", handler.GetUserSettings)
+	r.Put("/api/user/settings", handler.UpdateUserSettings)
+	redirectLimited.Get("/{ID:[^/]+\\+}", handler.PreviewHandler)
+	redirectLimited.Get("/{ID}/preview", handler.PreviewHandler)
+	redirectLimited.Get("/{ID}/qr.png", handler.QRCodePNGHandler)
+	redirectLimited.Get("/{ID}/qr.svg", handler.QRCodeSVGHandler)
+	redirectLimited.Get("/{ID}", handler.GetFromShortHandler)
+	redirectLimited.Head("/{ID}", handler.GetFromShortHandler)
+	redirectLimited.Post("/{ID}", handler.UnlockShortHandler)
+	redirectLimited.Get("/{ID}/*", handler.GetFromShortHandler)
+	redirectLimited.Head("/{ID}/*", handler.GetFromShortHandler)
+	redirectLimited.Post("/{ID}/*", handler.UnlockShortHandler)
+	r.With(handler.rateLimitHandle(rateLimitReport, handler.createLimit)).Post("/api/report/{ID}", handler.ReportHandler)
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(handler.adminHandle)
+		r.Get("/reports", handler.GetAbuseReports)
+		r.Get("/domain-filter", handler.GetDomainFilterStats)
+		r.Post("/urls/{ID}/disable", handler.DisableLink)
+		r.Post("/urls/{ID}/enable", handler.EnableLink)
+		r.Post("/urls/{ID}/dismiss", handler.DismissReports)
+		r.Put("/users/{userID}/trust", handler.SetUserTrust)
+	})
+	r.Get("/api/openapi.json", handler.OpenAPIHandler)
 	r.Get("/ping", handler.PingHandler)
-	r.Post("/api/shorten/batch", handler.ShortenBatchHandler)
+	r.Get("/healthz", handler.LivenessHandler)
+	r.Get("/readyz", handler.ReadinessHandler)
+	idempotentCreate.Post("/api/shorten/batch", handler.ShortenBatchHandler)
 	return r
 }
 
-const (
-	defaultBaseURL       = "http://localhost:8080"
-	defaultServerAddress = "localhost:8080"
-)
-
-type EnvConfig struct {
-	BaseURL         string `env:"BASE_URL"`
-	ServerAddress   string `env:"SERVER_ADDRESS"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
-	PostgresConStr  string `env:"DATABASE_DSN"`
-}
-
 func main() {
-	// comand line args
-	argServerAddress := flag.String("a", "", "usage")
-	argBaseURL := flag.String("b", "", "usage")
-	argFileStoragePath := flag.String("f", "", "usage")
-	argPostgresConStr := flag.String("d", "", "usage")
-	flag.Parse()
-
-	// environment variables
-	var envCfg EnvConfig
-	err := env.Parse(&envCfg)
+	cfg, err := parseConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	var serverAddress string
-	switch {
-	case len(*argServerAddress) > 0:
-		serverAddress = *argServerAddress
-	case len(envCfg.ServerAddress) > 0:
-		serverAddress = envCfg.ServerAddress
-	default:
-		serverAddress = defaultServerAddress
-	}
-
-	var baseURL string
-	switch {
-	case len(*argBaseURL) > 0:
-		baseURL = *argBaseURL
-	case len(envCfg.BaseURL) > 0:
-		baseURL = envCfg.BaseURL
-	default:
-		baseURL = defaultBaseURL
-	}
-
 	var storage app.Storage
+	var db *sql.DB
 	switch {
-	case len(*argPostgresConStr) > 0:
-		db, err := sql.Open("pgx", *argPostgresConStr)
+	case len(cfg.PostgresConStr) > 0:
+		db, err = sql.Open("pgx", cfg.PostgresConStr)
 		if err != nil {
 			panic(err)
 		}
@@ -84,32 +89,152 @@ func main() {
 			panic(err)
 		}
 		storage = dbStorage
-	case len(*argFileStoragePath) > 0:
-		storage = &app.JSONFileStorage{Filename: *argFileStoragePath}
-	case len(envCfg.PostgresConStr) > 0:
-		db, err := sql.Open("pgx", envCfg.PostgresConStr)
+	case len(cfg.FileStoragePath) > 0:
+		storage = &app.JSONFileStorage{Filename: cfg.FileStoragePath}
+	default:
+		storage = &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		}
+	}
+
+	urlValidator := app.URLValidator{
+		AllowedSchemes: cfg.AllowedSchemes,
+		MaxLength:      cfg.MaxURLLength,
+		Resolver:       net.DefaultResolver,
+	}
+	if !cfg.AllowSelfLinks {
+		baseURL, err := url.Parse(cfg.BaseURL)
 		if err != nil {
-			panic(err)
+			log.Fatal(err)
 		}
-		defer db.Close()
-		dbStorage := &app.PostgresStorage{DB: db}
-		if err := dbStorage.Init(context.Background()); err != nil {
+		urlValidator.SelfHost = baseURL.Hostname()
+	}
+
+	var domainFilter *app.DomainFilter
+	if len(cfg.BlocklistFile) > 0 || len(cfg.AllowlistFile) > 0 {
+		domainFilter = &app.DomainFilter{
+			BlocklistFile: cfg.BlocklistFile,
+			AllowlistFile: cfg.AllowlistFile,
+		}
+		if err := domainFilter.Reload(); err != nil {
+			log.Fatal(err)
+		}
+		go domainFilter.Watch(context.Background(), domainListsPollInterval)
+		go reloadOnSighup(domainFilter)
+	}
+
+	var rateLimiter app.RateLimiter
+	switch cfg.RateLimitStore {
+	case rateLimitStorePostgres:
+		postgresRateLimiter := &app.PostgresRateLimiter{DB: db}
+		if err := postgresRateLimiter.Init(context.Background()); err != nil {
 			panic(err)
 		}
-		storage = dbStorage
-	case len(envCfg.FileStoragePath) > 0:
-		storage = &app.JSONFileStorage{Filename: envCfg.FileStoragePath}
+		rateLimiter = postgresRateLimiter
 	default:
-		storage = &app.StructStorage{
-			ShortToLong:   make(map[string]string),
-			UserIDToShort: make(map[uint32][]string),
+		rateLimiter = &app.MemoryRateLimiter{}
+	}
+
+	// responses are kept with the links, so retries reaching another
+	// instance are replayed too
+	var idempotency app.IdempotencyStore
+	if db != nil {
+		postgresIdempotency := &app.PostgresIdempotencyStore{DB: db}
+		if err := postgresIdempotency.Init(context.Background()); err != nil {
+			panic(err)
 		}
+		idempotency = postgresIdempotency
+	} else {
+		idempotency = &app.MemoryIdempotencyStore{}
 	}
 
 	handler := Handler{
-		storage:       storage,
-		baseServerURL: baseURL,
+		storage:            storage,
+		baseServerURL:      cfg.BaseURL,
+		redirectCode:       cfg.RedirectCode,
+		urlValidator:       urlValidator,
+		domainFilter:       domainFilter,
+		linkUnlockAttempts: app.AttemptLimiter{MaxAttempts: maxLinkUnlockAttempts},
+		rateLimiter:        rateLimiter,
+		createLimit:        cfg.CreateLimit,
+		redirectLimit:      cfg.RedirectLimit,
+		trustedProxies:     cfg.TrustedProxies,
+		adminToken:         cfg.AdminToken,
+		maxBatchSize:       cfg.MaxBatchSize,
+		idempotency:        idempotency,
+		idempotencyTTL:     cfg.IdempotencyTTL,
+	}
+	var grpcServer *grpc.Server
+	if len(cfg.GRPCAddress) > 0 {
+		listener, err := net.Listen("tcp", cfg.GRPCAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcServer = NewGRPCServer(&handler)
+		go func() {
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
 	}
 	r := NewRouter(&handler)
-	http.ListenAndServe(serverAddress, middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	server := &http.Server{
+		Addr:    cfg.ServerAddress,
+		Handler: middlewareConveyor(r, gzipHandle, userTokenCookieHandle),
+	}
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(server, grpcServer, &handler)
+		close(stopped)
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-stopped
+}
+
+const (
+	// shutdownDrainDelay is how long the server keeps serving while it
+	// reports not ready, so load balancers notice before it stops.
+	shutdownDrainDelay = 5 * time.Second
+	// shutdownTimeout bounds the wait for the requests in flight.
+	shutdownTimeout = 30 * time.Second
+)
+
+// shutdownOnSignal stops the servers gracefully on SIGINT or SIGTERM.
+func shutdownOnSignal(server *http.Server, grpcServer *grpc.Server, handler *Handler) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	signal.Stop(signals)
+	log.Print("shutting down")
+	handler.beginShutdown()
+	time.Sleep(shutdownDrainDelay)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if grpcServer != nil {
+		go func() {
+			<-ctx.Done()
+			grpcServer.Stop()
+		}()
+		grpcServer.GracefulStop()
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("can't shut down gracefully: %v", err)
+	}
+}
+
+const domainListsPollInterval = 5 * time.Second
+
+func reloadOnSighup(domainFilter *app.DomainFilter) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := domainFilter.Reload(); err != nil {
+			log.Printf("can't reload domain lists: %v", err)
+		} else {
+			log.Print("domain lists reloaded")
+		}
+	}
 }
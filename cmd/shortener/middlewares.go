@@ -4,11 +4,14 @@ import (
 	"compress/gzip"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
 	"io"
+	"log"
 	"math/rand"
 	"net/http"
+	"runtime/debug"
 	"strings"
 )
 
@@ -21,6 +24,26 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush sends the data compressed so far, for handlers streaming their
+// response.
+func (w gzipWriter) Flush() {
+	if gz, ok := w.Writer.(*gzip.Writer); ok {
+		gz.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// EnableFullDuplex lets handlers streaming their response keep reading the
+// request body.
+func (w gzipWriter) EnableFullDuplex() error {
+	if duplexer, ok := w.ResponseWriter.(fullDuplexer); ok {
+		return duplexer.EnableFullDuplex()
+	}
+	return errFullDuplexUnsupported
+}
+
 type gzipBody struct {
 	Body   io.ReadCloser
 	Reader io.Reader
@@ -39,7 +62,7 @@ func gzipHandle(next http.Handler) http.Handler {
 		if strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
 			gz, err := gzip.NewReader(r.Body)
 			if err != nil {
-				io.WriteString(w, err.Error())
+				writeError(w, r, http.StatusBadRequest, errCodeInvalidEncoding, "Request body is not valid gzip: "+err.Error(), nil)
 				return
 			}
 			defer gz.Close()
@@ -49,7 +72,7 @@ func gzipHandle(next http.Handler) http.Handler {
 		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 			gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 			if err != nil {
-				io.WriteString(w, err.Error())
+				writeError(w, r, http.StatusInternalServerError, errCodeInternal, err.Error(), nil)
 				return
 			}
 			defer gz.Close()
@@ -63,6 +86,27 @@ func gzipHandle(next http.Handler) http.Handler {
 
 type Middleware func(http.Handler) http.Handler
 
+// recoverHandle answers api requests that panicked with a JSON error, other
+// requests are left to the server.
+func recoverHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isAPIRequest(r) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+				writeAPIError(w, http.StatusInternalServerError, errCodeInternal, "Internal server error", nil)
+			}()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func middlewareConveyor(h http.Handler, middlewares ...Middleware) http.Handler {
 	for _, middleware := range middlewares {
 		h = middleware(h)
@@ -92,6 +136,24 @@ func userTokenCookieHandle(next http.Handler) http.Handler {
 	})
 }
 
+// adminHandle lets through requests with the admin token, the admin api is
+// hidden while no token is configured.
+func (h *Handler) adminHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(h.adminToken) == 0 {
+			notFoundHandler(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.adminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAPIError(w, http.StatusUnauthorized, errCodeUnauthorized, "Admin token required", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 var secretKey = []byte("some secret key")
 
 func genUserToken() string {
@@ -115,7 +177,7 @@ func genUserID() uint32 {
 
 func isValidToken(token string) bool {
 	data, err := hex.DecodeString(token)
-	if err != nil {
+	if err != nil || len(data) < 4 {
 		return false
 	}
 	h := hmac.New(sha256.New, secretKey)
@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes every route of NewRouter, the tests check that the
+// handlers answer as documented.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func (h *Handler) OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
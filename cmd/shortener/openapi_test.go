@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type openAPIDocument struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components map[string]map[string]interface{}     `json:"components"`
+}
+
+type openAPIOperation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema map[string]interface{} `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]map[string]interface{} `json:"responses"`
+}
+
+func loadOpenAPI(t *testing.T) openAPIDocument {
+	doc := openAPIDocument{}
+	require.NoError(t, json.Unmarshal(openAPISpec, &doc))
+	return doc
+}
+
+func (doc openAPIDocument) operation(t *testing.T, path string, method string) openAPIOperation {
+	raw, exists := doc.Paths[path][strings.ToLower(method)]
+	require.True(t, exists, "%s %s is not documented", method, path)
+	op := openAPIOperation{}
+	require.NoError(t, json.Unmarshal(raw, &op))
+	return op
+}
+
+// resolve follows a local $ref like #/components/schemas/UserURL.
+func (doc openAPIDocument) resolve(node map[string]interface{}) map[string]interface{} {
+	for {
+		ref, isRef := node["$ref"].(string)
+		if !isRef {
+			return node
+		}
+		parts := strings.Split(strings.TrimPrefix(ref, "#/components/"), "/")
+		node = doc.Components[parts[0]][parts[1]].(map[string]interface{})
+	}
+}
+
+var chiParamPattern = regexp.MustCompile(`\{(\w+)(:[^}]*)?\}`)
+
+// openAPIPath converts a chi route pattern to the path of the document.
+func openAPIPath(route string) string {
+	if strings.HasSuffix(route, "/*") {
+		route = strings.TrimSuffix(route, "*") + "{path}"
+	}
+	return chiParamPattern.ReplaceAllStringFunc(route, func(param string) string {
+		match := chiParamPattern.FindStringSubmatch(param)
+		if strings.HasSuffix(match[2], `\+`) {
+			return "{" + match[1] + "}+"
+		}
+		return "{" + match[1] + "}"
+	})
+}
+
+// findPath matches a request path against the documented paths, preferring
+// the one with the most literal characters, like the router does.
+func (doc openAPIDocument) findPath(requestPath string) (string, bool) {
+	best, bestLiterals := "", -1
+	for path := range doc.Paths {
+		pattern := regexp.QuoteMeta(path)
+		pattern = strings.ReplaceAll(pattern, `\{path\}`, `.+`)
+		pattern = regexp.MustCompile(`\\\{\w+\\\}`).ReplaceAllString(pattern, `[^/]+`)
+		if !regexp.MustCompile("^" + pattern + "$").MatchString(requestPath) {
+			continue
+		}
+		literals := len(regexp.MustCompile(`\{\w+\}`).ReplaceAllString(path, ""))
+		if literals > bestLiterals {
+			best, bestLiterals = path, literals
+		}
+	}
+	return best, bestLiterals >= 0
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	doc := loadOpenAPI(t)
+	r := NewRouter(&Handler{})
+	routed := make(map[string]bool)
+	err := chi.Walk(r, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		path := openAPIPath(route)
+		routed[strings.ToLower(method)+" "+path] = true
+		_, documented := doc.Paths[path][strings.ToLower(method)]
+		assert.True(t, documented, "route %s %s is missing from openapi.json as %s", method, route, path)
+		return nil
+	})
+	require.NoError(t, err)
+	for path, item := range doc.Paths {
+		for method := range item {
+			if method == "parameters" {
+				continue
+			}
+			assert.True(t, routed[method+" "+path], "openapi.json documents %s %s which is not routed", method, path)
+		}
+	}
+}
+
+// validateSchema checks a decoded JSON value against the subset of the
+// OpenAPI schema object used by the document. Unlike JSON Schema, objects
+// without additionalProperties may not have undocumented properties, so that
+// new response fields can't be left out of the document.
+func (doc openAPIDocument) validateSchema(schema map[string]interface{}, value interface{}, at string) error {
+	schema = doc.resolve(schema)
+	if oneOf, hasOneOf := schema["oneOf"].([]interface{}); hasOneOf {
+		var errs []string
+		for _, alternative := range oneOf {
+			err := doc.validateSchema(alternative.(map[string]interface{}), value, at)
+			if err == nil {
+				return nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return fmt.Errorf("%s: matches none of the schemas: %s", at, strings.Join(errs, "; "))
+	}
+	if value == nil {
+		if nullable, _ := schema["nullable"].(bool); nullable {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not allowed", at)
+	}
+	if enum, hasEnum := schema["enum"].([]interface{}); hasEnum {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", at, value, enum)
+		}
+	}
+	switch schema["type"] {
+	case "object":
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return fmt.Errorf("%s: %v is not an object", at, value)
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		required, _ := schema["required"].([]interface{})
+		for _, name := range required {
+			if _, exists := object[name.(string)]; !exists {
+				return fmt.Errorf("%s: required property %s is missing", at, name)
+			}
+		}
+		for name, propertyValue := range object {
+			propertySchema, documented := properties[name].(map[string]interface{})
+			if !documented {
+				switch additional := schema["additionalProperties"].(type) {
+				case map[string]interface{}:
+					propertySchema = additional
+				case bool:
+					if additional {
+						continue
+					}
+				}
+			}
+			if propertySchema == nil {
+				if _, hasProperties := schema["properties"]; hasProperties || schema["additionalProperties"] != nil {
+					return fmt.Errorf("%s: property %s is not documented", at, name)
+				}
+				continue
+			}
+			if err := doc.validateSchema(propertySchema, propertyValue, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, isArray := value.([]interface{})
+		if !isArray {
+			return fmt.Errorf("%s: %v is not an array", at, value)
+		}
+		items, _ := schema["items"].(map[string]interface{})
+		for i, item := range array {
+			if err := doc.validateSchema(items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, isString := value.(string)
+		if !isString {
+			return fmt.Errorf("%s: %v is not a string", at, value)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("%s: %s is not a date-time", at, str)
+			}
+		}
+		if maxLength, hasMax := schema["maxLength"].(float64); hasMax && float64(len(str)) > maxLength {
+			return fmt.Errorf("%s: string is longer than %v", at, maxLength)
+		}
+	case "integer", "number":
+		number, isNumber := value.(float64)
+		if !isNumber {
+			return fmt.Errorf("%s: %v is not a number", at, value)
+		}
+		if schema["type"] == "integer" && number != float64(int64(number)) {
+			return fmt.Errorf("%s: %v is not an integer", at, value)
+		}
+	case "boolean":
+		if _, isBool := value.(bool); !isBool {
+			return fmt.Errorf("%s: %v is not a boolean", at, value)
+		}
+	}
+	return nil
+}
+
+// conformanceTransport checks every exchange against the document and
+// records the documented operations that were exercised.
+type conformanceTransport struct {
+	t         *testing.T
+	doc       openAPIDocument
+	exercised map[string]bool
+}
+
+func (c *conformanceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t := c.t
+	path, found := c.doc.findPath(req.URL.Path)
+	require.True(t, found, "no documented path for %s", req.URL.Path)
+	op := c.doc.operation(t, path, req.Method)
+	key := req.Method + " " + path
+	c.exercised[key] = true
+
+	if req.Body != nil && op.RequestBody != nil {
+		body, err := io.ReadAll(req.Body)
+		require.NoError(t, err)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if media, documented := op.RequestBody.Content[mediaType]; documented && mediaType == "application/json" && len(body) > 0 {
+			var value interface{}
+			require.NoError(t, json.Unmarshal(body, &value))
+			assert.NoError(t, c.doc.validateSchema(media.Schema, value, "request"), key)
+		}
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	documented, exists := op.Responses[fmt.Sprint(resp.StatusCode)]
+	if !assert.True(t, exists, "%s answered with undocumented status %d: %s", key, resp.StatusCode, body) {
+		return resp, nil
+	}
+	documented = c.doc.resolve(documented)
+	headers, _ := documented["headers"].(map[string]interface{})
+	for name, header := range headers {
+		if required, _ := c.doc.resolve(header.(map[string]interface{}))["required"].(bool); required {
+			assert.NotEmpty(t, resp.Header.Get(name), "%s %d misses the %s header", key, resp.StatusCode, name)
+		}
+	}
+	content, hasContent := documented["content"].(map[string]interface{})
+	if !hasContent {
+		return resp, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	media, documentedMedia := content[mediaType].(map[string]interface{})
+	if !assert.True(t, documentedMedia, "%s %d answered with undocumented content type %q", key, resp.StatusCode, mediaType) {
+		return resp, nil
+	}
+	if mediaType == "application/json" {
+		var value interface{}
+		require.NoError(t, json.Unmarshal(body, &value), "%s %d", key, resp.StatusCode)
+		assert.NoError(t, c.doc.validateSchema(media["schema"].(map[string]interface{}), value, "response"), "%s %d", key, resp.StatusCode)
+	}
+	if mediaType == "application/x-ndjson" {
+		for i, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+			var value interface{}
+			require.NoError(t, json.Unmarshal(line, &value), "%s %d", key, resp.StatusCode)
+			assert.NoError(t, c.doc.validateSchema(media["schema"].(map[string]interface{}), value, fmt.Sprintf("response line %d", i+1)), "%s %d", key, resp.StatusCode)
+		}
+	}
+	return resp, nil
+}
+
+func TestOpenAPIConformance(t *testing.T) {
+	const adminToken = "admin-secret"
+	doc := loadOpenAPI(t)
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL:  defaultBaseURL,
+		adminToken:     adminToken,
+		rateLimiter:    &app.MemoryRateLimiter{},
+		idempotency:    &app.MemoryIdempotencyStore{},
+		idempotencyTTL: time.Hour,
+		createLimit:    app.RateLimit{Rate: 1, Burst: 100},
+		redirectLimit:  app.RateLimit{Rate: 1, Burst: 100},
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	transport := &conformanceTransport{t: t, doc: doc, exercised: make(map[string]bool)}
+	newClient := func() *http.Client {
+		jar, err := cookiejar.New(nil)
+		require.NoError(t, err)
+		return &http.Client{
+			Transport: transport,
+			Jar:       jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	client := newClient()
+	do := func(client *http.Client, method string, path string, contentType string, body string, headers ...string) *http.Response {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if len(contentType) > 0 {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	const jsonType = "application/json"
+	const formType = "application/x-www-form-urlencoded"
+	asAdmin := []string{"Authorization", "Bearer " + adminToken}
+
+	do(client, http.MethodGet, "/api/openapi.json", "", "")
+	do(client, http.MethodGet, "/ping", "", "")
+	do(client, http.MethodGet, "/healthz", "", "")
+	do(client, http.MethodGet, "/readyz", "", "")
+
+	// the user's links
+	plainURL := "http://example.com/plain"
+	plain := app.GenShort(plainURL)
+	do(client, http.MethodPost, "/", "text/plain", plainURL)
+	do(client, http.MethodPost, "/", "text/plain", plainURL)
+	do(client, http.MethodPost, "/", "text/plain", "not an url")
+	optionsURL := "http://example.com/options"
+	options := app.GenShort(optionsURL)
+	do(client, http.MethodPost, "/api/shorten?qr=svg", jsonType, `{
+		"url": "`+optionsURL+`",
+		"title": "Options",
+		"forward_path": true,
+		"forward_query": true,
+		"query_conflict": "append",
+		"utm": {"source": "docs"},
+		"active_from": "2000-01-01T00:00:00Z"
+	}`)
+	do(client, http.MethodPost, "/api/shorten", jsonType, `{"url": "`+optionsURL+`"}`)
+	protectedURL := "http://example.com/protected"
+	protected := app.GenShort(protectedURL)
+	do(client, http.MethodPost, "/api/shorten", jsonType, `{"url": "`+protectedURL+`", "password": "secret", "redirect_code": 308}`)
+	do(client, http.MethodPost, "/api/shorten/batch?qr=png&size=100", jsonType, `[
+		{"correlation_id": "a", "original_url": "http://example.com/batch/a"},
+		{"correlation_id": "b", "original_url": "http://example.com/batch/b"}
+	]`)
+	do(client, http.MethodPost, "/", "text/plain", "http://example.com/idempotent", "Idempotency-Key", "key-1")
+	do(client, http.MethodPost, "/", "text/plain", "http://example.com/idempotent", "Idempotency-Key", "key-1")
+	do(client, http.MethodPost, "/api/shorten", jsonType, `{"url": "http://example.com/idempotent"}`, "Idempotency-Key", "key-1")
+	do(client, http.MethodPost, "/api/shorten/batch", jsonType, `[{"correlation_id": "a", "original_url": "http://example.com/batch/a"}]`, "Idempotency-Key", "key-1")
+	do(client, http.MethodPost, "/api/shorten/batch?qr=png&size=100", "application/x-ndjson", `{"correlation_id": "a", "original_url": "http://example.com/batch/a"}
+		{"correlation_id": "c", "original_url": "not an url"}
+		{"correlation_id": "d"`)
+	do(client, http.MethodPost, "/api/user/import", "text/csv", "short,original_url,campaign\nimported,http://example.com/imported,spring\nbad code,http://example.com/bad\n")
+	do(client, http.MethodPost, "/api/user/import", "application/x-ndjson", `{"original_url": "http://example.com/imported/jsonl", "created_at": "2020-01-01T00:00:00Z"}`+"\n{")
+	do(client, http.MethodPost, "/api/user/import", "text/csv", "short\nimported\n")
+	do(client, http.MethodGet, "/api/user/urls", "", "")
+	do(newClient(), http.MethodGet, "/api/user/urls", "", "")
+	do(client, http.MethodGet, "/api/user/urls/export", "", "")
+	do(client, http.MethodGet, "/api/user/urls/export?format=csv", "", "")
+	do(client, http.MethodGet, "/api/user/urls/export?format=jsonl", "", "")
+	do(client, http.MethodGet, "/api/user/urls/export?format=xml", "", "")
+
+	do(client, http.MethodPut, "/api/user/urls/"+options+"/rules", jsonType, `{"rules": [{"device": "ios", "url": "http://example.com/ios"}, {"header": {"name": "X-Beta"}, "url": "http://example.com/beta"}]}`)
+	do(client, http.MethodGet, "/api/user/urls/"+options+"/rules", "", "")
+	do(client, http.MethodGet, "/api/user/urls/"+plain+"/rules", "", "")
+	do(client, http.MethodPut, "/api/user/urls/"+options+"/variants", jsonType, `{"variants": [{"name": "a", "url": "http://example.com/a", "weight": 1}]}`)
+	do(client, http.MethodGet, "/api/user/urls/"+options+"/variants", "", "")
+	do(newClient(), http.MethodGet, "/api/user/urls/"+options+"/variants", "", "")
+	do(client, http.MethodPut, "/api/user/settings", jsonType, `{"default_utm": {"medium": "email"}}`)
+	do(client, http.MethodGet, "/api/user/settings", "", "")
+	do(newClient(), http.MethodGet, "/api/user/settings", "", "")
+
+	// visitors
+	do(client, http.MethodGet, "/"+plain, "", "")
+	do(client, http.MethodGet, "/"+options+"/docs?page=1", "", "")
+	do(client, http.MethodGet, "/"+protected, "", "")
+	do(client, http.MethodPost, "/"+protected, formType, "password=wrong")
+	do(client, http.MethodPost, "/"+protected, formType, "password=secret")
+	do(client, http.MethodPost, "/"+protected+"/more", formType, "password=secret")
+	do(client, http.MethodPost, "/"+plain, formType, "")
+	do(client, http.MethodGet, "/unknown", "", "")
+	do(client, http.MethodGet, "/"+plain+"+", "", "")
+	do(client, http.MethodGet, "/"+protected+"/preview", "", "")
+	do(client, http.MethodGet, "/"+plain+"/qr.png", "", "")
+	do(client, http.MethodGet, "/"+plain+"/qr.svg?level=H&margin=1", "", "")
+	do(client, http.MethodGet, "/"+plain+"/qr.svg?level=X", "", "")
+	do(client, http.MethodGet, "/api/user/urls/"+options+"/stats", "", "")
+	do(client, http.MethodHead, "/"+plain, "", "")
+	do(client, http.MethodHead, "/"+options+"/docs", "", "")
+	do(client, http.MethodGet, "/api/urls/"+options, "", "")
+	do(newClient(), http.MethodGet, "/api/urls/"+protected, "", "")
+	do(client, http.MethodGet, "/api/urls/unknown", "", "")
+
+	// abuse reports
+	do(client, http.MethodPost, "/api/report/"+plain, jsonType, `{"reason": "spam"}`)
+	do(client, http.MethodPost, "/api/report/unknown", jsonType, `{"reason": "spam"}`)
+	do(client, http.MethodGet, "/api/admin/reports", "", "")
+	do(client, http.MethodGet, "/api/admin/reports", "", "", asAdmin...)
+	do(client, http.MethodGet, "/api/admin/domain-filter", "", "", asAdmin...)
+	do(client, http.MethodPost, "/api/admin/urls/"+plain+"/disable", jsonType, `{"status": 451, "reason": "spam"}`, asAdmin...)
+	do(client, http.MethodGet, "/"+plain, "", "")
+	do(client, http.MethodGet, "/"+plain+"/preview", "", "")
+	do(client, http.MethodGet, "/api/user/urls", "", "")
+	do(client, http.MethodPost, "/api/admin/urls/"+plain+"/enable", "", "", asAdmin...)
+	do(client, http.MethodPost, "/api/admin/urls/"+plain+"/dismiss", "", "", asAdmin...)
+	do(client, http.MethodPut, "/api/admin/users/42/trust", jsonType, `{"untrusted": true}`, asAdmin...)
+
+	// deleted links
+	do(client, http.MethodDelete, "/api/user/urls", jsonType, `["`+plain+`"]`)
+	do(client, http.MethodDelete, "/api/user/urls", "text/plain", plain)
+	do(client, http.MethodGet, "/"+plain, "", "")
+	do(client, http.MethodGet, "/"+plain+"+", "", "")
+
+	// rate limits
+	for i := 0; i < 3; i++ {
+		do(client, http.MethodPost, "/api/shorten/batch", jsonType, `[{"correlation_id": "x", "original_url": "http://example.com/x"}]`)
+	}
+	handler.createLimit = app.RateLimit{Rate: 1.0 / 60, Burst: 1}
+	limited := httptest.NewServer(middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle))
+	defer limited.Close()
+	ts.URL = limited.URL
+	do(client, http.MethodPost, "/", "text/plain", "http://example.com/limited")
+	do(client, http.MethodPost, "/", "text/plain", "http://example.com/limited")
+
+	handler.beginShutdown()
+	do(client, http.MethodGet, "/readyz", "", "")
+
+	var missed []string
+	for path, item := range doc.Paths {
+		for method := range item {
+			key := strings.ToUpper(method) + " " + path
+			if method != "parameters" && !transport.exercised[key] {
+				missed = append(missed, key)
+			}
+		}
+	}
+	sort.Strings(missed)
+	assert.Empty(t, missed, "documented operations the test doesn't exercise")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/evgenspj/url-shortener/internal/app"
+)
+
+// Kinds of requests limited separately.
+const (
+	rateLimitCreate   = "create"
+	rateLimitRedirect = "redirect"
+	rateLimitReport   = "report"
+)
+
+// rateLimitHandle takes one token per request from the buckets of the client
+// ip and, if the request carries a valid user token, of the user.
+func (h *Handler) rateLimitHandle(kind string, limit app.RateLimit) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !h.takeRateLimit(w, r, kind, limit, 1) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// takeRateLimit takes cost tokens and sets the RateLimit-* headers of the
+// strictest bucket. It writes an error response and returns false if the
+// request is over the limit. Limiter errors let the request through.
+func (h *Handler) takeRateLimit(w http.ResponseWriter, r *http.Request, kind string, limit app.RateLimit, cost int) bool {
+	if h.rateLimiter == nil || !limit.Enabled() || cost <= 0 {
+		return true
+	}
+	if cost > limit.Burst {
+		writeError(w, r, http.StatusRequestEntityTooLarge, errCodeRequestTooLarge, fmt.Sprintf("Request costs more than %d requests allowed at once", limit.Burst), map[string]interface{}{
+			"limit": limit.Burst,
+		})
+		return false
+	}
+	strictest := h.allowRateLimit(r, kind, limit, cost)
+	if strictest == nil {
+		return true
+	}
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(strictest.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(strictest.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(strictest.Reset)))
+	if !strictest.Allowed {
+		retryAfter := ceilSeconds(strictest.RetryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeError(w, r, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests", map[string]interface{}{
+			"retry_after": retryAfter,
+		})
+		return false
+	}
+	return true
+}
+
+// allowRateLimit takes cost tokens from the buckets of the request and
+// returns the result of the strictest one, nil if no bucket could be checked.
+// Unlike takeRateLimit it leaves the response alone, for requests answered
+// already.
+func (h *Handler) allowRateLimit(r *http.Request, kind string, limit app.RateLimit, cost int) *app.RateLimitResult {
+	keys := []string{ipRateLimitKey(kind, h.clientIP(r))}
+	if cookie, err := r.Cookie("user_token"); err == nil && isValidToken(cookie.Value) {
+		keys = append(keys, userRateLimitKey(kind, app.GetUserIDFromToken(cookie.Value)))
+	}
+	return h.allowRateLimitKeys(r.Context(), keys, limit, cost)
+}
+
+func (h *Handler) allowRateLimitKeys(ctx context.Context, keys []string, limit app.RateLimit, cost int) *app.RateLimitResult {
+	var strictest *app.RateLimitResult
+	for _, key := range keys {
+		result, err := h.rateLimiter.Allow(ctx, key, limit, cost)
+		if err != nil {
+			log.Printf("can't check rate limit of %s: %v", key, err)
+			continue
+		}
+		if strictest == nil || isStricter(result, *strictest) {
+			strictest = &result
+		}
+	}
+	return strictest
+}
+
+func ipRateLimitKey(kind string, ip string) string {
+	return "ip:" + kind + ":" + ip
+}
+
+func userRateLimitKey(kind string, userID uint32) string {
+	return "user:" + kind + ":" + strconv.FormatUint(uint64(userID), 10)
+}
+
+func isStricter(a, b app.RateLimitResult) bool {
+	if a.Allowed != b.Allowed {
+		return !a.Allowed
+	}
+	if !a.Allowed {
+		return a.RetryAfter > b.RetryAfter
+	}
+	return a.Remaining < b.Remaining
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only read
+// when the request comes from a trusted proxy, and only up to the first
+// address that is not a trusted proxy itself.
+func (h *Handler) clientIP(r *http.Request) string {
+	return h.clientIPFrom(r.RemoteAddr, r.Header.Values("X-Forwarded-For"))
+}
+
+func (h *Handler) clientIPFrom(remoteAddr string, forwardedFor []string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !h.isTrustedProxy(ip) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(forwardedFor, ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+		if !h.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+func (h *Handler) isTrustedProxy(ip net.IP) bool {
+	for _, network := range h.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
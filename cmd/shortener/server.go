@@ -3,10 +3,15 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"mime"
+	"net"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/evgenspj/url-shortener/internal/app"
 	"github.com/go-chi/chi/v5"
@@ -15,29 +20,167 @@ import (
 type Handler struct {
 	storage       app.Storage
 	baseServerURL string
+	redirectCode  int
+	urlValidator  app.URLValidator
+	domainFilter  *app.DomainFilter
+	// unlockAttempts limits the failed passwords of a client on a link,
+	// linkUnlockAttempts the ones of all clients together.
+	unlockAttempts     app.AttemptLimiter
+	linkUnlockAttempts app.AttemptLimiter
+	rateLimiter        app.RateLimiter
+	createLimit        app.RateLimit
+	redirectLimit      app.RateLimit
+	trustedProxies     []*net.IPNet
+	// adminToken enables the admin api for requests bearing it.
+	adminToken string
+	// maxBatchSize caps the urls of a batch when positive.
+	maxBatchSize int
+	// idempotency keeps responses of requests with an Idempotency-Key for
+	// idempotencyTTL, keys are ignored without it.
+	idempotency    app.IdempotencyStore
+	idempotencyTTL time.Duration
+	// shuttingDown is set once a graceful shutdown began, accessed
+	// atomically.
+	shuttingDown int32
 }
 
 type ShortenHandlerJSONRequest struct {
-	URL string `json:"url"`
+	URL           string             `json:"url"`
+	Password      string             `json:"password,omitempty"`
+	MaxClicks     int                `json:"max_clicks,omitempty"`
+	RedirectCode  int                `json:"redirect_code,omitempty"`
+	ForwardQuery  bool               `json:"forward_query,omitempty"`
+	QueryConflict string             `json:"query_conflict,omitempty"`
+	ForwardPath   bool               `json:"forward_path,omitempty"`
+	UTM           *app.UTMParams     `json:"utm,omitempty"`
+	Rules         []app.RedirectRule `json:"rules,omitempty"`
+	Variants      []app.Variant      `json:"variants,omitempty"`
+	ActiveFrom    *time.Time         `json:"active_from,omitempty"`
+	ActiveUntil   *time.Time         `json:"active_until,omitempty"`
+	BeforeURL     string             `json:"before_url,omitempty"`
+	AfterURL      string             `json:"after_url,omitempty"`
+	NotYetMessage string             `json:"not_yet_message,omitempty"`
+	Title         string             `json:"title,omitempty"`
 }
 
 type ShortenHandlerJSONResponse struct {
 	Result string `json:"result"`
+	QR     string `json:"qr,omitempty"`
 }
 
 type UserURLsResponseStruct struct {
-	ShortURL string `json:"short_url"`
-	LongURL  string `json:"original_url"`
+	ShortURL       string `json:"short_url"`
+	LongURL        string `json:"original_url"`
+	Status         string `json:"status"`
+	TakedownReason string `json:"takedown_reason,omitempty"`
 }
 
-type ShortenBatchHandlerJSONRequest []struct {
+// Statuses of links in /api/user/urls. Link info also tells exhausted
+// links apart.
+const (
+	linkStatusActive    = "active"
+	linkStatusDisabled  = "disabled"
+	linkStatusExhausted = "exhausted"
+)
+
+type ShortenBatchItemJSON struct {
 	CorrelationID string `json:"correlation_id"`
 	OrginalURL    string `json:"original_url"`
 }
 
+type ShortenBatchHandlerJSONRequest []ShortenBatchItemJSON
+
 type ShortenBatchHandlerJSONResponse struct {
 	CorrelationID string `json:"correlation_id"`
 	ShortURL      string `json:"short_url"`
+	QR            string `json:"qr,omitempty"`
+}
+
+// ShortenBatchNDJSONResponse is a line of the answer to a streamed batch,
+// either the short url or the error of the item.
+type ShortenBatchNDJSONResponse struct {
+	CorrelationID string `json:"correlation_id"`
+	ShortURL      string `json:"short_url,omitempty"`
+	QR            string `json:"qr,omitempty"`
+	// Existed is set for urls shortened before.
+	Existed bool       `json:"existed,omitempty"`
+	Error   *ErrorJSON `json:"error,omitempty"`
+}
+
+// ShortenBatchNDJSONError is the last line of a streamed batch cut short,
+// the items after the ones answered were not read.
+type ShortenBatchNDJSONError struct {
+	Error ErrorJSON `json:"error"`
+}
+
+type LinkRulesJSON struct {
+	Rules []app.RedirectRule `json:"rules"`
+}
+
+type LinkVariantsJSON struct {
+	Variants []app.Variant `json:"variants"`
+}
+
+type UserSettingsJSON struct {
+	DefaultUTM *app.UTMParams `json:"default_utm"`
+}
+
+// LinkInfoJSON describes a link without following it. The destination of
+// password protected and disabled links stays hidden, the owner of the link
+// sees it along with the fields below Owner.
+type LinkInfoJSON struct {
+	Short          string     `json:"short"`
+	ShortURL       string     `json:"short_url"`
+	OriginalURL    string     `json:"original_url,omitempty"`
+	Status         string     `json:"status"`
+	TakedownReason string     `json:"takedown_reason,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	Title          string     `json:"title,omitempty"`
+	Protected      bool       `json:"protected,omitempty"`
+	Preview        bool       `json:"preview,omitempty"`
+
+	Owner       bool              `json:"owner,omitempty"`
+	ActiveFrom  *time.Time        `json:"active_from,omitempty"`
+	ActiveUntil *time.Time        `json:"active_until,omitempty"`
+	MaxClicks   int               `json:"max_clicks,omitempty"`
+	Clicks      *app.ClickStats   `json:"clicks,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type ReportJSONRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ReportJSONResponse struct {
+	ID int64 `json:"id"`
+}
+
+type AbuseReportJSON struct {
+	app.AbuseReport
+	ShortURL string `json:"short_url"`
+	LongURL  string `json:"original_url"`
+}
+
+type UserTrustJSON struct {
+	Untrusted bool `json:"untrusted"`
+}
+
+type TakedownJSONRequest struct {
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+type ImportRowErrorJSON struct {
+	Line int `json:"line"`
+	ErrorJSON
+}
+
+type ImportJSONResponse struct {
+	Imported int                  `json:"imported"`
+	Failed   int                  `json:"failed"`
+	Errors   []ImportRowErrorJSON `json:"errors"`
+	// ErrorsTruncated is set when more rows failed than errors are listed.
+	ErrorsTruncated bool `json:"errors_truncated,omitempty"`
 }
 
 func (h *Handler) ShortenHandler(w http.ResponseWriter, r *http.Request) {
@@ -51,16 +194,16 @@ func (h *Handler) ShortenHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Can't read request body", http.StatusBadRequest)
 		return
 	}
-	url, err := url.ParseRequestURI(string(data))
+	url, err := h.validateURL(r.Context(), string(data))
 	if err != nil {
-		http.Error(w, "Invalid url received", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	longURL := url.String()
 	short := app.GenShort(longURL)
 	userID := getUserTokenFromWriter(w)
-	err = h.storage.SaveShort(r.Context(), short, longURL, userID)
+	err = h.storage.SaveLink(r.Context(), short, longURL, userID, h.defaultLinkOptions(r.Context(), userID))
 	var duplicateErr *app.DuplicateError
 	var respStatus int
 	if err != nil {
@@ -73,55 +216,211 @@ func (h *Handler) ShortenHandler(w http.ResponseWriter, r *http.Request) {
 		respStatus = http.StatusCreated
 	}
 	shortURL := strings.Join([]string{h.baseServerURL, short}, "/")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(respStatus)
 	w.Write([]byte(shortURL))
 }
 
+// GetFromShortHandler redirects to the destination of the link. HEAD
+// requests, e.g. of link checkers, get the same answer without counting as a
+// click.
 func (h *Handler) GetFromShortHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Only GET and HEAD requests are allowed", http.StatusMethodNotAllowed)
 		return
 	}
 	short := chi.URLParam(r, "ID")
 	longURL, exists := h.storage.GetURLFromShort(r.Context(), short)
 	if !exists {
-		http.Error(w, "No such short url", http.StatusNotFound)
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "No such short url", nil)
+		return
+	}
+	opts, err := h.storage.GetLinkOptions(r.Context(), short)
+	if err != nil {
+		panic(err)
+	}
+	if opts.IsDeleted() {
+		http.Error(w, "Link was deleted", http.StatusGone)
+		return
+	}
+	if opts.IsDisabled() {
+		writeTakedownPage(w, *opts.Takedown)
+		return
+	}
+	destination, variant, ok := h.destination(w, r, short, longURL, opts)
+	if !ok || !h.checkRedirect(w, r, short, destination, opts) {
 		return
 	}
-	http.Redirect(w, r, longURL, http.StatusTemporaryRedirect)
+	if opts.IsProtected() {
+		writeUnlockPage(w, http.StatusOK, "")
+		return
+	}
+	if opts.ForcePreview {
+		h.writePreviewPage(w, short, longURL, opts)
+		return
+	}
+	if r.Method == http.MethodHead {
+		h.redirect(w, r, destination, opts)
+		return
+	}
+	if !h.consumeClick(w, r, short, opts) {
+		return
+	}
+	h.recordClick(r.Context(), short, variant)
+	h.redirect(w, r, destination, opts)
 
 }
 
+// UnlockShortHandler redirects after the password of a protected link is
+// entered or the visitor confirmed a forced preview.
+func (h *Handler) UnlockShortHandler(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	longURL, exists := h.storage.GetURLFromShort(r.Context(), short)
+	if !exists {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "No such short url", nil)
+		return
+	}
+	opts, err := h.storage.GetLinkOptions(r.Context(), short)
+	if err != nil {
+		panic(err)
+	}
+	if opts.IsDeleted() {
+		http.Error(w, "Link was deleted", http.StatusGone)
+		return
+	}
+	if opts.IsDisabled() {
+		writeTakedownPage(w, *opts.Takedown)
+		return
+	}
+	confirmed := opts.ForcePreview && len(r.PostFormValue("confirm")) > 0
+	if !opts.IsProtected() && !confirmed {
+		http.Error(w, "Only GET requests are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	destination, variant, ok := h.destination(w, r, short, longURL, opts)
+	if !ok || !h.checkRedirect(w, r, short, destination, opts) {
+		return
+	}
+	if opts.IsProtected() {
+		ip := h.clientIP(r)
+		allowed, retryAfter := h.acquireUnlock(short, ip)
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeUnlockPage(w, http.StatusTooManyRequests, "Too many failed attempts, try again later")
+			return
+		}
+		if !app.CheckPassword(opts.PasswordHash, r.PostFormValue("password")) {
+			writeUnlockPage(w, http.StatusForbidden, "Wrong password")
+			return
+		}
+		h.releaseUnlock(short, ip)
+	}
+	if !h.consumeClick(w, r, short, opts) {
+		return
+	}
+	h.recordClick(r.Context(), short, variant)
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, destination, http.StatusSeeOther)
+}
+
 func (h *Handler) ShortenHandlerJSON(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST requests are allowed!", http.StatusMethodNotAllowed)
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST requests are allowed!", nil)
 		return
 	}
 	defer r.Body.Close()
 	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-		http.Error(w, "Bad Content-Type", http.StatusBadRequest)
+		writeInvalidContentType(w)
 		return
 	}
 	data := ShortenHandlerJSONRequest{}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeInvalidJSON(w, err)
+		return
+	}
+	qrFormat, qrOpts, err := h.parseQRRequest(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error(), nil)
 		return
 	}
-	url, err := url.ParseRequestURI(data.URL)
+	url, err := h.validateURL(r.Context(), data.URL)
 	if err != nil {
-		http.Error(w, "Invalid url received", http.StatusBadRequest)
+		writeFieldError(w, "url", err)
+		return
+	}
+	if data.MaxClicks < 0 {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidField, "max_clicks must not be negative", map[string]interface{}{"field": "max_clicks"})
 		return
 	}
+	if data.RedirectCode != 0 && !app.IsValidRedirectCode(data.RedirectCode) {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidField, "redirect_code must be one of 301, 302, 303, 307, 308", map[string]interface{}{"field": "redirect_code"})
+		return
+	}
+	if !app.IsValidQueryConflict(data.QueryConflict) {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidField, "query_conflict must be one of link, request, append", map[string]interface{}{"field": "query_conflict"})
+		return
+	}
+	for i, rule := range data.Rules {
+		if err := rule.Validate(); err != nil {
+			writeFieldError(w, fmt.Sprintf("rules[%d]", i), err)
+			return
+		}
+	}
+	if err := app.ValidateVariants(data.Variants); err != nil {
+		writeFieldError(w, "variants", err)
+		return
+	}
+	userID := getUserTokenFromWriter(w)
+	opts := h.defaultLinkOptions(r.Context(), userID)
+	opts.MaxClicks = data.MaxClicks
+	opts.RedirectCode = data.RedirectCode
+	opts.ForwardQuery = data.ForwardQuery
+	opts.QueryConflict = data.QueryConflict
+	opts.ForwardPath = data.ForwardPath
+	opts.Rules = data.Rules
+	opts.Variants = data.Variants
+	opts.ActiveFrom = data.ActiveFrom
+	opts.ActiveUntil = data.ActiveUntil
+	opts.BeforeURL = data.BeforeURL
+	opts.AfterURL = data.AfterURL
+	opts.NotYetMessage = data.NotYetMessage
+	opts.Title = data.Title
+	if err := opts.ValidateTitle(); err != nil {
+		writeFieldError(w, "title", err)
+		return
+	}
+	if err := opts.ValidateWindow(); err != nil {
+		writeFieldError(w, "", err)
+		return
+	}
+	if data.UTM != nil {
+		opts.UTM = data.UTM
+	}
+	if err := h.validateDestinations(r.Context(), opts); err != nil {
+		writeFieldError(w, "", err)
+		return
+	}
+	if len(data.Password) > 0 {
+		opts.PasswordHash, err = app.HashPassword(data.Password)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidField, "Invalid password received", map[string]interface{}{"field": "password"})
+			return
+		}
+	}
 
 	longURL := url.String()
 	short := app.GenShort(longURL)
-	userID := getUserTokenFromWriter(w)
-	err = h.storage.SaveShort(r.Context(), short, longURL, userID)
+	err = h.storage.SaveLink(r.Context(), short, longURL, userID, opts)
 	var duplicateErr *app.DuplicateError
 	var respStatus int
 	if err != nil {
 		if errors.As(err, &duplicateErr) {
+			if len(data.Password) > 0 && !h.hasPassword(r.Context(), short, data.Password) {
+				// the existing link would give the url away without the password
+				writeAPIError(w, http.StatusConflict, errCodeURLTaken, "The url was shortened before without this password", nil)
+				return
+			}
 			respStatus = http.StatusConflict
 		} else {
 			panic(err)
@@ -132,19 +431,19 @@ func (h *Handler) ShortenHandlerJSON(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(respStatus)
 	shortURL := strings.Join([]string{h.baseServerURL, short}, "/")
-	ret, _ := json.Marshal(ShortenHandlerJSONResponse{shortURL})
+	qr, err := qrDataURI(shortURL, qrFormat, qrOpts)
+	if err != nil {
+		panic(err)
+	}
+	ret, _ := json.Marshal(ShortenHandlerJSONResponse{Result: shortURL, QR: qr})
 	w.Write(ret)
 }
 
 func (h *Handler) UserURLs(w http.ResponseWriter, r *http.Request) {
 	userID := getUserTokenFromWriter(w)
-	shortURLIDs := h.storage.GetURLsByUserID(r.Context(), userID)
-	response := make([]UserURLsResponseStruct, 0)
-	for _, shortURLId := range shortURLIDs {
-		shortURL := strings.Join([]string{h.baseServerURL, shortURLId}, "/")
-		longURL, _ := h.storage.GetURLFromShort(r.Context(), shortURLId)
-		item := UserURLsResponseStruct{shortURL, longURL}
-		response = append(response, item)
+	response, err := h.userURLs(r.Context(), userID)
+	if err != nil {
+		panic(err)
 	}
 
 	encoder := json.NewEncoder(w)
@@ -159,50 +458,177 @@ func (h *Handler) UserURLs(w http.ResponseWriter, r *http.Request) {
 	encoder.Encode(response)
 }
 
+// DeleteUserURLs deletes the links of the user listed in the body, links of
+// other users are skipped.
+func (h *Handler) DeleteUserURLs(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		writeInvalidContentType(w)
+		return
+	}
+	var shorts []string
+	if err := json.NewDecoder(r.Body).Decode(&shorts); err != nil {
+		writeInvalidJSON(w, err)
+		return
+	}
+	userID := getUserTokenFromWriter(w)
+	if err := h.deleteUserURLs(r.Context(), userID, shorts); err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ExportUserURLs streams the links of the user with their metadata and
+// clicks as CSV, JSON or JSONL. An error after the first link was written
+// aborts the response, so a cut export isn't taken for a whole one.
+func (h *Handler) ExportUserURLs(w http.ResponseWriter, r *http.Request) {
+	formatName := r.URL.Query().Get("format")
+	if len(formatName) == 0 {
+		formatName = exportFormatJSON
+	}
+	format, ok := exportFormats[formatName]
+	if !ok {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, "Unknown export format", map[string]interface{}{
+			"parameter": "format",
+			"expected":  "csv, json, jsonl",
+		})
+		return
+	}
+	userID := getUserTokenFromWriter(w)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="links.`+format.extension+`"`)
+	exporter := format.new(w)
+	exported := 0
+	err := h.storage.ExportLinks(r.Context(), userID, func(link app.ExportedLink) error {
+		if link.Options.IsDeleted() {
+			return nil
+		}
+		if err := exporter.write(h.exportedURL(link)); err != nil {
+			return err
+		}
+		exported++
+		if exported%exportFlushLinks == 0 {
+			flushResponse(w)
+		}
+		return nil
+	})
+	if err == nil {
+		err = exporter.close()
+	}
+	if err != nil {
+		if exported > 0 {
+			panic(http.ErrAbortHandler)
+		}
+		panic(err)
+	}
+}
+
+// ImportUserURLs saves the links of a CSV or JSONL file for the user, with
+// their own short codes if given. The file is read and saved in chunks, rows
+// failing validation or taken already are skipped and reported.
+func (h *Handler) ImportUserURLs(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var reader app.ImportReader
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/csv":
+		var err error
+		if reader, err = app.NewCSVImportReader(r.Body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidImport, err.Error(), nil)
+			return
+		}
+	case "application/x-ndjson", "application/jsonl":
+		reader = app.NewJSONLImportReader(r.Body)
+	default:
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidContentType, "Bad Content-Type", map[string]interface{}{
+			"expected": "text/csv, application/x-ndjson",
+		})
+		return
+	}
+	userID := getUserTokenFromWriter(w)
+	response, err := h.importLinks(r, reader, userID)
+	var limitErr *importRateLimitError
+	if errors.As(err, &limitErr) {
+		retryAfter := ceilSeconds(limitErr.retryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeAPIError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many requests", map[string]interface{}{
+			"retry_after": retryAfter,
+			"imported":    response.Imported,
+		})
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidImport, err.Error(), map[string]interface{}{
+			"imported": response.Imported,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
 func (h *Handler) PingHandler(w http.ResponseWriter, r *http.Request) {
-	if pgStorage, isPgStorage := h.storage.(*app.PostgresStorage); !isPgStorage {
-		w.WriteHeader(http.StatusOK)
+	if err := h.pingStorage(r.Context()); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
 	} else {
-		err := pgStorage.PingContext(r.Context())
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			w.WriteHeader(http.StatusOK)
-		}
+		w.WriteHeader(http.StatusOK)
 	}
 }
 
 func (h *Handler) ShortenBatchHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST requests are allowed!", http.StatusMethodNotAllowed)
+		writeAPIError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Only POST requests are allowed!", nil)
 		return
 	}
 	defer r.Body.Close()
-	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-		http.Error(w, "Bad Content-Type", http.StatusBadRequest)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-ndjson" {
+		h.shortenBatchNDJSON(w, r)
+		return
+	}
+	if mediaType != "application/json" {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidContentType, "Bad Content-Type", map[string]interface{}{
+			"expected": "application/json, application/x-ndjson",
+		})
 		return
 	}
 	data := ShortenBatchHandlerJSONRequest{}
 
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeInvalidJSON(w, err)
+		return
+	}
+	qrFormat, qrOpts, err := h.parseQRRequest(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error(), nil)
+		return
+	}
+	if h.maxBatchSize > 0 && len(data) > h.maxBatchSize {
+		writeBatchTooLarge(w, h.maxBatchSize)
+		return
+	}
+	if h.createLimit.Enabled() && len(data) > h.createLimit.Burst {
+		writeBatchTooLarge(w, h.createLimit.Burst)
+		return
+	}
+	// the request itself has already been counted
+	if !h.takeRateLimit(w, r, rateLimitCreate, h.createLimit, len(data)-1) {
 		return
 	}
 	userID := getUserTokenFromWriter(w)
-	correlationIDtoShort := make(map[string]string)
+	shorts := make([]string, len(data))
 	shortToLong := make(map[string]string)
-	for _, item := range data {
-		longURL, err := url.ParseRequestURI(item.OrginalURL)
+	for i, item := range data {
+		longURL, err := h.validateURL(r.Context(), item.OrginalURL)
 		if err != nil {
-			http.Error(w, "Invalid url received", http.StatusBadRequest)
+			writeFieldError(w, fmt.Sprintf("[%d].original_url", i), err)
 			return
 		}
-		shortURL := app.GenShort(longURL.String())
-		correlationIDtoShort[item.CorrelationID] = shortURL
-		shortToLong[shortURL] = longURL.String()
+		shorts[i] = app.GenShort(longURL.String())
+		shortToLong[shorts[i]] = longURL.String()
 	}
 
-	err := h.storage.SaveShortMulti(r.Context(), shortToLong, userID)
+	err = h.storage.SaveLinkMulti(r.Context(), shortToLong, userID, h.defaultLinkOptions(r.Context(), userID))
 	var duplicateErr *app.DuplicateError
 	var respStatus int
 	if err != nil {
@@ -214,13 +640,19 @@ func (h *Handler) ShortenBatchHandler(w http.ResponseWriter, r *http.Request) {
 	} else {
 		respStatus = http.StatusCreated
 	}
-	respData := []ShortenBatchHandlerJSONResponse{}
-	for correlationID, shortURL := range correlationIDtoShort {
+	respData := make([]ShortenBatchHandlerJSONResponse, 0, len(data))
+	for i, item := range data {
+		shortURL := strings.Join([]string{h.baseServerURL, shorts[i]}, "/")
+		qr, err := qrDataURI(shortURL, qrFormat, qrOpts)
+		if err != nil {
+			panic(err)
+		}
 		respData = append(
 			respData,
 			ShortenBatchHandlerJSONResponse{
-				CorrelationID: correlationID,
-				ShortURL:      strings.Join([]string{h.baseServerURL, shortURL}, "/"),
+				CorrelationID: item.CorrelationID,
+				ShortURL:      shortURL,
+				QR:            qr,
 			},
 		)
 	}
@@ -229,3 +661,382 @@ func (h *Handler) ShortenBatchHandler(w http.ResponseWriter, r *http.Request) {
 	ret, _ := json.MarshalIndent(respData, "", "    ")
 	w.Write(ret)
 }
+
+func (h *Handler) GetUserSettings(w http.ResponseWriter, r *http.Request) {
+	userID := getUserTokenFromWriter(w)
+	settings, err := h.storage.GetUserSettings(r.Context(), userID)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UserSettingsJSON{DefaultUTM: settings.DefaultUTM})
+}
+
+func (h *Handler) UpdateUserSettings(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		writeInvalidContentType(w)
+		return
+	}
+	data := UserSettingsJSON{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeInvalidJSON(w, err)
+		return
+	}
+	userID := getUserTokenFromWriter(w)
+	settings, err := h.storage.GetUserSettings(r.Context(), userID)
+	if err != nil {
+		panic(err)
+	}
+	settings.DefaultUTM = data.DefaultUTM
+	if err := h.storage.SaveUserSettings(r.Context(), userID, settings); err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (h *Handler) GetLinkRules(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	userID := getUserTokenFromWriter(w)
+	if !h.isOwner(r.Context(), userID, short) {
+		writeNotFound(w)
+		return
+	}
+	opts, err := h.storage.GetLinkOptions(r.Context(), short)
+	if err != nil {
+		panic(err)
+	}
+	response := LinkRulesJSON{Rules: opts.Rules}
+	if response.Rules == nil {
+		response.Rules = []app.RedirectRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) UpdateLinkRules(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		writeInvalidContentType(w)
+		return
+	}
+	short := chi.URLParam(r, "ID")
+	userID := getUserTokenFromWriter(w)
+	if !h.isOwner(r.Context(), userID, short) {
+		writeNotFound(w)
+		return
+	}
+	data := LinkRulesJSON{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeInvalidJSON(w, err)
+		return
+	}
+	for i, rule := range data.Rules {
+		if err := rule.Validate(); err != nil {
+			writeFieldError(w, fmt.Sprintf("rules[%d]", i), err)
+			return
+		}
+	}
+	if err := h.validateDestinations(r.Context(), app.LinkOptions{Rules: data.Rules}); err != nil {
+		writeFieldError(w, "rules", err)
+		return
+	}
+	err := h.storage.UpdateLinkOptions(r.Context(), short, func(opts *app.LinkOptions) error {
+		opts.Rules = data.Rules
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if data.Rules == nil {
+		data.Rules = []app.RedirectRule{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (h *Handler) GetLinkVariants(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	userID := getUserTokenFromWriter(w)
+	if !h.isOwner(r.Context(), userID, short) {
+		writeNotFound(w)
+		return
+	}
+	opts, err := h.storage.GetLinkOptions(r.Context(), short)
+	if err != nil {
+		panic(err)
+	}
+	response := LinkVariantsJSON{Variants: opts.Variants}
+	if response.Variants == nil {
+		response.Variants = []app.Variant{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) UpdateLinkVariants(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		writeInvalidContentType(w)
+		return
+	}
+	short := chi.URLParam(r, "ID")
+	userID := getUserTokenFromWriter(w)
+	if !h.isOwner(r.Context(), userID, short) {
+		writeNotFound(w)
+		return
+	}
+	data := LinkVariantsJSON{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeInvalidJSON(w, err)
+		return
+	}
+	if err := app.ValidateVariants(data.Variants); err != nil {
+		writeFieldError(w, "variants", err)
+		return
+	}
+	if err := h.validateDestinations(r.Context(), app.LinkOptions{Variants: data.Variants}); err != nil {
+		writeFieldError(w, "variants", err)
+		return
+	}
+	err := h.storage.UpdateLinkOptions(r.Context(), short, func(opts *app.LinkOptions) error {
+		opts.Variants = data.Variants
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+	if data.Variants == nil {
+		data.Variants = []app.Variant{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (h *Handler) GetLinkInfo(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	longURL, exists := h.storage.GetURLFromShort(r.Context(), short)
+	if !exists {
+		writeNotFound(w)
+		return
+	}
+	opts, err := h.storage.GetLinkOptions(r.Context(), short)
+	if err != nil {
+		panic(err)
+	}
+	if opts.IsDeleted() {
+		writeNotFound(w)
+		return
+	}
+	userID := getUserTokenFromWriter(w)
+	info, err := h.linkInfo(r.Context(), short, longURL, opts, h.isOwner(r.Context(), userID, short))
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (h *Handler) GetLinkStats(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	userID := getUserTokenFromWriter(w)
+	if !h.isOwner(r.Context(), userID, short) {
+		writeNotFound(w)
+		return
+	}
+	stats, err := h.storage.GetClickStats(r.Context(), short)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (h *Handler) ReportHandler(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	if _, exists := h.storage.GetURLFromShort(r.Context(), short); !exists {
+		writeNotFound(w)
+		return
+	}
+	defer r.Body.Close()
+	data := ReportJSONRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil && err != io.EOF {
+		writeInvalidJSON(w, err)
+		return
+	}
+	report := app.AbuseReport{
+		Short:     short,
+		Reason:    data.Reason,
+		Reporter:  h.clientIP(r),
+		CreatedAt: time.Now().UTC(),
+	}
+	if err := report.Validate(); err != nil {
+		writeFieldError(w, "reason", err)
+		return
+	}
+	id, err := h.storage.SaveReport(r.Context(), report)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(ReportJSONResponse{ID: id})
+}
+
+func (h *Handler) GetAbuseReports(w http.ResponseWriter, r *http.Request) {
+	reports, err := h.storage.GetOpenReports(r.Context())
+	if err != nil {
+		panic(err)
+	}
+	response := make([]AbuseReportJSON, 0, len(reports))
+	for _, report := range reports {
+		longURL, _ := h.storage.GetURLFromShort(r.Context(), report.Short)
+		response = append(response, AbuseReportJSON{
+			AbuseReport: report,
+			ShortURL:    strings.Join([]string{h.baseServerURL, report.Short}, "/"),
+			LongURL:     longURL,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DisableLink takes the link down and closes its open reports.
+func (h *Handler) DisableLink(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	defer r.Body.Close()
+	data := TakedownJSONRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeInvalidJSON(w, err)
+		return
+	}
+	takedown := app.Takedown{Status: data.Status, Reason: data.Reason, At: time.Now().UTC()}
+	if takedown.Status == 0 {
+		takedown.Status = http.StatusGone
+	}
+	if err := takedown.Validate(); err != nil {
+		writeFieldError(w, "", err)
+		return
+	}
+	err := h.storage.UpdateLinkOptions(r.Context(), short, func(opts *app.LinkOptions) error {
+		opts.Takedown = &takedown
+		return nil
+	})
+	if errors.Is(err, app.ErrLinkNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	if err := h.storage.ResolveReports(r.Context(), short, app.ReportDisabled); err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(takedown)
+}
+
+func (h *Handler) EnableLink(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	err := h.storage.UpdateLinkOptions(r.Context(), short, func(opts *app.LinkOptions) error {
+		opts.Takedown = nil
+		return nil
+	})
+	if errors.Is(err, app.ErrLinkNotFound) {
+		writeNotFound(w)
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DismissReports closes the open reports of the link without taking it down.
+func (h *Handler) DismissReports(w http.ResponseWriter, r *http.Request) {
+	short := chi.URLParam(r, "ID")
+	if _, exists := h.storage.GetURLFromShort(r.Context(), short); !exists {
+		writeNotFound(w)
+		return
+	}
+	if err := h.storage.ResolveReports(r.Context(), short, app.ReportDismissed); err != nil {
+		panic(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PreviewHandler shows where the link leads instead of redirecting, both for
+// /{ID}+ and /{ID}/preview.
+func (h *Handler) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	short := strings.TrimSuffix(chi.URLParam(r, "ID"), "+")
+	longURL, exists := h.storage.GetURLFromShort(r.Context(), short)
+	if !exists {
+		http.Error(w, "No such short url", http.StatusNotFound)
+		return
+	}
+	opts, err := h.storage.GetLinkOptions(r.Context(), short)
+	if err != nil {
+		panic(err)
+	}
+	// the preview shows the destination only when following it would
+	if !h.checkRedirect(w, r, short, longURL, opts) {
+		return
+	}
+	h.writePreviewPage(w, short, longURL, opts)
+}
+
+// SetUserTrust marks a user as untrusted, which forces the preview page on
+// all links of the user, existing and new ones.
+func (h *Handler) SetUserTrust(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 32)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidParameter, "Invalid user id", map[string]interface{}{"parameter": "userID"})
+		return
+	}
+	defer r.Body.Close()
+	data := UserTrustJSON{}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		writeInvalidJSON(w, err)
+		return
+	}
+	settings, err := h.storage.GetUserSettings(r.Context(), uint32(userID))
+	if err != nil {
+		panic(err)
+	}
+	settings.Untrusted = data.Untrusted
+	if err := h.storage.SaveUserSettings(r.Context(), uint32(userID), settings); err != nil {
+		panic(err)
+	}
+	for _, short := range h.storage.GetURLsByUserID(r.Context(), uint32(userID)) {
+		err := h.storage.UpdateLinkOptions(r.Context(), short, func(opts *app.LinkOptions) error {
+			opts.ForcePreview = data.Untrusted
+			return nil
+		})
+		if err != nil && !errors.Is(err, app.ErrLinkNotFound) {
+			panic(err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// GetDomainFilterStats reports the size of the domain lists and how many
+// requests they rejected, empty when no list is configured.
+func (h *Handler) GetDomainFilterStats(w http.ResponseWriter, r *http.Request) {
+	stats := app.DomainFilterStats{Rejections: map[string]int64{}}
+	if h.domainFilter != nil {
+		stats = h.domainFilter.Stats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func (h *Handler) QRCodePNGHandler(w http.ResponseWriter, r *http.Request) {
+	h.writeQRCode(w, r, app.QRFormatPNG)
+}
+
+func (h *Handler) QRCodeSVGHandler(w http.ResponseWriter, r *http.Request) {
+	h.writeQRCode(w, r, app.QRFormatSVG)
+}
@@ -1,10 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	"github.com/evgenspj/url-shortener/internal/app"
+	"github.com/go-chi/chi/v5"
 )
 
 func getUserTokenFromWriter(w http.ResponseWriter) uint32 {
@@ -13,3 +21,706 @@ func getUserTokenFromWriter(w http.ResponseWriter) uint32 {
 	userID := app.GetUserIDFromToken(userToken)
 	return userID
 }
+
+// maxLinkUnlockAttempts caps the failed passwords on a link from all clients
+// together. It is far above the cap of a client, so one client can't lock
+// out the others.
+const maxLinkUnlockAttempts = 100
+
+// acquireUnlock counts a password attempt of the client on the link against
+// both its own cap and the cap of the link.
+func (h *Handler) acquireUnlock(short string, ip string) (bool, time.Duration) {
+	key := short + " " + ip
+	allowed, retryAfter := h.unlockAttempts.Acquire(key)
+	if !allowed {
+		return false, retryAfter
+	}
+	if allowed, retryAfter = h.linkUnlockAttempts.Acquire(short); !allowed {
+		h.unlockAttempts.Release(key)
+		return false, retryAfter
+	}
+	return true, 0
+}
+
+// releaseUnlock forgets a successful attempt acquired by acquireUnlock.
+func (h *Handler) releaseUnlock(short string, ip string) {
+	h.unlockAttempts.Release(short + " " + ip)
+	h.linkUnlockAttempts.Release(short)
+}
+
+// hasPassword tells if the link is protected by the password.
+func (h *Handler) hasPassword(ctx context.Context, short string, password string) bool {
+	opts, err := h.storage.GetLinkOptions(ctx, short)
+	if err != nil {
+		panic(err)
+	}
+	return opts.IsProtected() && app.CheckPassword(opts.PasswordHash, password)
+}
+
+func writeUnlockPage(w http.ResponseWriter, status int, errorMessage string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	unlockPageTemplate.Execute(w, unlockPageData{Error: errorMessage})
+}
+
+func writeTakedownPage(w http.ResponseWriter, takedown app.Takedown) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(takedown.Status)
+	takedownPageTemplate.Execute(w, takedownPageData{
+		Status: takedown.Status,
+		Reason: takedown.Reason,
+	})
+}
+
+// writePreviewPage describes the link without following it. The destination
+// of password protected links stays hidden.
+func (h *Handler) writePreviewPage(w http.ResponseWriter, short string, longURL string, opts app.LinkOptions) {
+	data := previewPageData{
+		ShortURL:     strings.Join([]string{h.baseServerURL, short}, "/"),
+		Short:        short,
+		Title:        opts.Title,
+		Protected:    opts.IsProtected(),
+		MayVary:      len(opts.Rules) > 0 || len(opts.Variants) > 0,
+		ForcePreview: opts.ForcePreview,
+	}
+	if !data.Protected {
+		data.Destination = longURL
+	}
+	if opts.CreatedAt != nil {
+		data.CreatedAt = opts.CreatedAt.UTC().Format(time.RFC1123)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("X-Robots-Tag", "noindex")
+	previewPageTemplate.Execute(w, data)
+}
+
+// writeQRCode renders the short url of the link as a QR code, the size,
+// level and margin query parameters are passed to the encoder.
+func (h *Handler) writeQRCode(w http.ResponseWriter, r *http.Request, format string) {
+	short := chi.URLParam(r, "ID")
+	if _, exists := h.storage.GetURLFromShort(r.Context(), short); !exists {
+		http.Error(w, "No such short url", http.StatusNotFound)
+		return
+	}
+	qrOpts, err := app.ParseQROptions(r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	code, err := app.NewQRCode(strings.Join([]string{h.baseServerURL, short}, "/"), qrOpts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var data []byte
+	switch format {
+	case app.QRFormatPNG:
+		w.Header().Set("Content-Type", "image/png")
+		if data, err = code.PNG(); err != nil {
+			panic(err)
+		}
+	case app.QRFormatSVG:
+		w.Header().Set("Content-Type", "image/svg+xml")
+		data = code.SVG()
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
+
+// parseQRRequest reads the qr query parameter of the shorten endpoints, an
+// empty format means no QR code was asked for. The options are checked
+// against a short url of the usual length so that links aren't saved when
+// their QR code can't be rendered.
+func (h *Handler) parseQRRequest(r *http.Request) (string, app.QROptions, error) {
+	query := r.URL.Query()
+	format := query.Get("qr")
+	switch format {
+	case "":
+		return "", app.QROptions{}, nil
+	case app.QRFormatPNG, app.QRFormatSVG:
+	default:
+		return "", app.QROptions{}, fmt.Errorf("qr must be %s or %s", app.QRFormatPNG, app.QRFormatSVG)
+	}
+	qrOpts, err := app.ParseQROptions(query.Get)
+	if err != nil {
+		return "", app.QROptions{}, err
+	}
+	sample := strings.Join([]string{h.baseServerURL, app.GenShort("")}, "/")
+	if _, err := app.NewQRCode(sample, qrOpts); err != nil {
+		return "", app.QROptions{}, err
+	}
+	return format, qrOpts, nil
+}
+
+func qrDataURI(shortURL string, format string, qrOpts app.QROptions) (string, error) {
+	if len(format) == 0 {
+		return "", nil
+	}
+	code, err := app.NewQRCode(shortURL, qrOpts)
+	if err != nil {
+		return "", err
+	}
+	return code.DataURI(format)
+}
+
+// defaultLinkOptions returns the options every new link of the user starts with.
+func (h *Handler) defaultLinkOptions(ctx context.Context, userID uint32) app.LinkOptions {
+	settings, err := h.storage.GetUserSettings(ctx, userID)
+	if err != nil {
+		panic(err)
+	}
+	createdAt := time.Now().UTC()
+	return app.LinkOptions{
+		UTM:          settings.DefaultUTM,
+		CreatedAt:    &createdAt,
+		ForcePreview: settings.Untrusted,
+	}
+}
+
+// Reasons a link doesn't redirect to its destination, see checkLink.
+const (
+	linkAvailable = iota
+	linkDeleted
+	linkDisabled
+	linkBlocked
+	linkNotStarted
+	linkEnded
+	linkExhausted
+)
+
+// checkLink runs the checks a redirect of the link to destination goes
+// through before the password, the preview and the click, without taking a
+// click. Links outside their activation window also get their fallback url,
+// empty if they have none.
+func (h *Handler) checkLink(ctx context.Context, short string, destination string, opts app.LinkOptions) (int, string, error) {
+	switch {
+	case opts.IsDeleted():
+		return linkDeleted, "", nil
+	case opts.IsDisabled():
+		return linkDisabled, "", nil
+	case h.isBlocked(destination):
+		return linkBlocked, "", nil
+	}
+	switch opts.WindowState(time.Now()) {
+	case app.WindowNotStarted:
+		if len(opts.BeforeURL) > 0 && h.isBlocked(opts.BeforeURL) {
+			return linkBlocked, "", nil
+		}
+		return linkNotStarted, opts.BeforeURL, nil
+	case app.WindowEnded:
+		if len(opts.AfterURL) > 0 && h.isBlocked(opts.AfterURL) {
+			return linkBlocked, "", nil
+		}
+		return linkEnded, opts.AfterURL, nil
+	}
+	exhausted, err := h.clicksExhausted(ctx, short, opts)
+	if err != nil {
+		return 0, "", err
+	}
+	if exhausted {
+		return linkExhausted, "", nil
+	}
+	return linkAvailable, "", nil
+}
+
+// checkRedirect answers requests for links checkLink doesn't let through:
+// 403 Forbidden for destinations blocked after the link was created, the
+// fallback url, a "not yet available" page or 410 Gone outside of the
+// activation window and 410 Gone once the click limit is exhausted.
+func (h *Handler) checkRedirect(w http.ResponseWriter, r *http.Request, short string, destination string, opts app.LinkOptions) bool {
+	state, fallbackURL, err := h.checkLink(r.Context(), short, destination, opts)
+	if err != nil {
+		panic(err)
+	}
+	switch state {
+	case linkAvailable:
+		return true
+	case linkDeleted:
+		http.Error(w, "Link was deleted", http.StatusGone)
+	case linkDisabled:
+		writeTakedownPage(w, *opts.Takedown)
+	case linkBlocked:
+		http.Error(w, "Destination is blocked", http.StatusForbidden)
+	case linkNotStarted, linkEnded:
+		w.Header().Set("Cache-Control", "no-store")
+		switch {
+		case len(fallbackURL) > 0:
+			http.Redirect(w, r, fallbackURL, http.StatusFound)
+		case state == linkNotStarted:
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Retry-After", opts.ActiveFrom.UTC().Format(http.TimeFormat))
+			w.WriteHeader(http.StatusForbidden)
+			notYetPageTemplate.Execute(w, notYetPageData{
+				Message:    opts.NotYetMessage,
+				ActiveFrom: opts.ActiveFrom.UTC().Format(time.RFC1123),
+			})
+		default:
+			http.Error(w, "Link is no longer available", http.StatusGone)
+		}
+	case linkExhausted:
+		http.Error(w, "Link is no longer available", http.StatusGone)
+	}
+	return false
+}
+
+// validateURL checks a destination url before it is shortened.
+func (h *Handler) validateURL(ctx context.Context, rawURL string) (*url.URL, error) {
+	parsedURL, err := h.urlValidator.Validate(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if h.domainFilter != nil {
+		if err := h.domainFilter.Check(parsedURL.Hostname(), app.FilterStageShorten); err != nil {
+			return nil, err
+		}
+	}
+	return parsedURL, nil
+}
+
+// validateDestinations checks the rule, variant and fallback urls of the link
+// the same way as the link url.
+func (h *Handler) validateDestinations(ctx context.Context, opts app.LinkOptions) error {
+	for _, destination := range opts.DestinationURLs() {
+		if _, err := h.validateURL(ctx, destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBlocked tells whether the domain filter blocks a destination, it may
+// have been blocked after the link was created.
+func (h *Handler) isBlocked(destination string) bool {
+	if h.domainFilter == nil {
+		return false
+	}
+	destinationURL, err := url.Parse(destination)
+	if err != nil {
+		panic(err)
+	}
+	return h.domainFilter.Check(destinationURL.Hostname(), app.FilterStageRedirect) != nil
+}
+
+// consumeClick takes a click from a limited link and answers 410 Gone once
+// the limit is exhausted.
+func (h *Handler) consumeClick(w http.ResponseWriter, r *http.Request, short string, opts app.LinkOptions) bool {
+	if !opts.HasClickLimit() {
+		return true
+	}
+	ok, err := h.storage.ConsumeClick(r.Context(), short)
+	if err != nil {
+		panic(err)
+	}
+	if !ok {
+		http.Error(w, "Link is no longer available", http.StatusGone)
+		return false
+	}
+	return true
+}
+
+// clicksExhausted tells whether the click limit of the link is used up,
+// without taking a click.
+func (h *Handler) clicksExhausted(ctx context.Context, short string, opts app.LinkOptions) (bool, error) {
+	if !opts.HasClickLimit() {
+		return false, nil
+	}
+	clicksLeft, limited, err := h.storage.ClicksLeft(ctx, short)
+	return limited && clicksLeft <= 0, err
+}
+
+const variantCookieMaxAge = 30 * 24 * time.Hour
+
+// destination picks the destination of the link for the request and applies
+// query and path passthrough to it. A path after the short code is only
+// accepted by links forwarding it. The name of the chosen A/B variant is
+// returned as well and kept in a cookie, so visitors stick to it.
+func (h *Handler) destination(w http.ResponseWriter, r *http.Request, short string, longURL string, opts app.LinkOptions) (string, string, bool) {
+	extraPath := chi.URLParam(r, "*")
+	if len(extraPath) > 0 && !opts.ForwardPath {
+		http.Error(w, "No such short url", http.StatusNotFound)
+		return "", "", false
+	}
+	var variantName string
+	if ruleURL, matched := app.SelectRule(opts.Rules, r.Header); matched {
+		longURL = ruleURL
+	} else if len(opts.Variants) > 0 {
+		cookieName := "variant_" + short
+		var variant app.Variant
+		found := false
+		if cookie, err := r.Cookie(cookieName); err == nil {
+			variant, found = app.FindVariant(opts.Variants, cookie.Value)
+		}
+		if !found {
+			variant, found = app.PickVariant(opts.Variants)
+		}
+		if found {
+			http.SetCookie(w, &http.Cookie{
+				Name:   cookieName,
+				Value:  variant.Name,
+				Path:   "/" + short,
+				MaxAge: int(variantCookieMaxAge.Seconds()),
+			})
+			longURL = variant.URL
+			variantName = variant.Name
+		}
+	}
+	destination, err := app.BuildDestination(longURL, opts, extraPath, r.URL.Query())
+	if err != nil {
+		panic(err)
+	}
+	return destination, variantName, true
+}
+
+func (h *Handler) recordClick(ctx context.Context, short string, variant string) {
+	if err := h.storage.RecordClick(ctx, short, variant); err != nil {
+		log.Printf("can't record click of %s: %v", short, err)
+	}
+}
+
+// permanentRedirectMaxAge bounds how long browsers keep following a
+// permanent redirect without asking, e.g. after the link was taken down or
+// deleted. Shared caches don't keep them.
+const permanentRedirectMaxAge = 5 * time.Minute
+
+// redirect sends the client to the link destination using the status code
+// of the link or the server default, with matching caching semantics.
+func (h *Handler) redirect(w http.ResponseWriter, r *http.Request, longURL string, opts app.LinkOptions) {
+	code := opts.RedirectCode
+	if code == 0 {
+		code = h.redirectCode
+	}
+	if code == 0 {
+		code = http.StatusTemporaryRedirect
+	}
+	var cacheControl string
+	switch {
+	case opts.HasClickLimit():
+		// every click has to reach the server
+		cacheControl = "no-store"
+	case len(opts.Rules) > 0 || len(opts.Variants) > 0 || opts.ActiveFrom != nil || opts.ActiveUntil != nil:
+		// the destination depends on the visitor or the time
+		cacheControl = "no-store"
+		if len(opts.Rules) > 0 {
+			w.Header().Set("Vary", strings.Join(ruleHeaders(opts.Rules), ", "))
+		}
+	case app.IsPermanentRedirectCode(code):
+		cacheControl = fmt.Sprintf("private, max-age=%d", int(permanentRedirectMaxAge.Seconds()))
+	default:
+		cacheControl = "no-cache"
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	http.Redirect(w, r, longURL, code)
+}
+
+func ruleHeaders(rules []app.RedirectRule) []string {
+	headers := []string{}
+	seen := map[string]bool{}
+	add := func(header string) {
+		header = http.CanonicalHeaderKey(header)
+		if !seen[header] {
+			seen[header] = true
+			headers = append(headers, header)
+		}
+	}
+	for _, rule := range rules {
+		if len(rule.Device) > 0 {
+			add("User-Agent")
+		}
+		if len(rule.Language) > 0 {
+			add("Accept-Language")
+		}
+		if rule.Header != nil {
+			add(rule.Header.Name)
+		}
+	}
+	return headers
+}
+
+func (h *Handler) isOwner(ctx context.Context, userID uint32, short string) bool {
+	for _, userShort := range h.storage.GetURLsByUserID(ctx, userID) {
+		if userShort == short {
+			return true
+		}
+	}
+	return false
+}
+
+// pingStorage checks the storage can serve requests, storages unable to
+// tell are assumed to.
+func (h *Handler) pingStorage(ctx context.Context) error {
+	if checker, ok := h.storage.(app.HealthChecker); ok {
+		return checker.CheckHealth(ctx)
+	}
+	return nil
+}
+
+const (
+	// importChunkSize is how many rows of an import are saved at once.
+	importChunkSize = 1000
+	// maxImportErrors caps the row errors listed in the response of an import.
+	maxImportErrors = 1000
+)
+
+// importRateLimitError ends an import over the create rate limit.
+type importRateLimitError struct {
+	retryAfter time.Duration
+}
+
+func (e *importRateLimitError) Error() string {
+	return "too many requests"
+}
+
+// importLinks validates the rows of the import and saves them in chunks
+// through an app.LinkImport. Every chunk is counted against the create rate
+// limit. An error reading the import or the rate limit ends it, the chunks
+// added before are still saved.
+func (h *Handler) importLinks(r *http.Request, reader app.ImportReader, userID uint32) (ImportJSONResponse, error) {
+	ctx := r.Context()
+	response := ImportJSONResponse{Errors: []ImportRowErrorJSON{}}
+	addError := func(line int, rowErr ErrorJSON) {
+		response.Failed++
+		if len(response.Errors) >= maxImportErrors {
+			response.ErrorsTruncated = true
+			return
+		}
+		response.Errors = append(response.Errors, ImportRowErrorJSON{Line: line, ErrorJSON: rowErr})
+	}
+	chunkSize := importChunkSize
+	if h.createLimit.Enabled() && h.createLimit.Burst < chunkSize {
+		chunkSize = h.createLimit.Burst
+	}
+	importer, err := h.storage.NewImport(ctx, userID)
+	if err != nil {
+		panic(err)
+	}
+	// lineOf finds the rows of links the storage refuses on Commit
+	lineOf := make(map[string]int)
+	duplicate := ErrorJSON{Code: errCodeDuplicate, Message: "Short code or url is taken"}
+	defaults := h.defaultLinkOptions(ctx, userID)
+	links := make([]app.ImportedLink, 0, chunkSize)
+	lines := make([]int, 0, chunkSize)
+	saved := false
+	save := func() error {
+		if len(links) == 0 {
+			return nil
+		}
+		cost := len(links)
+		if !saved {
+			// the request itself has already been counted
+			cost--
+		}
+		if h.rateLimiter != nil && h.createLimit.Enabled() && cost > 0 {
+			if result := h.allowRateLimit(r, rateLimitCreate, h.createLimit, cost); result != nil && !result.Allowed {
+				return &importRateLimitError{retryAfter: result.RetryAfter}
+			}
+		}
+		saved = true
+		skipped, err := importer.Add(ctx, links)
+		if err != nil {
+			panic(err)
+		}
+		isSkipped := make(map[int]bool, len(skipped))
+		for _, i := range skipped {
+			isSkipped[i] = true
+			addError(lines[i], duplicate)
+		}
+		for i, link := range links {
+			if !isSkipped[i] {
+				lineOf[link.Short] = lines[i]
+			}
+		}
+		response.Imported += len(links) - len(skipped)
+		links = links[:0]
+		lines = lines[:0]
+		return nil
+	}
+	read := func() error {
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			var rowErr *app.ImportRowError
+			if errors.As(err, &rowErr) {
+				if len(rowErr.Field) > 0 {
+					addError(rowErr.Line, fieldError(rowErr.Field, rowErr.Err))
+				} else {
+					addError(rowErr.Line, ErrorJSON{Code: errCodeInvalidRow, Message: rowErr.Err.Error()})
+				}
+				continue
+			}
+			if err != nil {
+				if saveErr := save(); saveErr != nil {
+					return saveErr
+				}
+				return err
+			}
+			link, field, err := h.importedLink(ctx, row, defaults)
+			if err != nil {
+				addError(row.Line, fieldError(field, err))
+				continue
+			}
+			links = append(links, link)
+			lines = append(lines, row.Line)
+			if len(links) == chunkSize {
+				if err := save(); err != nil {
+					return err
+				}
+			}
+		}
+		return save()
+	}
+	err = read()
+	clashed, commitErr := importer.Commit(ctx)
+	if commitErr != nil {
+		panic(commitErr)
+	}
+	for _, short := range clashed {
+		addError(lineOf[short], duplicate)
+		response.Imported--
+	}
+	return response, err
+}
+
+// importedLink validates a row of an import the way links created through
+// the api are validated. It returns the invalid field with the error.
+func (h *Handler) importedLink(ctx context.Context, row app.ImportRow, defaults app.LinkOptions) (app.ImportedLink, string, error) {
+	longURL, err := h.validateURL(ctx, row.OriginalURL)
+	if err != nil {
+		return app.ImportedLink{}, "original_url", err
+	}
+	short := row.Short
+	if len(short) == 0 {
+		short = app.GenShort(longURL.String())
+	} else if err := app.ValidateShortCode(short, longURL.String()); err != nil {
+		return app.ImportedLink{}, "short", err
+	}
+	opts := defaults
+	opts.Title = row.Title
+	if err := opts.ValidateTitle(); err != nil {
+		return app.ImportedLink{}, "title", err
+	}
+	if err := app.ValidateMetadata(row.Metadata); err != nil {
+		return app.ImportedLink{}, "metadata", err
+	}
+	opts.Metadata = row.Metadata
+	createdAt := *defaults.CreatedAt
+	if row.CreatedAt != nil {
+		createdAt = row.CreatedAt.UTC()
+	}
+	opts.CreatedAt = &createdAt
+	return app.ImportedLink{Short: short, LongURL: longURL.String(), Options: opts}, "", nil
+}
+
+// userURLs lists the links of the user that aren't deleted.
+func (h *Handler) userURLs(ctx context.Context, userID uint32) ([]UserURLsResponseStruct, error) {
+	response := make([]UserURLsResponseStruct, 0)
+	for _, short := range h.storage.GetURLsByUserID(ctx, userID) {
+		longURL, _ := h.storage.GetURLFromShort(ctx, short)
+		opts, err := h.storage.GetLinkOptions(ctx, short)
+		if err != nil {
+			return nil, err
+		}
+		if opts.IsDeleted() {
+			continue
+		}
+		item := UserURLsResponseStruct{
+			ShortURL: strings.Join([]string{h.baseServerURL, short}, "/"),
+			LongURL:  longURL,
+			Status:   linkStatusActive,
+		}
+		if opts.IsDisabled() {
+			item.Status = linkStatusDisabled
+			item.TakedownReason = opts.Takedown.Reason
+		}
+		response = append(response, item)
+	}
+	return response, nil
+}
+
+func (h *Handler) exportedURL(link app.ExportedLink) ExportedURLJSON {
+	exported := ExportedURLJSON{
+		Short:       link.Short,
+		ShortURL:    strings.Join([]string{h.baseServerURL, link.Short}, "/"),
+		OriginalURL: link.LongURL,
+		Status:      linkStatusActive,
+		CreatedAt:   link.Options.CreatedAt,
+		Title:       link.Options.Title,
+		Metadata:    link.Options.Metadata,
+		Clicks:      link.Clicks,
+	}
+	if link.Options.IsDisabled() {
+		exported.Status = linkStatusDisabled
+		exported.TakedownReason = link.Options.Takedown.Reason
+	}
+	return exported
+}
+
+func (h *Handler) linkInfo(ctx context.Context, short string, longURL string, opts app.LinkOptions, owner bool) (LinkInfoJSON, error) {
+	info := LinkInfoJSON{
+		Short:     short,
+		ShortURL:  strings.Join([]string{h.baseServerURL, short}, "/"),
+		Status:    linkStatusActive,
+		CreatedAt: opts.CreatedAt,
+		Title:     opts.Title,
+		Protected: opts.IsProtected(),
+		Preview:   opts.ForcePreview,
+	}
+	exhausted, err := h.clicksExhausted(ctx, short, opts)
+	if err != nil {
+		return LinkInfoJSON{}, err
+	}
+	switch {
+	case opts.IsDisabled():
+		info.Status = linkStatusDisabled
+		info.TakedownReason = opts.Takedown.Reason
+	case exhausted:
+		info.Status = linkStatusExhausted
+	}
+	if !owner {
+		if !info.Protected && !opts.IsDisabled() {
+			info.OriginalURL = longURL
+		}
+		return info, nil
+	}
+	clicks, err := h.storage.GetClickStats(ctx, short)
+	if err != nil {
+		return LinkInfoJSON{}, err
+	}
+	info.OriginalURL = longURL
+	info.Owner = true
+	info.ActiveFrom = opts.ActiveFrom
+	info.ActiveUntil = opts.ActiveUntil
+	info.MaxClicks = opts.MaxClicks
+	info.Clicks = &clicks
+	info.Metadata = opts.Metadata
+	return info, nil
+}
+
+// deleteUserURLs marks the links of the user as deleted, links the user
+// doesn't own are skipped.
+func (h *Handler) deleteUserURLs(ctx context.Context, userID uint32, shorts []string) error {
+	owned := make(map[string]bool)
+	for _, short := range h.storage.GetURLsByUserID(ctx, userID) {
+		owned[short] = true
+	}
+	now := time.Now().UTC()
+	for _, short := range shorts {
+		if !owned[short] {
+			continue
+		}
+		err := h.storage.UpdateLinkOptions(ctx, short, func(opts *app.LinkOptions) error {
+			if !opts.IsDeleted() {
+				opts.DeletedAt = &now
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
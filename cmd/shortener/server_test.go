@@ -2,13 +2,23 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"image/png"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/evgenspj/url-shortener/internal/app"
 	"github.com/stretchr/testify/assert"
@@ -316,7 +326,7 @@ func TestShortenHandlerJSON(t *testing.T) {
 			if len(requestHeaders) == 0 {
 				requestHeaders = map[string][]string{"Content-Type": {"application/json"}}
 			}
-			requestBody, _ := json.Marshal(ShortenHandlerJSONRequest{tt.testURL})
+			requestBody, _ := json.Marshal(ShortenHandlerJSONRequest{URL: tt.testURL})
 			reqArgs := testRequestArgs{
 				t:       t,
 				ts:      ts,
@@ -420,6 +430,68 @@ func TestUserURLs(t *testing.T) {
 	}
 }
 
+func TestDeleteUserURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage app.Storage
+	}{
+		{
+			name: "struct storage",
+			storage: &app.StructStorage{
+				ShortToLong:   make(map[string]string),
+				UserIDToShort: make(map[uint32][]string),
+			},
+		},
+		{
+			name:    "json file storage",
+			storage: &app.JSONFileStorage{Filename: filepath.Join(t.TempDir(), "urls.json")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Handler{
+				storage:       tt.storage,
+				baseServerURL: defaultBaseURL,
+			}
+			ts := httptest.NewServer(middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle))
+			defer ts.Close()
+
+			longURL := "http://example.com/deleted"
+			short := app.GenShort(longURL)
+			owner := genUserTokenByID(genUserID())
+			other := genUserTokenByID(genUserID())
+			send := func(method string, path string, body string, userToken string) int {
+				resp := testRequest(testRequestArgs{
+					t:         t,
+					ts:        ts,
+					method:    method,
+					path:      path,
+					body:      body,
+					headers:   map[string][]string{"Content-Type": {"application/json"}},
+					userToken: userToken,
+				})
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			require.Equal(t, http.StatusCreated, send(http.MethodPost, "/api/shorten", `{"url": "`+longURL+`", "max_clicks": 1}`, owner))
+			require.Equal(t, http.StatusTemporaryRedirect, send(http.MethodGet, "/"+short, "", ""))
+			require.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/api/user/urls", `["`+short+`"]`, other), "only the owner deletes")
+			require.Equal(t, http.StatusGone, send(http.MethodGet, "/"+short, "", ""), "the click limit is used up")
+			require.Equal(t, http.StatusNoContent, send(http.MethodDelete, "/api/user/urls", `["`+short+`"]`, owner))
+			assert.Equal(t, http.StatusGone, send(http.MethodGet, "/"+short, "", ""))
+			assert.Equal(t, http.StatusNoContent, send(http.MethodGet, "/api/user/urls", "", owner))
+
+			// the url of a deleted link can be shortened again
+			require.Equal(t, http.StatusCreated, send(http.MethodPost, "/api/shorten", `{"url": "`+longURL+`"}`, other))
+			assert.Equal(t, http.StatusTemporaryRedirect, send(http.MethodGet, "/"+short, "", ""))
+			assert.Equal(t, http.StatusTemporaryRedirect, send(http.MethodGet, "/"+short, "", ""), "the click limit is gone")
+			assert.Equal(t, http.StatusNoContent, send(http.MethodGet, "/api/user/urls", "", owner), "the link moved to the new owner")
+			assert.Equal(t, http.StatusOK, send(http.MethodGet, "/api/user/urls", "", other))
+			assert.Equal(t, http.StatusConflict, send(http.MethodPost, "/api/shorten", `{"url": "`+longURL+`"}`, owner))
+		})
+	}
+}
+
 func TestShortenBatchHandler(t *testing.T) {
 	type want struct {
 		code     int
@@ -440,8 +512,8 @@ func TestShortenBatchHandler(t *testing.T) {
 			want: want{
 				code: 201,
 				response: []ShortenBatchHandlerJSONResponse{
-					{CorrelationID: "some id", ShortURL: app.GenShort("https://yandex.ru")},
-					{CorrelationID: "other id", ShortURL: app.GenShort("https://google.com")},
+					{CorrelationID: "some id", ShortURL: defaultBaseURL + "/" + app.GenShort("https://yandex.ru")},
+					{CorrelationID: "other id", ShortURL: defaultBaseURL + "/" + app.GenShort("https://google.com")},
 				},
 			},
 		},
@@ -463,7 +535,7 @@ func TestShortenBatchHandler(t *testing.T) {
 			want: want{
 				code: http.StatusConflict,
 				response: []ShortenBatchHandlerJSONResponse{
-					{CorrelationID: "id", ShortURL: app.GenShort("http://duplicate.com")},
+					{CorrelationID: "id", ShortURL: defaultBaseURL + "/" + app.GenShort("http://duplicate.com")},
 				},
 			},
 		},
@@ -498,14 +570,2464 @@ func TestShortenBatchHandler(t *testing.T) {
 			defer resp.Body.Close()
 
 			require.Equal(t, tt.want.code, resp.StatusCode)
-			if len(tt.want.response) == http.StatusOK {
+			if len(tt.want.response) > 0 {
 				respBody, err := io.ReadAll(resp.Body)
 				require.NoError(t, err)
 				bodyParsed := make([]ShortenBatchHandlerJSONResponse, 0)
 				err = json.Unmarshal(respBody, &bodyParsed)
 				require.NoError(t, err)
-				require.Equal(t, bodyParsed, tt.want.response)
+				require.Equal(t, tt.want.response, bodyParsed)
+			}
+		})
+	}
+}
+
+func TestPasswordProtectedLink(t *testing.T) {
+	longURL := "http://example.com/internal"
+	short := app.GenShort(longURL)
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL:      defaultBaseURL,
+		unlockAttempts:     app.AttemptLimiter{MaxAttempts: 2},
+		linkUnlockAttempts: app.AttemptLimiter{MaxAttempts: 4},
+		trustedProxies:     []*net.IPNet{loopback},
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	requestBody, _ := json.Marshal(ShortenHandlerJSONRequest{URL: longURL, Password: "secret"})
+	resp := testRequest(testRequestArgs{
+		t:       t,
+		ts:      ts,
+		method:  http.MethodPost,
+		path:    "/api/shorten",
+		body:    string(requestBody),
+		headers: map[string][]string{"Content-Type": {"application/json"}},
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	for _, tt := range []struct {
+		name     string
+		url      string
+		password string
+		code     int
+		errCode  string
+	}{
+		{name: "same password", url: longURL, password: "secret", code: http.StatusConflict},
+		{name: "other password", url: longURL, password: "other", code: http.StatusConflict, errCode: errCodeURLTaken},
+		{name: "shortened without a password", url: "http://example.com/public", code: http.StatusCreated},
+		{name: "protecting a public url", url: "http://example.com/public", password: "secret", code: http.StatusConflict, errCode: errCodeURLTaken},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			requestBody, _ := json.Marshal(ShortenHandlerJSONRequest{URL: tt.url, Password: tt.password})
+			resp := testRequest(testRequestArgs{
+				t:       t,
+				ts:      ts,
+				method:  http.MethodPost,
+				path:    "/api/shorten",
+				body:    string(requestBody),
+				headers: map[string][]string{"Content-Type": {"application/json"}},
+			})
+			defer resp.Body.Close()
+			require.Equal(t, tt.code, resp.StatusCode)
+			if len(tt.errCode) > 0 {
+				errResp := ErrorJSONResponse{}
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+				assert.Equal(t, tt.errCode, errResp.Error.Code)
+			}
+		})
+	}
+
+	formHeaders := map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}
+	steps := []struct {
+		name           string
+		client         string
+		method         string
+		body           string
+		code           int
+		locationHeader string
+	}{
+		{name: "unlock form", client: "10.0.0.1", method: http.MethodGet, code: http.StatusOK},
+		{name: "wrong password", client: "10.0.0.1", method: http.MethodPost, body: "password=wrong", code: http.StatusForbidden},
+		{name: "right password", client: "10.0.0.1", method: http.MethodPost, body: "password=secret", code: http.StatusSeeOther, locationHeader: longURL},
+		{name: "wrong password again", client: "10.0.0.1", method: http.MethodPost, body: "password=wrong", code: http.StatusForbidden},
+		{name: "rate limited", client: "10.0.0.1", method: http.MethodPost, body: "password=secret", code: http.StatusTooManyRequests},
+		{name: "other clients aren't locked out", client: "10.0.0.2", method: http.MethodPost, body: "password=secret", code: http.StatusSeeOther, locationHeader: longURL},
+		{name: "wrong password of another client", client: "10.0.0.2", method: http.MethodPost, body: "password=wrong", code: http.StatusForbidden},
+		{name: "wrong password of a third client", client: "10.0.0.3", method: http.MethodPost, body: "password=wrong", code: http.StatusForbidden},
+		{name: "link rate limited", client: "10.0.0.4", method: http.MethodPost, body: "password=secret", code: http.StatusTooManyRequests},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			resp := testRequest(testRequestArgs{
+				t:      t,
+				ts:     ts,
+				method: step.method,
+				path:   "/" + short,
+				body:   step.body,
+				headers: map[string][]string{
+					"Content-Type":    formHeaders["Content-Type"],
+					"X-Forwarded-For": {step.client},
+				},
+			})
+			defer resp.Body.Close()
+
+			require.Equal(t, step.code, resp.StatusCode)
+			assert.Equal(t, step.locationHeader, resp.Header.Get("Location"))
+		})
+	}
+}
+
+func TestMaxClicks(t *testing.T) {
+	const (
+		maxClicks = 3
+		requests  = 20
+	)
+	tests := []struct {
+		name    string
+		storage app.Storage
+	}{
+		{
+			name: "struct storage",
+			storage: &app.StructStorage{
+				ShortToLong:   make(map[string]string),
+				UserIDToShort: make(map[uint32][]string),
+			},
+		},
+		{
+			name:    "json file storage",
+			storage: &app.JSONFileStorage{Filename: filepath.Join(t.TempDir(), "urls.json")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Handler{
+				storage:       tt.storage,
+				baseServerURL: defaultBaseURL,
+			}
+			r := NewRouter(&handler)
+			ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+			defer ts.Close()
+
+			longURL := "http://example.com/invite"
+			requestBody, _ := json.Marshal(ShortenHandlerJSONRequest{URL: longURL, MaxClicks: maxClicks})
+			resp := testRequest(testRequestArgs{
+				t:       t,
+				ts:      ts,
+				method:  http.MethodPost,
+				path:    "/api/shorten",
+				body:    string(requestBody),
+				headers: map[string][]string{"Content-Type": {"application/json"}},
+			})
+			resp.Body.Close()
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+			codes := make(chan int, requests)
+			var wg sync.WaitGroup
+			for i := 0; i < requests; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					resp := testRequest(testRequestArgs{
+						t:      t,
+						ts:     ts,
+						method: http.MethodGet,
+						path:   "/" + app.GenShort(longURL),
+					})
+					resp.Body.Close()
+					codes <- resp.StatusCode
+				}()
+			}
+			wg.Wait()
+			close(codes)
+			redirects := 0
+			for code := range codes {
+				if code == http.StatusTemporaryRedirect {
+					redirects++
+				} else {
+					assert.Equal(t, http.StatusGone, code)
+				}
+			}
+			assert.Equal(t, maxClicks, redirects)
+		})
+	}
+}
+
+func TestRedirectCode(t *testing.T) {
+	until := time.Now().Add(time.Hour)
+	type want struct {
+		code         int
+		cacheControl string
+	}
+	tests := []struct {
+		name        string
+		serverCode  int
+		linkOptions app.LinkOptions
+		want        want
+	}{
+		{
+			name: "default",
+			want: want{
+				code:         http.StatusTemporaryRedirect,
+				cacheControl: "no-cache",
+			},
+		},
+		{
+			name:       "server default",
+			serverCode: http.StatusFound,
+			want: want{
+				code:         http.StatusFound,
+				cacheControl: "no-cache",
+			},
+		},
+		{
+			name:        "link override",
+			serverCode:  http.StatusFound,
+			linkOptions: app.LinkOptions{RedirectCode: http.StatusMovedPermanently},
+			want: want{
+				code:         http.StatusMovedPermanently,
+				cacheControl: "private, max-age=300",
+			},
+		},
+		{
+			name:        "permanent redirect with an activation window",
+			linkOptions: app.LinkOptions{RedirectCode: http.StatusMovedPermanently, ActiveUntil: &until},
+			want: want{
+				code:         http.StatusMovedPermanently,
+				cacheControl: "no-store",
+			},
+		},
+		{
+			name:        "permanent redirect with click limit",
+			linkOptions: app.LinkOptions{RedirectCode: http.StatusPermanentRedirect, MaxClicks: 10},
+			want: want{
+				code:         http.StatusPermanentRedirect,
+				cacheControl: "no-store",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Handler{
+				storage: &app.StructStorage{
+					ShortToLong:   make(map[string]string),
+					UserIDToShort: make(map[uint32][]string),
+				},
+				baseServerURL: defaultBaseURL,
+				redirectCode:  tt.serverCode,
+			}
+			err := handler.storage.SaveLink(context.Background(), "loremid", "http://example.com", genUserID(), tt.linkOptions)
+			require.NoError(t, err)
+			r := NewRouter(&handler)
+			ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+			defer ts.Close()
+			resp := testRequest(testRequestArgs{
+				t:      t,
+				ts:     ts,
+				method: http.MethodGet,
+				path:   "/loremid",
+			})
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.want.code, resp.StatusCode)
+			assert.Equal(t, "http://example.com", resp.Header.Get("Location"))
+			assert.Equal(t, tt.want.cacheControl, resp.Header.Get("Cache-Control"))
+		})
+	}
+}
+
+func TestRedirectPassthrough(t *testing.T) {
+	type want struct {
+		code           int
+		locationHeader string
+	}
+	tests := []struct {
+		name        string
+		longURL     string
+		linkOptions app.LinkOptions
+		request     string
+		want        want
+	}{
+		{
+			name:    "query ignored by default",
+			longURL: "http://example.com/landing?a=1",
+			request: "/loremid?utm_source=x",
+			want: want{
+				code:           http.StatusTemporaryRedirect,
+				locationHeader: "http://example.com/landing?a=1",
+			},
+		},
+		{
+			name:        "query forwarded keeping link values",
+			longURL:     "http://example.com/landing?a=1",
+			linkOptions: app.LinkOptions{ForwardQuery: true},
+			request:     "/loremid?a=2&utm_source=x",
+			want: want{
+				code:           http.StatusTemporaryRedirect,
+				locationHeader: "http://example.com/landing?a=1&utm_source=x",
+			},
+		},
+		{
+			name:        "query forwarded overriding link values",
+			longURL:     "http://example.com/landing?a=1",
+			linkOptions: app.LinkOptions{ForwardQuery: true, QueryConflict: app.QueryConflictOverride},
+			request:     "/loremid?a=2",
+			want: want{
+				code:           http.StatusTemporaryRedirect,
+				locationHeader: "http://example.com/landing?a=2",
+			},
+		},
+		{
+			name:        "query forwarded appending values",
+			longURL:     "http://example.com/landing?a=1",
+			linkOptions: app.LinkOptions{ForwardQuery: true, QueryConflict: app.QueryConflictAppend},
+			request:     "/loremid?a=2",
+			want: want{
+				code:           http.StatusTemporaryRedirect,
+				locationHeader: "http://example.com/landing?a=1&a=2",
+			},
+		},
+		{
+			name:    "path not forwarded",
+			longURL: "http://example.com/docs",
+			request: "/loremid/extra/path",
+			want: want{
+				code:           http.StatusNotFound,
+				locationHeader: "",
+			},
+		},
+		{
+			name:        "path forwarded",
+			longURL:     "http://example.com/docs/",
+			linkOptions: app.LinkOptions{ForwardPath: true, ForwardQuery: true},
+			request:     "/loremid/extra/path?page=2",
+			want: want{
+				code:           http.StatusTemporaryRedirect,
+				locationHeader: "http://example.com/docs/extra/path?page=2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Handler{
+				storage: &app.StructStorage{
+					ShortToLong:   make(map[string]string),
+					UserIDToShort: make(map[uint32][]string),
+				},
+				baseServerURL: defaultBaseURL,
+			}
+			err := handler.storage.SaveLink(context.Background(), "loremid", tt.longURL, genUserID(), tt.linkOptions)
+			require.NoError(t, err)
+			r := NewRouter(&handler)
+			ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+			defer ts.Close()
+			resp := testRequest(testRequestArgs{
+				t:      t,
+				ts:     ts,
+				method: http.MethodGet,
+				path:   tt.request,
+			})
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.want.code, resp.StatusCode)
+			assert.Equal(t, tt.want.locationHeader, resp.Header.Get("Location"))
+		})
+	}
+}
+
+func TestUTMTemplates(t *testing.T) {
+	userToken := genUserTokenByID(genUserID())
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+	jsonHeaders := map[string][]string{"Content-Type": {"application/json"}}
+
+	settings, _ := json.Marshal(UserSettingsJSON{DefaultUTM: &app.UTMParams{Source: "newsletter", Medium: "email"}})
+	resp := testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodPut,
+		path:      "/api/user/settings",
+		body:      string(settings),
+		headers:   jsonHeaders,
+		userToken: userToken,
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodGet,
+		path:      "/api/user/settings",
+		userToken: userToken,
+	})
+	savedSettings := UserSettingsJSON{}
+	json.NewDecoder(resp.Body).Decode(&savedSettings)
+	resp.Body.Close()
+	require.NotNil(t, savedSettings.DefaultUTM)
+	assert.Equal(t, "newsletter", savedSettings.DefaultUTM.Source)
+
+	tests := []struct {
+		name           string
+		path           string
+		body           string
+		headers        map[string][]string
+		locationHeader string
+	}{
+		{
+			name:           "user default template",
+			path:           "/",
+			body:           "http://example.com/a",
+			locationHeader: "http://example.com/a?utm_medium=email&utm_source=newsletter",
+		},
+		{
+			name:           "parameters already in destination are kept",
+			path:           "/",
+			body:           "http://example.com/b?utm_source=site",
+			locationHeader: "http://example.com/b?utm_medium=email&utm_source=site",
+		},
+		{
+			name:           "link template overrides user default",
+			path:           "/api/shorten",
+			body:           `{"url": "http://example.com/c", "utm": {"campaign": "launch"}}`,
+			headers:        jsonHeaders,
+			locationHeader: "http://example.com/c?utm_campaign=launch",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testRequest(testRequestArgs{
+				t:         t,
+				ts:        ts,
+				method:    http.MethodPost,
+				path:      tt.path,
+				body:      tt.body,
+				headers:   tt.headers,
+				userToken: userToken,
+			})
+			respBody, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require.NoError(t, err)
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+			shortURL := string(respBody)
+			if tt.headers != nil {
+				respJSONStruct := ShortenHandlerJSONResponse{}
+				require.NoError(t, json.Unmarshal(respBody, &respJSONStruct))
+				shortURL = respJSONStruct.Result
 			}
+
+			resp = testRequest(testRequestArgs{
+				t:      t,
+				ts:     ts,
+				method: http.MethodGet,
+				path:   strings.TrimPrefix(shortURL, defaultBaseURL),
+			})
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			assert.Equal(t, tt.locationHeader, resp.Header.Get("Location"))
+		})
+	}
+}
+
+func TestRedirectRules(t *testing.T) {
+	userToken := genUserTokenByID(genUserID())
+	longURL := "http://example.com/app"
+	short := app.GenShort(longURL)
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+	jsonHeaders := map[string][]string{"Content-Type": {"application/json"}}
+
+	requestBody, _ := json.Marshal(ShortenHandlerJSONRequest{
+		URL: longURL,
+		Rules: []app.RedirectRule{
+			{Device: app.DeviceIOS, URL: "https://apps.apple.com/app/id1"},
+			{Device: app.DeviceAndroid, URL: "https://play.google.com/store/apps/details?id=app"},
+		},
+	})
+	resp := testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodPost,
+		path:      "/api/shorten",
+		body:      string(requestBody),
+		headers:   jsonHeaders,
+		userToken: userToken,
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	rules, _ := json.Marshal(LinkRulesJSON{Rules: []app.RedirectRule{
+		{Device: app.DeviceIOS, URL: "https://apps.apple.com/app/id1"},
+		{Device: app.DeviceAndroid, URL: "https://play.google.com/store/apps/details?id=app"},
+		{Language: "de", URL: "http://example.com/de/app"},
+		{Header: &app.HeaderMatch{Name: "X-Beta", Value: "yes"}, URL: "http://beta.example.com/app"},
+	}})
+	resp = testRequest(testRequestArgs{
+		t:       t,
+		ts:      ts,
+		method:  http.MethodPut,
+		path:    "/api/user/urls/" + short + "/rules",
+		body:    string(rules),
+		headers: jsonHeaders,
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode, "only the owner can change rules")
+	resp = testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodPut,
+		path:      "/api/user/urls/" + short + "/rules",
+		body:      string(rules),
+		headers:   jsonHeaders,
+		userToken: userToken,
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	tests := []struct {
+		name           string
+		headers        map[string][]string
+		locationHeader string
+	}{
+		{
+			name:           "ios",
+			headers:        map[string][]string{"User-Agent": {"Mozilla/5.0 (iPhone; CPU iPhone OS 15_0 like Mac OS X)"}},
+			locationHeader: "https://apps.apple.com/app/id1",
+		},
+		{
+			name:           "android",
+			headers:        map[string][]string{"User-Agent": {"Mozilla/5.0 (Linux; Android 12; Pixel 6) Mobile"}},
+			locationHeader: "https://play.google.com/store/apps/details?id=app",
+		},
+		{
+			name:           "preferred language",
+			headers:        map[string][]string{"Accept-Language": {"en;q=0.5, de-AT"}},
+			locationHeader: "http://example.com/de/app",
+		},
+		{
+			name:           "header",
+			headers:        map[string][]string{"X-Beta": {"YES"}},
+			locationHeader: "http://beta.example.com/app",
+		},
+		{
+			name:           "fallback",
+			headers:        map[string][]string{"Accept-Language": {"en-US, de;q=0.8"}},
+			locationHeader: longURL,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testRequest(testRequestArgs{
+				t:       t,
+				ts:      ts,
+				method:  http.MethodGet,
+				path:    "/" + short,
+				headers: tt.headers,
+			})
+			defer resp.Body.Close()
+
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			assert.Equal(t, tt.locationHeader, resp.Header.Get("Location"))
+			assert.Equal(t, "User-Agent, Accept-Language, X-Beta", resp.Header.Get("Vary"))
 		})
 	}
 }
+
+func TestSplitVariants(t *testing.T) {
+	userToken := genUserTokenByID(genUserID())
+	longURL := "http://example.com/landing"
+	short := app.GenShort(longURL)
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+	jsonHeaders := map[string][]string{"Content-Type": {"application/json"}}
+
+	requestBody, _ := json.Marshal(ShortenHandlerJSONRequest{
+		URL: longURL,
+		Variants: []app.Variant{
+			{Name: "a", URL: "http://example.com/landing-a", Weight: 1},
+			{Name: "b", URL: "http://example.com/landing-b", Weight: 0},
+		},
+	})
+	resp := testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodPost,
+		path:      "/api/shorten",
+		body:      string(requestBody),
+		headers:   jsonHeaders,
+		userToken: userToken,
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	steps := []struct {
+		name           string
+		variants       []app.Variant
+		cookie         string
+		locationHeader string
+	}{
+		{
+			name:           "weighted pick",
+			locationHeader: "http://example.com/landing-a",
+		},
+		{
+			name:           "sticky variant",
+			variants:       []app.Variant{{Name: "a", URL: "http://example.com/landing-a", Weight: 1}, {Name: "b", URL: "http://example.com/landing-b", Weight: 1}},
+			cookie:         "variant_" + short + "=b",
+			locationHeader: "http://example.com/landing-b",
+		},
+		{
+			name:           "sticky variant without traffic is picked again",
+			variants:       []app.Variant{{Name: "a", URL: "http://example.com/landing-a", Weight: 0}, {Name: "b", URL: "http://example.com/landing-b", Weight: 1}},
+			cookie:         "variant_" + short + "=a",
+			locationHeader: "http://example.com/landing-b",
+		},
+	}
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if step.variants != nil {
+				variants, _ := json.Marshal(LinkVariantsJSON{Variants: step.variants})
+				resp := testRequest(testRequestArgs{
+					t:         t,
+					ts:        ts,
+					method:    http.MethodPut,
+					path:      "/api/user/urls/" + short + "/variants",
+					body:      string(variants),
+					headers:   jsonHeaders,
+					userToken: userToken,
+				})
+				resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+			headers := map[string][]string{}
+			if len(step.cookie) > 0 {
+				headers["Cookie"] = []string{step.cookie}
+			}
+			resp := testRequest(testRequestArgs{
+				t:       t,
+				ts:      ts,
+				method:  http.MethodGet,
+				path:    "/" + short,
+				headers: headers,
+			})
+			defer resp.Body.Close()
+
+			require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			assert.Equal(t, step.locationHeader, resp.Header.Get("Location"))
+			cookieNames := []string{}
+			for _, cookie := range resp.Cookies() {
+				cookieNames = append(cookieNames, cookie.Name)
+			}
+			assert.Contains(t, cookieNames, "variant_"+short)
+		})
+	}
+
+	resp = testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodGet,
+		path:      "/api/user/urls/" + short + "/stats",
+		userToken: userToken,
+	})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	stats := app.ClickStats{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, app.ClickStats{Total: 3, Variants: map[string]int64{"a": 1, "b": 2}}, stats)
+}
+
+func TestActivationWindow(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	type want struct {
+		code           int
+		locationHeader string
+	}
+	tests := []struct {
+		name        string
+		linkOptions app.LinkOptions
+		want        want
+	}{
+		{
+			name:        "inside window",
+			linkOptions: app.LinkOptions{ActiveFrom: &past, ActiveUntil: &future},
+			want: want{
+				code:           http.StatusTemporaryRedirect,
+				locationHeader: "http://example.com/launch",
+			},
+		},
+		{
+			name:        "not started",
+			linkOptions: app.LinkOptions{ActiveFrom: &future},
+			want: want{
+				code: http.StatusForbidden,
+			},
+		},
+		{
+			name:        "not started with fallback",
+			linkOptions: app.LinkOptions{ActiveFrom: &future, BeforeURL: "http://example.com/soon"},
+			want: want{
+				code:           http.StatusFound,
+				locationHeader: "http://example.com/soon",
+			},
+		},
+		{
+			name:        "ended",
+			linkOptions: app.LinkOptions{ActiveUntil: &past},
+			want: want{
+				code: http.StatusGone,
+			},
+		},
+		{
+			name:        "ended with fallback",
+			linkOptions: app.LinkOptions{ActiveUntil: &past, AfterURL: "http://example.com/archive"},
+			want: want{
+				code:           http.StatusFound,
+				locationHeader: "http://example.com/archive",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Handler{
+				storage: &app.StructStorage{
+					ShortToLong:   make(map[string]string),
+					UserIDToShort: make(map[uint32][]string),
+				},
+				baseServerURL: defaultBaseURL,
+			}
+			err := handler.storage.SaveLink(context.Background(), "loremid", "http://example.com/launch", genUserID(), tt.linkOptions)
+			require.NoError(t, err)
+			r := NewRouter(&handler)
+			ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+			defer ts.Close()
+			resp := testRequest(testRequestArgs{
+				t:      t,
+				ts:     ts,
+				method: http.MethodGet,
+				path:   "/loremid",
+			})
+			defer resp.Body.Close()
+
+			require.Equal(t, tt.want.code, resp.StatusCode)
+			assert.Equal(t, tt.want.locationHeader, resp.Header.Get("Location"))
+		})
+	}
+}
+
+type testResolver map[string][]string
+
+func (r testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, exists := r[host]
+	if !exists {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	addrs := []net.IPAddr{}
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestURLValidation(t *testing.T) {
+	urlValidator := app.URLValidator{
+		MaxLength: 64,
+		SelfHost:  "short.example",
+		Resolver: testResolver{
+			"example.com":   {"93.184.216.34"},
+			"intranet.corp": {"10.1.2.3"},
+			"rebind.test":   {"93.184.216.34", "127.0.0.1"},
+		},
+	}
+	tests := []struct {
+		name    string
+		path    string
+		body    string
+		headers map[string][]string
+		code    int
+	}{
+		{name: "public host", path: "/", body: "http://example.com", code: http.StatusCreated},
+		{name: "unresolvable host", path: "/", body: "https://not-resolving.example.org", code: http.StatusBadRequest},
+		{name: "javascript scheme", path: "/", body: "javascript:alert(1)", code: http.StatusBadRequest},
+		{name: "file scheme", path: "/", body: "file:///etc/passwd", code: http.StatusBadRequest},
+		{name: "data scheme", path: "/", body: "data:text/html,hi", code: http.StatusBadRequest},
+		{name: "localhost", path: "/", body: "http://localhost:6379", code: http.StatusBadRequest},
+		{name: "loopback literal", path: "/", body: "http://127.0.0.1/", code: http.StatusBadRequest},
+		{name: "private literal", path: "/", body: "http://10.0.0.1/admin", code: http.StatusBadRequest},
+		{name: "link-local literal", path: "/", body: "http://169.254.169.254/latest/meta-data", code: http.StatusBadRequest},
+		{name: "ipv6 loopback", path: "/", body: "http://[::1]:8080/", code: http.StatusBadRequest},
+		{name: "numeric host", path: "/", body: "http://2130706433/", code: http.StatusBadRequest},
+		{name: "resolves to private", path: "/", body: "http://intranet.corp/wiki", code: http.StatusBadRequest},
+		{name: "one address is loopback", path: "/", body: "http://rebind.test/", code: http.StatusBadRequest},
+		{name: "self link", path: "/", body: "http://short.example/abc", code: http.StatusBadRequest},
+		{name: "too long", path: "/", body: "http://example.com/" + strings.Repeat("a", 64), code: http.StatusBadRequest},
+		{
+			name:    "json endpoint",
+			path:    "/api/shorten",
+			body:    `{"url": "http://10.0.0.1/"}`,
+			headers: map[string][]string{"Content-Type": {"application/json"}},
+			code:    http.StatusBadRequest,
+		},
+		{
+			name:    "json endpoint rule destination",
+			path:    "/api/shorten",
+			body:    `{"url": "http://example.com/app", "rules": [{"device": "ios", "url": "http://127.0.0.1/"}]}`,
+			headers: map[string][]string{"Content-Type": {"application/json"}},
+			code:    http.StatusBadRequest,
+		},
+		{
+			name:    "batch endpoint",
+			path:    "/api/shorten/batch",
+			body:    `[{"correlation_id": "1", "original_url": "http://example.com/1"}, {"correlation_id": "2", "original_url": "ftp://example.com/2"}]`,
+			headers: map[string][]string{"Content-Type": {"application/json"}},
+			code:    http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Handler{
+				storage: &app.StructStorage{
+					ShortToLong:   make(map[string]string),
+					UserIDToShort: make(map[uint32][]string),
+				},
+				baseServerURL: defaultBaseURL,
+				urlValidator:  urlValidator,
+			}
+			r := NewRouter(&handler)
+			ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+			defer ts.Close()
+			resp := testRequest(testRequestArgs{
+				t:       t,
+				ts:      ts,
+				method:  http.MethodPost,
+				path:    tt.path,
+				body:    tt.body,
+				headers: tt.headers,
+			})
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.code, resp.StatusCode)
+		})
+	}
+}
+
+func TestDomainFilter(t *testing.T) {
+	const adminToken = "admin-secret"
+	blocklistFile := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("# phishing\nevil.com\n*.phish.net\n/^ads[0-9]+\\./\n"), 0644))
+	domainFilter := &app.DomainFilter{BlocklistFile: blocklistFile}
+	require.NoError(t, domainFilter.Reload())
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+		domainFilter:  domainFilter,
+		adminToken:    adminToken,
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		code int
+	}{
+		{name: "allowed", url: "http://later.example.com/page", code: http.StatusCreated},
+		{name: "exact host", url: "http://EVIL.com/login", code: http.StatusBadRequest},
+		{name: "wildcard apex", url: "http://phish.net/", code: http.StatusBadRequest},
+		{name: "wildcard subdomain", url: "http://bank.phish.net/", code: http.StatusBadRequest},
+		{name: "regexp", url: "http://ads42.example.org/", code: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testRequest(testRequestArgs{
+				t:      t,
+				ts:     ts,
+				method: http.MethodPost,
+				path:   "/",
+				body:   tt.url,
+			})
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+		})
+	}
+
+	redirectCode := func() int {
+		resp := testRequest(testRequestArgs{
+			t:      t,
+			ts:     ts,
+			method: http.MethodGet,
+			path:   "/" + app.GenShort("http://later.example.com/page"),
+		})
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusTemporaryRedirect, redirectCode())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go domainFilter.Watch(ctx, 10*time.Millisecond)
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("*.example.com\n"), 0644))
+	modTime := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(blocklistFile, modTime, modTime))
+	require.Eventually(t, func() bool {
+		return redirectCode() == http.StatusForbidden
+	}, time.Second, 10*time.Millisecond, "links to newly blocked domains stop working")
+
+	getStats := func(token string) *http.Response {
+		return testRequest(testRequestArgs{
+			t:       t,
+			ts:      ts,
+			method:  http.MethodGet,
+			path:    "/api/admin/domain-filter",
+			headers: map[string][]string{"Authorization": {"Bearer " + token}},
+		})
+	}
+	resp := getStats("wrong")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "the counters are for admins only")
+	resp = getStats(adminToken)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var stats app.DomainFilterStats
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&stats))
+	assert.Equal(t, 1, stats.BlocklistSize)
+	assert.Equal(t, int64(4), stats.Rejections["shorten.blocklist"])
+	assert.Equal(t, int64(1), stats.Rejections["redirect.blocklist"])
+}
+
+func TestRateLimit(t *testing.T) {
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL:  defaultBaseURL,
+		rateLimiter:    &app.MemoryRateLimiter{},
+		createLimit:    app.RateLimit{Rate: 1.0 / 60, Burst: 3},
+		redirectLimit:  app.RateLimit{Rate: 1.0 / 60, Burst: 2},
+		trustedProxies: []*net.IPNet{loopback},
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	shorten := func(clientIP string, userToken string, url string) *http.Response {
+		return testRequest(testRequestArgs{
+			t:         t,
+			ts:        ts,
+			method:    http.MethodPost,
+			path:      "/",
+			body:      url,
+			headers:   map[string][]string{"X-Forwarded-For": {clientIP}},
+			userToken: userToken,
+		})
+	}
+
+	resp := shorten("203.0.113.1", "", "http://example.com/1")
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "3", resp.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "2", resp.Header.Get("RateLimit-Remaining"))
+	assert.Equal(t, "60", resp.Header.Get("RateLimit-Reset"))
+
+	batch := `[
+		{"correlation_id": "1", "original_url": "http://example.com/2"},
+		{"correlation_id": "2", "original_url": "http://example.com/3"}
+	]`
+	resp = testRequest(testRequestArgs{
+		t:       t,
+		ts:      ts,
+		method:  http.MethodPost,
+		path:    "/api/shorten/batch",
+		body:    batch,
+		headers: map[string][]string{"Content-Type": {"application/json"}, "X-Forwarded-For": {"203.0.113.1"}},
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"), "every link of the batch counts")
+
+	resp = shorten("203.0.113.1", "", "http://example.com/4")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+
+	t.Run("other ip", func(t *testing.T) {
+		resp := shorten("203.0.113.2", "", "http://example.com/5")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("forwarded through untrusted hop", func(t *testing.T) {
+		resp := shorten("203.0.113.3, 203.0.113.1", "", "http://example.com/6")
+		resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "only the last hop is trusted")
+	})
+
+	t.Run("user across ips", func(t *testing.T) {
+		userToken := genUserTokenByID(42)
+		for i, code := range []int{http.StatusCreated, http.StatusCreated, http.StatusCreated, http.StatusTooManyRequests} {
+			resp := shorten(fmt.Sprintf("198.51.100.%d", i), userToken, fmt.Sprintf("http://example.com/user/%d", i))
+			resp.Body.Close()
+			assert.Equal(t, code, resp.StatusCode)
+		}
+	})
+
+	t.Run("batch over burst", func(t *testing.T) {
+		resp := testRequest(testRequestArgs{
+			t:      t,
+			ts:     ts,
+			method: http.MethodPost,
+			path:   "/api/shorten/batch",
+			body: `[
+				{"correlation_id": "1", "original_url": "http://example.com/b1"},
+				{"correlation_id": "2", "original_url": "http://example.com/b2"},
+				{"correlation_id": "3", "original_url": "http://example.com/b3"},
+				{"correlation_id": "4", "original_url": "http://example.com/b4"}
+			]`,
+			headers: map[string][]string{"Content-Type": {"application/json"}, "X-Forwarded-For": {"192.0.2.10"}},
+		})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("redirects are limited separately", func(t *testing.T) {
+		for _, code := range []int{http.StatusTemporaryRedirect, http.StatusTemporaryRedirect, http.StatusTooManyRequests} {
+			resp := testRequest(testRequestArgs{
+				t:       t,
+				ts:      ts,
+				method:  http.MethodGet,
+				path:    "/" + app.GenShort("http://example.com/1"),
+				headers: map[string][]string{"X-Forwarded-For": {"203.0.113.1"}},
+			})
+			resp.Body.Close()
+			assert.Equal(t, code, resp.StatusCode)
+		}
+	})
+}
+
+func TestAbuseReports(t *testing.T) {
+	const adminToken = "admin-secret"
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+		adminToken:    adminToken,
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	userToken := genUserTokenByID(genUserID())
+	longURL := "http://malware.example.com/"
+	short := app.GenShort(longURL)
+	resp := testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodPost, path: "/", body: longURL, userToken: userToken})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodPost, path: "/api/report/" + short, body: `{"reason": "serves malware"}`})
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodPost, path: "/api/report/unknown"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	admin := func(method string, path string, body string, token string) *http.Response {
+		return testRequest(testRequestArgs{
+			t:       t,
+			ts:      ts,
+			method:  method,
+			path:    "/api/admin" + path,
+			body:    body,
+			headers: map[string][]string{"Authorization": {"Bearer " + token}},
+		})
+	}
+	openReports := func() []AbuseReportJSON {
+		resp := admin(http.MethodGet, "/reports", "", adminToken)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		reports := []AbuseReportJSON{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&reports))
+		return reports
+	}
+	userURLs := func() UserURLsResponseStruct {
+		resp := testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/api/user/urls", userToken: userToken})
+		defer resp.Body.Close()
+		urls := []UserURLsResponseStruct{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&urls))
+		require.Len(t, urls, 1)
+		return urls[0]
+	}
+	redirect := func() *http.Response {
+		return testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/" + short})
+	}
+
+	resp = admin(http.MethodGet, "/reports", "", "wrong")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	reports := openReports()
+	require.Len(t, reports, 1)
+	assert.Equal(t, short, reports[0].Short)
+	assert.Equal(t, "serves malware", reports[0].Reason)
+	assert.Equal(t, longURL, reports[0].LongURL)
+
+	resp = admin(http.MethodPost, "/urls/"+short+"/disable", `{"status": 302, "reason": "malware"}`, adminToken)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = admin(http.MethodPost, "/urls/"+short+"/disable", `{"status": 451, "reason": "malware"}`, adminToken)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, openReports())
+
+	resp = redirect()
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnavailableForLegalReasons, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Location"))
+	assert.Contains(t, string(body), "malware")
+	status := userURLs()
+	assert.Equal(t, linkStatusDisabled, status.Status)
+	assert.Equal(t, "malware", status.TakedownReason)
+
+	resp = admin(http.MethodPost, "/urls/"+short+"/enable", "", adminToken)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = redirect()
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, linkStatusActive, userURLs().Status)
+
+	resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodPost, path: "/api/report/" + short})
+	resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	resp = admin(http.MethodPost, "/urls/"+short+"/dismiss", "", adminToken)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, openReports())
+}
+
+func TestPreviewPage(t *testing.T) {
+	const adminToken = "admin-secret"
+	blocklistFile := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("blocked.example.com\n"), 0644))
+	domainFilter := &app.DomainFilter{BlocklistFile: blocklistFile}
+	require.NoError(t, domainFilter.Reload())
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+		adminToken:    adminToken,
+		domainFilter:  domainFilter,
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	userID := genUserID()
+	userToken := genUserTokenByID(userID)
+	longURL := "http://example.com/article"
+	short := app.GenShort(longURL)
+	resp := testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodPost,
+		path:      "/api/shorten",
+		body:      `{"url": "` + longURL + `", "title": "An <article>"}`,
+		headers:   map[string][]string{"Content-Type": {"application/json"}},
+		userToken: userToken,
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	for _, path := range []string{"/" + short + "+", "/" + short + "/preview"} {
+		t.Run(path, func(t *testing.T) {
+			resp := testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: path})
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+			assert.Contains(t, string(body), longURL)
+			assert.Contains(t, string(body), "An &lt;article&gt;")
+			assert.Contains(t, string(body), time.Now().UTC().Format("02 Jan 2006"))
+		})
+	}
+	resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/unknown+"})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// links saved before their destination was blocked or before they start
+	activeFrom := time.Now().Add(time.Hour)
+	hidden := map[string]struct {
+		longURL string
+		opts    app.LinkOptions
+		code    int
+	}{
+		"blocked":     {longURL: "http://blocked.example.com/page", code: http.StatusForbidden},
+		"not started": {longURL: "http://example.com/later", opts: app.LinkOptions{ActiveFrom: &activeFrom}, code: http.StatusForbidden},
+	}
+	for name, link := range hidden {
+		t.Run(name, func(t *testing.T) {
+			short := app.GenShort(link.longURL)
+			require.NoError(t, handler.storage.SaveLink(context.Background(), short, link.longURL, userID, link.opts))
+			resp := testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/" + short + "+"})
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			assert.Equal(t, link.code, resp.StatusCode)
+			assert.NotContains(t, string(body), link.longURL)
+		})
+	}
+
+	resp = testRequest(testRequestArgs{
+		t:       t,
+		ts:      ts,
+		method:  http.MethodPut,
+		path:    fmt.Sprintf("/api/admin/users/%d/trust", userID),
+		body:    `{"untrusted": true}`,
+		headers: map[string][]string{"Authorization": {"Bearer " + adminToken}},
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/" + short})
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "links of untrusted users show the interstitial")
+	assert.Contains(t, string(body), `name="confirm"`)
+
+	resp = testRequest(testRequestArgs{
+		t:       t,
+		ts:      ts,
+		method:  http.MethodPost,
+		path:    "/" + short,
+		body:    "confirm=1",
+		headers: map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}},
+	})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, longURL, resp.Header.Get("Location"))
+
+	newURL := "http://example.com/new"
+	resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodPost, path: "/", body: newURL, userToken: userToken})
+	resp.Body.Close()
+	resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/" + app.GenShort(newURL)})
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "new links of untrusted users too")
+}
+
+func TestQRCode(t *testing.T) {
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	longURL := "http://example.com/poster"
+	resp := testRequest(testRequestArgs{
+		t:       t,
+		ts:      ts,
+		method:  http.MethodPost,
+		path:    "/api/shorten?qr=png&size=128",
+		body:    `{"url": "` + longURL + `"}`,
+		headers: map[string][]string{"Content-Type": {"application/json"}},
+	})
+	respJSON := ShortenHandlerJSONResponse{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&respJSON))
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.True(t, strings.HasPrefix(respJSON.QR, "data:image/png;base64,"))
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(respJSON.QR, "data:image/png;base64,"))
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 128, img.Bounds().Dx())
+
+	short := app.GenShort(longURL)
+	get := func(path string) (*http.Response, []byte) {
+		resp := testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: path})
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, body
+	}
+
+	resp, body := get("/" + short + "/qr.png?size=300&margin=2")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	img, err = png.Decode(bytes.NewReader(body))
+	require.NoError(t, err)
+	assert.Equal(t, 300, img.Bounds().Dx())
+	isDark := func(x, y int) bool {
+		r, _, _, _ := img.At(x, y).RGBA()
+		return r == 0
+	}
+	assert.False(t, isDark(0, 0), "quiet zone")
+	// the url fits a version 4 code at level M, 33 modules wide, 37 with the margin
+	scale := 300 / 37
+	offset := (300 - 37*scale) / 2
+	assert.False(t, isDark(offset+2*scale-1, offset+2*scale-1), "margin")
+	assert.True(t, isDark(offset+2*scale, offset+2*scale), "corner of the finder pattern")
+
+	resp, body = get("/" + short + "/qr.svg?level=L&margin=0")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/svg+xml", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), `viewBox="0 0 33 33"`)
+	_, body = get("/" + short + "/qr.svg?level=H&margin=0")
+	assert.Contains(t, string(body), `viewBox="0 0 41 41"`, "higher levels need more modules")
+
+	for _, path := range []string{
+		"/" + short + "/qr.png?level=X",
+		"/" + short + "/qr.png?size=10",
+		"/" + short + "/qr.svg?margin=-1",
+	} {
+		resp, _ := get(path)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+	}
+	resp, _ = get("/unknown/qr.png")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAPIErrors(t *testing.T) {
+	blocklistFile := filepath.Join(t.TempDir(), "blocklist.txt")
+	require.NoError(t, os.WriteFile(blocklistFile, []byte("evil.com\n"), 0644))
+	domainFilter := &app.DomainFilter{BlocklistFile: blocklistFile}
+	require.NoError(t, domainFilter.Reload())
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+		domainFilter:  domainFilter,
+		adminToken:    "admin-secret",
+		createLimit:   app.RateLimit{Rate: 1.0 / 60, Burst: 2},
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	jsonHeaders := map[string][]string{"Content-Type": {"application/json"}}
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		headers map[string][]string
+		code    int
+		errCode string
+		details map[string]interface{}
+	}{
+		{
+			name:    "bad content type",
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			body:    `{"url": "http://example.com"}`,
+			code:    http.StatusBadRequest,
+			errCode: errCodeInvalidContentType,
+			details: map[string]interface{}{"expected": "application/json"},
+		},
+		{
+			name:    "broken json",
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			body:    `{"url": `,
+			headers: jsonHeaders,
+			code:    http.StatusBadRequest,
+			errCode: errCodeInvalidJSON,
+		},
+		{
+			name:    "invalid url",
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			body:    `{"url": "not an url"}`,
+			headers: jsonHeaders,
+			code:    http.StatusBadRequest,
+			errCode: errCodeInvalidURL,
+			details: map[string]interface{}{"field": "url", "reason": "can't parse url"},
+		},
+		{
+			name:    "blocked domain",
+			method:  http.MethodPost,
+			path:    "/api/shorten/batch",
+			body:    `[{"correlation_id": "1", "original_url": "http://evil.com/"}]`,
+			headers: jsonHeaders,
+			code:    http.StatusBadRequest,
+			errCode: errCodeBlockedDomain,
+			details: map[string]interface{}{"field": "[0].original_url", "host": "evil.com"},
+		},
+		{
+			name:    "invalid field",
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			body:    `{"url": "http://example.com", "max_clicks": -1}`,
+			headers: jsonHeaders,
+			code:    http.StatusBadRequest,
+			errCode: errCodeInvalidField,
+			details: map[string]interface{}{"field": "max_clicks"},
+		},
+		{
+			name:    "invalid rule",
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			body:    `{"url": "http://example.com", "rules": [{"device": "ios", "url": "http://example.com/ios"}, {"url": "http://example.com/any"}]}`,
+			headers: jsonHeaders,
+			code:    http.StatusBadRequest,
+			errCode: errCodeInvalidField,
+			details: map[string]interface{}{"field": "rules[1]"},
+		},
+		{
+			name:    "invalid query parameter",
+			method:  http.MethodPost,
+			path:    "/api/shorten?qr=gif",
+			body:    `{"url": "http://example.com"}`,
+			headers: jsonHeaders,
+			code:    http.StatusBadRequest,
+			errCode: errCodeInvalidParameter,
+		},
+		{
+			name:    "not gzip",
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			body:    `{"url": "http://example.com"}`,
+			headers: map[string][]string{"Content-Type": {"application/json"}, "Content-Encoding": {"gzip"}},
+			code:    http.StatusBadRequest,
+			errCode: errCodeInvalidEncoding,
+		},
+		{
+			name:    "batch over the burst",
+			method:  http.MethodPost,
+			path:    "/api/shorten/batch",
+			body:    `[{"correlation_id": "1", "original_url": "http://example.com/1"}, {"correlation_id": "2", "original_url": "http://example.com/2"}, {"correlation_id": "3", "original_url": "http://example.com/3"}]`,
+			headers: jsonHeaders,
+			code:    http.StatusRequestEntityTooLarge,
+			errCode: errCodeRequestTooLarge,
+			details: map[string]interface{}{"limit": float64(2)},
+		},
+		{
+			name:    "unknown link",
+			method:  http.MethodGet,
+			path:    "/api/user/urls/unknown/rules",
+			code:    http.StatusNotFound,
+			errCode: errCodeNotFound,
+		},
+		{
+			name:    "unknown endpoint",
+			method:  http.MethodGet,
+			path:    "/api/unknown",
+			code:    http.StatusNotFound,
+			errCode: errCodeNotFound,
+		},
+		{
+			name:    "method not allowed",
+			method:  http.MethodPut,
+			path:    "/api/shorten",
+			code:    http.StatusMethodNotAllowed,
+			errCode: errCodeMethodNotAllowed,
+		},
+		{
+			name:    "no admin token",
+			method:  http.MethodGet,
+			path:    "/api/admin/reports",
+			code:    http.StatusUnauthorized,
+			errCode: errCodeUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testRequest(testRequestArgs{
+				t:       t,
+				ts:      ts,
+				method:  tt.method,
+				path:    tt.path,
+				body:    tt.body,
+				headers: tt.headers,
+			})
+			defer resp.Body.Close()
+			assert.Equal(t, tt.code, resp.StatusCode)
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			response := ErrorJSONResponse{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+			assert.Equal(t, tt.errCode, response.Error.Code)
+			assert.NotEmpty(t, response.Error.Message)
+			assert.Equal(t, tt.details, response.Error.Details)
+		})
+	}
+
+	t.Run("rate limited", func(t *testing.T) {
+		limitedHandler := Handler{
+			storage:       handler.storage,
+			baseServerURL: defaultBaseURL,
+			rateLimiter:   &app.MemoryRateLimiter{},
+			createLimit:   handler.createLimit,
+		}
+		ts := httptest.NewServer(middlewareConveyor(NewRouter(&limitedHandler), gzipHandle, userTokenCookieHandle))
+		defer ts.Close()
+		var resp *http.Response
+		for i := 0; i < 2; i++ {
+			resp = testRequest(testRequestArgs{
+				t:       t,
+				ts:      ts,
+				method:  http.MethodPost,
+				path:    "/api/shorten",
+				body:    fmt.Sprintf(`{"url": "http://example.com/limited/%d"}`, i),
+				headers: jsonHeaders,
+			})
+			resp.Body.Close()
+		}
+		resp = testRequest(testRequestArgs{
+			t:       t,
+			ts:      ts,
+			method:  http.MethodPost,
+			path:    "/api/shorten",
+			body:    `{"url": "http://example.com/limited"}`,
+			headers: jsonHeaders,
+		})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+		response := ErrorJSONResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		assert.Equal(t, errCodeRateLimited, response.Error.Code)
+		assert.Equal(t, resp.Header.Get("Retry-After"), fmt.Sprint(response.Error.Details["retry_after"]))
+	})
+
+	t.Run("plain endpoint keeps text errors", func(t *testing.T) {
+		resp := testRequest(testRequestArgs{
+			t:       t,
+			ts:      ts,
+			method:  http.MethodPost,
+			path:    "/",
+			body:    "http://example.com",
+			headers: map[string][]string{"Content-Encoding": {"gzip"}},
+		})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+
+		resp = testRequest(testRequestArgs{
+			t:      t,
+			ts:     ts,
+			method: http.MethodGet,
+			path:   "/unknown",
+		})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	})
+
+	t.Run("panics", func(t *testing.T) {
+		r := NewRouter(&Handler{})
+		r.Get("/api/panic", func(w http.ResponseWriter, r *http.Request) {
+			panic("storage is down")
+		})
+		ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+		defer ts.Close()
+		resp := testRequest(testRequestArgs{
+			t:      t,
+			ts:     ts,
+			method: http.MethodGet,
+			path:   "/api/panic",
+		})
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		response := ErrorJSONResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		assert.Equal(t, errCodeInternal, response.Error.Code)
+	})
+}
+
+func TestImportUserURLs(t *testing.T) {
+	tests := []struct {
+		name    string
+		storage app.Storage
+	}{
+		{
+			name: "struct storage",
+			storage: &app.StructStorage{
+				ShortToLong:   make(map[string]string),
+				UserIDToShort: make(map[uint32][]string),
+			},
+		},
+		{
+			name:    "json file storage",
+			storage: &app.JSONFileStorage{Filename: filepath.Join(t.TempDir(), "urls.json")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Handler{
+				storage:       tt.storage,
+				baseServerURL: defaultBaseURL,
+			}
+			r := NewRouter(&handler)
+			ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+			defer ts.Close()
+
+			userToken := genUserTokenByID(genUserID())
+			existingURL := "http://example.com/existing"
+			resp := testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodPost, path: "/", body: existingURL, userToken: userToken})
+			resp.Body.Close()
+			require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+			importFile := func(contentType string, body string) (int, ImportJSONResponse, ErrorJSONResponse) {
+				resp := testRequest(testRequestArgs{
+					t:         t,
+					ts:        ts,
+					method:    http.MethodPost,
+					path:      "/api/user/import",
+					body:      body,
+					headers:   map[string][]string{"Content-Type": {contentType}},
+					userToken: userToken,
+				})
+				defer resp.Body.Close()
+				result := ImportJSONResponse{}
+				errResp := ErrorJSONResponse{}
+				if resp.StatusCode == http.StatusOK {
+					require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+				} else {
+					require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+				}
+				return resp.StatusCode, result, errResp
+			}
+			rowErrors := func(result ImportJSONResponse) map[int]string {
+				codes := make(map[int]string)
+				for _, rowErr := range result.Errors {
+					codes[rowErr.Line] = rowErr.Code
+				}
+				return codes
+			}
+
+			status, result, _ := importFile("text/csv; charset=utf-8", strings.Join([]string{
+				"\ufeffShort,original_url,created_at,title,campaign",
+				"promo,http://example.com/promo,2020-01-02T03:04:05+01:00,Promo,spring",
+				",http://example.com/generated,,,",
+				"bad code,http://example.com/bad,,,",
+				"api,http://example.com/reserved,,,",
+				"promo,http://example.com/other,,,",
+				"taken,http://example.com/existing,,,",
+				"dated,http://example.com/dated,yesterday,,",
+				"short,not an url,,,",
+				"too,few",
+				`"unterminated,http://example.com/quote`,
+			}, "\n"))
+			require.Equal(t, http.StatusOK, status)
+			assert.Equal(t, 2, result.Imported)
+			assert.Equal(t, 8, result.Failed)
+			assert.Equal(t, map[int]string{
+				4:  errCodeInvalidField,
+				5:  errCodeInvalidField,
+				6:  errCodeDuplicate,
+				7:  errCodeDuplicate,
+				8:  errCodeInvalidField,
+				9:  errCodeInvalidURL,
+				10: errCodeInvalidRow,
+				11: errCodeInvalidRow,
+			}, rowErrors(result))
+
+			opts, err := tt.storage.GetLinkOptions(context.Background(), "promo")
+			require.NoError(t, err)
+			assert.Equal(t, "Promo", opts.Title)
+			assert.Equal(t, map[string]string{"campaign": "spring"}, opts.Metadata)
+			require.NotNil(t, opts.CreatedAt)
+			assert.Equal(t, time.Date(2020, 1, 2, 2, 4, 5, 0, time.UTC), *opts.CreatedAt)
+
+			resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/promo"})
+			resp.Body.Close()
+			assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+			assert.Equal(t, "http://example.com/promo", resp.Header.Get("Location"))
+
+			status, result, _ = importFile("application/x-ndjson", strings.Join([]string{
+				`{"short": "jsonl", "original_url": "http://example.com/jsonl", "metadata": {"team": "docs"}}`,
+				``,
+				`{"original_url": "http://example.com/jsonl/generated"}`,
+				`{"original_url": 1}`,
+				`{"short": "0123456789abcdef0123456789abcdef", "original_url": "http://example.com/lookalike"}`,
+			}, "\n"))
+			require.Equal(t, http.StatusOK, status)
+			assert.Equal(t, 2, result.Imported)
+			assert.Equal(t, map[int]string{4: errCodeInvalidRow, 5: errCodeInvalidField}, rowErrors(result))
+
+			resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/api/user/urls", userToken: userToken})
+			urls := []UserURLsResponseStruct{}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&urls))
+			resp.Body.Close()
+			originalURLs := make(map[string]string)
+			for _, u := range urls {
+				originalURLs[u.ShortURL] = u.LongURL
+			}
+			assert.Equal(t, map[string]string{
+				defaultBaseURL + "/" + app.GenShort(existingURL):                          existingURL,
+				defaultBaseURL + "/promo":                                                 "http://example.com/promo",
+				defaultBaseURL + "/" + app.GenShort("http://example.com/generated"):       "http://example.com/generated",
+				defaultBaseURL + "/jsonl":                                                 "http://example.com/jsonl",
+				defaultBaseURL + "/" + app.GenShort("http://example.com/jsonl/generated"): "http://example.com/jsonl/generated",
+			}, originalURLs)
+
+			status, _, errResp := importFile("text/csv", "short,url\npromo,http://example.com/promo\n")
+			assert.Equal(t, http.StatusBadRequest, status)
+			assert.Equal(t, errCodeInvalidImport, errResp.Error.Code)
+			status, _, errResp = importFile("application/json", "[]")
+			assert.Equal(t, http.StatusBadRequest, status)
+			assert.Equal(t, errCodeInvalidContentType, errResp.Error.Code)
+		})
+	}
+}
+
+func TestImportRateLimit(t *testing.T) {
+	storage := &app.StructStorage{
+		ShortToLong:   make(map[string]string),
+		UserIDToShort: make(map[uint32][]string),
+	}
+	handler := Handler{
+		storage:       storage,
+		baseServerURL: defaultBaseURL,
+		rateLimiter:   &app.MemoryRateLimiter{},
+		createLimit:   app.RateLimit{Rate: 1.0 / 60, Burst: 3},
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	userID := genUserID()
+	rows := make([]string, 0, 5)
+	for i := 0; i < 5; i++ {
+		rows = append(rows, fmt.Sprintf(`{"original_url": "http://example.com/import/limited/%d"}`, i))
+	}
+	resp := testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodPost,
+		path:      "/api/user/import",
+		body:      strings.Join(rows, "\n"),
+		headers:   map[string][]string{"Content-Type": {"application/x-ndjson"}},
+		userToken: genUserTokenByID(userID),
+	})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "every row takes a token")
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	errResp := ErrorJSONResponse{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&errResp))
+	assert.Equal(t, errCodeRateLimited, errResp.Error.Code)
+	assert.Equal(t, float64(3), errResp.Error.Details["imported"], "the chunks within the limit are saved")
+	assert.Len(t, storage.GetURLsByUserID(context.Background(), userID), 3)
+}
+
+func TestImportDoesNotSlowDownPerChunk(t *testing.T) {
+	const chunks = 30
+	storages := map[string]app.Storage{
+		"struct": &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		"json": &app.JSONFileStorage{Filename: filepath.Join(t.TempDir(), "urls.json")},
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			userID := genUserID()
+			importer, err := storage.NewImport(ctx, userID)
+			require.NoError(t, err)
+			durations := make([]time.Duration, 0, chunks)
+			for chunk := 0; chunk < chunks; chunk++ {
+				links := make([]app.ImportedLink, 0, importChunkSize)
+				for i := 0; i < importChunkSize; i++ {
+					n := chunk*importChunkSize + i
+					links = append(links, app.ImportedLink{
+						Short:   fmt.Sprintf("bulk%d", n),
+						LongURL: fmt.Sprintf("http://example.com/bulk/%d", n),
+					})
+				}
+				start := time.Now()
+				skipped, err := importer.Add(ctx, links)
+				durations = append(durations, time.Since(start))
+				require.NoError(t, err)
+				require.Empty(t, skipped)
+			}
+			clashed, err := importer.Commit(ctx)
+			require.NoError(t, err)
+			require.Empty(t, clashed)
+			assert.Len(t, storage.GetURLsByUserID(ctx, userID), chunks*importChunkSize)
+
+			var first, last time.Duration
+			for i := 0; i < 5; i++ {
+				first += durations[i]
+				last += durations[chunks-1-i]
+			}
+			assert.Less(t, int64(last), int64(4*first+50*time.Millisecond),
+				"the last chunks take %v, the first ones %v", last, first)
+		})
+	}
+}
+
+func TestExportUserURLs(t *testing.T) {
+	storage := &app.StructStorage{
+		ShortToLong:   make(map[string]string),
+		UserIDToShort: make(map[uint32][]string),
+	}
+	handler := Handler{
+		storage:       storage,
+		baseServerURL: defaultBaseURL,
+	}
+	r := NewRouter(&handler)
+	ts := httptest.NewServer(middlewareConveyor(r, gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	userToken := genUserTokenByID(genUserID())
+	rows := []string{"short,original_url,created_at,title,campaign"}
+	rows = append(rows, "promo,http://example.com/promo,2020-01-02T03:04:05Z,Promo,spring")
+	rows = append(rows, "deleted,http://example.com/deleted,,,")
+	for i := 0; i < 2*exportFlushLinks; i++ {
+		rows = append(rows, fmt.Sprintf(",http://example.com/%d,,,", i))
+	}
+	resp := testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodPost,
+		path:      "/api/user/import",
+		body:      strings.Join(rows, "\n"),
+		headers:   map[string][]string{"Content-Type": {"text/csv"}},
+		userToken: userToken,
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/promo"})
+	resp.Body.Close()
+	require.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	resp = testRequest(testRequestArgs{
+		t:         t,
+		ts:        ts,
+		method:    http.MethodDelete,
+		path:      "/api/user/urls",
+		body:      `["deleted"]`,
+		headers:   map[string][]string{"Content-Type": {"application/json"}},
+		userToken: userToken,
+	})
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	export := func(format string, userToken string) (*http.Response, []byte) {
+		resp := testRequest(testRequestArgs{
+			t:         t,
+			ts:        ts,
+			method:    http.MethodGet,
+			path:      "/api/user/urls/export?format=" + format,
+			headers:   map[string][]string{"Accept-Encoding": {"gzip"}},
+			userToken: userToken,
+		})
+		defer resp.Body.Close()
+		var body io.Reader = resp.Body
+		if resp.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(resp.Body)
+			require.NoError(t, err)
+			body = gz
+		}
+		data, err := io.ReadAll(body)
+		require.NoError(t, err)
+		return resp, data
+	}
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	promo := ExportedURLJSON{
+		Short:       "promo",
+		ShortURL:    defaultBaseURL + "/promo",
+		OriginalURL: "http://example.com/promo",
+		Status:      linkStatusActive,
+		CreatedAt:   &createdAt,
+		Title:       "Promo",
+		Metadata:    map[string]string{"campaign": "spring"},
+		Clicks:      app.ClickStats{Total: 1},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		resp, data := export("json", userToken)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+		assert.Equal(t, `attachment; filename="links.json"`, resp.Header.Get("Content-Disposition"))
+		links := []ExportedURLJSON{}
+		require.NoError(t, json.Unmarshal(data, &links))
+		require.Len(t, links, 1+2*exportFlushLinks)
+		assert.Equal(t, promo, links[0])
+		assert.Equal(t, "http://example.com/0", links[1].OriginalURL)
+		assert.Equal(t, app.GenShort("http://example.com/0"), links[1].Short)
+	})
+
+	t.Run("jsonl", func(t *testing.T) {
+		resp, data := export("jsonl", userToken)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		require.Len(t, lines, 1+2*exportFlushLinks)
+		link := ExportedURLJSON{}
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &link))
+		assert.Equal(t, promo, link)
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		resp, data := export("csv", userToken)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+		lines := strings.Split(string(data), "\n")
+		assert.Equal(t, "short,short_url,original_url,created_at,title,status,takedown_reason,clicks,metadata", lines[0])
+		assert.Equal(t, `promo,`+defaultBaseURL+`/promo,http://example.com/promo,2020-01-02T03:04:05Z,Promo,active,,1,"{""campaign"":""spring""}"`, lines[1])
+
+		// the export is imported into another shortener as it is
+		restored := &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		}
+		restoreTS := httptest.NewServer(middlewareConveyor(NewRouter(&Handler{storage: restored, baseServerURL: defaultBaseURL}), gzipHandle, userTokenCookieHandle))
+		defer restoreTS.Close()
+		resp = testRequest(testRequestArgs{
+			t:         t,
+			ts:        restoreTS,
+			method:    http.MethodPost,
+			path:      "/api/user/import",
+			body:      string(data),
+			headers:   map[string][]string{"Content-Type": {"text/csv"}},
+			userToken: userToken,
+		})
+		result := ImportJSONResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		resp.Body.Close()
+		assert.Equal(t, 1+2*exportFlushLinks, result.Imported)
+		assert.Empty(t, result.Errors)
+		opts, err := restored.GetLinkOptions(context.Background(), "promo")
+		require.NoError(t, err)
+		assert.Equal(t, promo.Title, opts.Title)
+		assert.Equal(t, promo.Metadata, opts.Metadata)
+		assert.Equal(t, promo.CreatedAt, opts.CreatedAt)
+	})
+
+	t.Run("no links", func(t *testing.T) {
+		resp, data := export("", genUserTokenByID(genUserID()))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "[]\n", string(data))
+		resp, data = export("csv", genUserTokenByID(genUserID()))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, strings.Join(exportCSVHeader, ",")+"\n", string(data))
+	})
+
+	t.Run("unknown format", func(t *testing.T) {
+		resp, _ := export("xml", userToken)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+}
+
+func TestShortenBatchNDJSON(t *testing.T) {
+	type batchLine struct {
+		ShortenBatchNDJSONResponse
+		// set on the line ending a batch cut short
+		End bool
+	}
+	newServer := func(handler *Handler) *httptest.Server {
+		handler.storage = &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		}
+		handler.baseServerURL = defaultBaseURL
+		return httptest.NewServer(middlewareConveyor(NewRouter(handler), gzipHandle, userTokenCookieHandle))
+	}
+	batch := func(ts *httptest.Server, body string) (*http.Response, []batchLine) {
+		resp := testRequest(testRequestArgs{
+			t:       t,
+			ts:      ts,
+			method:  http.MethodPost,
+			path:    "/api/shorten/batch",
+			body:    body,
+			headers: map[string][]string{"Content-Type": {"application/x-ndjson"}},
+		})
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp, nil
+		}
+		lines := []batchLine{}
+		decoder := json.NewDecoder(resp.Body)
+		for decoder.More() {
+			raw := map[string]json.RawMessage{}
+			require.NoError(t, decoder.Decode(&raw))
+			line := batchLine{}
+			_, line.End = raw["error"]
+			if _, hasID := raw["correlation_id"]; hasID {
+				line.End = false
+			}
+			data, _ := json.Marshal(raw)
+			require.NoError(t, json.Unmarshal(data, &line.ShortenBatchNDJSONResponse))
+			lines = append(lines, line)
+		}
+		return resp, lines
+	}
+	items := func(from int, to int) string {
+		var body strings.Builder
+		for i := from; i < to; i++ {
+			fmt.Fprintf(&body, `{"correlation_id": "%d", "original_url": "http://example.com/%d"}`+"\n", i, i)
+		}
+		return body.String()
+	}
+
+	t.Run("chunks keep the order", func(t *testing.T) {
+		handler := &Handler{}
+		ts := newServer(handler)
+		defer ts.Close()
+		_, err := handler.storage.ImportLinks(context.Background(), []app.ImportedLink{{Short: "custom", LongURL: "http://example.com/custom"}}, 1)
+		require.NoError(t, err)
+
+		body := items(0, 2*batchChunkSize) +
+			"\n" +
+			`{"correlation_id": "bad", "original_url": "not an url"}` + "\n" +
+			`{"correlation_id": "again", "original_url": "http://example.com/0"}` + "\n" +
+			`{"correlation_id": "custom", "original_url": "http://example.com/custom"}`
+		resp, lines := batch(ts, body)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+		require.Len(t, lines, 2*batchChunkSize+3)
+		for i := 0; i < 2*batchChunkSize; i++ {
+			longURL := fmt.Sprintf("http://example.com/%d", i)
+			assert.Equal(t, ShortenBatchNDJSONResponse{CorrelationID: strconv.Itoa(i), ShortURL: defaultBaseURL + "/" + app.GenShort(longURL)}, lines[i].ShortenBatchNDJSONResponse)
+		}
+		bad := lines[2*batchChunkSize]
+		assert.Equal(t, "bad", bad.CorrelationID)
+		require.NotNil(t, bad.Error)
+		assert.Equal(t, errCodeInvalidURL, bad.Error.Code)
+		assert.Empty(t, bad.ShortURL)
+		assert.Equal(t, ShortenBatchNDJSONResponse{CorrelationID: "again", ShortURL: lines[0].ShortURL, Existed: true}, lines[2*batchChunkSize+1].ShortenBatchNDJSONResponse)
+		custom := lines[2*batchChunkSize+2]
+		require.NotNil(t, custom.Error)
+		assert.Equal(t, errCodeDuplicate, custom.Error.Code)
+	})
+
+	t.Run("invalid line ends the batch", func(t *testing.T) {
+		ts := newServer(&Handler{})
+		defer ts.Close()
+		resp, _ := batch(ts, "{\n")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp, lines := batch(ts, items(0, batchChunkSize)+"{\n"+items(batchChunkSize, batchChunkSize+1))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, lines, batchChunkSize+1)
+		last := lines[batchChunkSize]
+		assert.True(t, last.End)
+		assert.Equal(t, errCodeInvalidJSON, last.Error.Code)
+	})
+
+	t.Run("max batch size", func(t *testing.T) {
+		ts := newServer(&Handler{maxBatchSize: batchChunkSize + 10})
+		defer ts.Close()
+		resp, lines := batch(ts, items(0, batchChunkSize+10))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, lines, batchChunkSize+10)
+
+		resp, lines = batch(ts, items(0, batchChunkSize+11))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, lines, batchChunkSize+1)
+		assert.True(t, lines[batchChunkSize].End)
+		assert.Equal(t, errCodeRequestTooLarge, lines[batchChunkSize].Error.Code)
+
+		small := newServer(&Handler{maxBatchSize: 2})
+		defer small.Close()
+		resp, _ = batch(small, items(0, 3))
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+		requestBody, _ := json.Marshal(ShortenBatchHandlerJSONRequest{
+			{CorrelationID: "1", OrginalURL: "http://example.com/1"},
+			{CorrelationID: "2", OrginalURL: "http://example.com/2"},
+			{CorrelationID: "3", OrginalURL: "http://example.com/3"},
+		})
+		resp = testRequest(testRequestArgs{
+			t:       t,
+			ts:      small,
+			method:  http.MethodPost,
+			path:    "/api/shorten/batch",
+			body:    string(requestBody),
+			headers: map[string][]string{"Content-Type": {"application/json"}},
+		})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+		ts := newServer(&Handler{
+			rateLimiter: &app.MemoryRateLimiter{},
+			createLimit: app.RateLimit{Rate: 1.0 / 60, Burst: batchChunkSize + batchChunkSize/2},
+		})
+		defer ts.Close()
+		resp, lines := batch(ts, items(0, 2*batchChunkSize))
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, lines, batchChunkSize+1)
+		last := lines[batchChunkSize]
+		assert.True(t, last.End)
+		assert.Equal(t, errCodeRateLimited, last.Error.Code)
+
+		resp, _ = batch(ts, items(0, batchChunkSize))
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	})
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	userToken := genUserTokenByID(genUserID())
+	idempotency := &app.MemoryIdempotencyStore{}
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL:  defaultBaseURL,
+		idempotency:    idempotency,
+		idempotencyTTL: time.Hour,
+	}
+	ts := httptest.NewServer(middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+
+	type result struct {
+		code     int
+		body     string
+		replayed bool
+	}
+	send := func(path string, contentType string, body string, key string, userToken string) result {
+		headers := map[string][]string{"Content-Type": {contentType}}
+		if len(key) > 0 {
+			headers[idempotencyKeyHeader] = []string{key}
+		}
+		resp := testRequest(testRequestArgs{
+			t:         t,
+			ts:        ts,
+			method:    http.MethodPost,
+			path:      path,
+			body:      body,
+			headers:   headers,
+			userToken: userToken,
+		})
+		defer resp.Body.Close()
+		respBody, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return result{resp.StatusCode, string(respBody), resp.Header.Get(idempotencyReplayedHeader) == "true"}
+	}
+	shortURL := defaultBaseURL + "/" + app.GenShort("http://example.com/retried")
+
+	t.Run("retries are replayed", func(t *testing.T) {
+		first := send("/", "text/plain", "http://example.com/retried", "key-1", userToken)
+		assert.Equal(t, result{http.StatusCreated, shortURL, false}, first)
+		retry := send("/", "text/plain", "http://example.com/retried", "key-1", userToken)
+		assert.Equal(t, result{http.StatusCreated, shortURL, true}, retry)
+		withoutKey := send("/", "text/plain", "http://example.com/retried", "", userToken)
+		assert.Equal(t, http.StatusConflict, withoutKey.code)
+	})
+
+	t.Run("batches are replayed", func(t *testing.T) {
+		body := `[{"correlation_id": "a", "original_url": "http://example.com/batch/retried"}]`
+		first := send("/api/shorten/batch", "application/json", body, "key-2", userToken)
+		require.Equal(t, http.StatusCreated, first.code, first.body)
+		retry := send("/api/shorten/batch", "application/json", body, "key-2", userToken)
+		assert.Equal(t, result{http.StatusCreated, first.body, true}, retry)
+	})
+
+	t.Run("keys are per user", func(t *testing.T) {
+		other := send("/", "text/plain", "http://example.com/other", "key-1", genUserTokenByID(genUserID()))
+		assert.Equal(t, http.StatusCreated, other.code)
+		assert.False(t, other.replayed)
+	})
+
+	t.Run("retries without a user token are replayed", func(t *testing.T) {
+		first := send("/", "text/plain", "http://example.com/anonymous", "key-5", "")
+		require.Equal(t, http.StatusCreated, first.code, first.body)
+		retry := send("/", "text/plain", "http://example.com/anonymous", "key-5", "")
+		assert.Equal(t, result{http.StatusCreated, first.body, true}, retry)
+		other := send("/", "text/plain", "http://example.com/anonymous/other", "key-5", "")
+		assert.Equal(t, result{http.StatusCreated, defaultBaseURL + "/" + app.GenShort("http://example.com/anonymous/other"), false}, other)
+	})
+
+	t.Run("streams are not replayed", func(t *testing.T) {
+		body := `{"correlation_id": "a", "original_url": "http://example.com/stream/retried"}`
+		first := send("/api/shorten/batch", "application/x-ndjson", body, "key-6", userToken)
+		require.Equal(t, http.StatusOK, first.code, first.body)
+		retry := send("/api/shorten/batch", "application/x-ndjson", body, "key-6", userToken)
+		assert.Equal(t, http.StatusOK, retry.code)
+		assert.False(t, retry.replayed)
+		assert.Contains(t, retry.body, `"correlation_id":"a"`, "the retry is handled again")
+	})
+
+	t.Run("key reused for another request", func(t *testing.T) {
+		res := send("/api/shorten", "application/json", `{"url": "http://example.com/another"}`, "key-1", userToken)
+		assert.Equal(t, http.StatusUnprocessableEntity, res.code)
+		assert.Contains(t, res.body, errCodeIdempotencyKeyReused)
+	})
+
+	t.Run("retry while the request is handled", func(t *testing.T) {
+		storeKey := strconv.FormatUint(uint64(app.GetUserIDFromToken(userToken)), 10) + ":key-3"
+		req := httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url": "http://example.com/slow"}`))
+		req.Header.Set("Content-Type", "application/json")
+		_, reserved, err := idempotency.Reserve(context.Background(), storeKey, requestFingerprint(req, []byte(`{"url": "http://example.com/slow"}`)), time.Minute)
+		require.NoError(t, err)
+		require.True(t, reserved)
+		res := send("/api/shorten", "application/json", `{"url": "http://example.com/slow"}`, "key-3", userToken)
+		assert.Equal(t, http.StatusConflict, res.code)
+		assert.Contains(t, res.body, errCodeIdempotencyKeyInUse)
+	})
+
+	t.Run("client errors are replayed", func(t *testing.T) {
+		res := send("/api/shorten", "application/json", `{"url": `, "key-4", userToken)
+		assert.Equal(t, http.StatusBadRequest, res.code)
+		retry := send("/api/shorten", "application/json", `{"url": `, "key-4", userToken)
+		assert.Equal(t, result{http.StatusBadRequest, res.body, true}, retry)
+	})
+
+	t.Run("rate limited requests are not kept", func(t *testing.T) {
+		handler := Handler{
+			storage:        handler.storage,
+			baseServerURL:  defaultBaseURL,
+			rateLimiter:    &app.MemoryRateLimiter{},
+			createLimit:    app.RateLimit{Rate: 0.001, Burst: 1},
+			idempotency:    idempotency,
+			idempotencyTTL: time.Hour,
+		}
+		ts := httptest.NewServer(middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle))
+		defer ts.Close()
+		userToken := genUserTokenByID(genUserID())
+		for _, want := range []int{http.StatusCreated, http.StatusTooManyRequests} {
+			resp := testRequest(testRequestArgs{
+				t:         t,
+				ts:        ts,
+				method:    http.MethodPost,
+				path:      "/",
+				body:      "http://example.com/limited/" + strconv.Itoa(want),
+				headers:   map[string][]string{idempotencyKeyHeader: {"key-" + strconv.Itoa(want)}},
+				userToken: userToken,
+			})
+			resp.Body.Close()
+			require.Equal(t, want, resp.StatusCode)
+		}
+		storeKey := strconv.FormatUint(uint64(app.GetUserIDFromToken(userToken)), 10) + ":key-429"
+		_, reserved, err := idempotency.Reserve(context.Background(), storeKey, "", time.Minute)
+		require.NoError(t, err)
+		assert.True(t, reserved, "the key is free for the retry")
+	})
+}
+
+func TestLinkInfo(t *testing.T) {
+	ownerToken := genUserTokenByID(genUserID())
+	handler := Handler{
+		storage: &app.StructStorage{
+			ShortToLong:   make(map[string]string),
+			UserIDToShort: make(map[uint32][]string),
+		},
+		baseServerURL: defaultBaseURL,
+		redirectCode:  defaultRedirectCode,
+	}
+	ts := httptest.NewServer(middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle))
+	defer ts.Close()
+	ctx := context.Background()
+	ownerID := app.GetUserIDFromToken(ownerToken)
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	activeUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	passwordHash, err := app.HashPassword("secret")
+	require.NoError(t, err)
+	require.NoError(t, handler.storage.SaveLink(ctx, "limited", "http://example.com/limited", ownerID, app.LinkOptions{
+		MaxClicks:   1,
+		CreatedAt:   &createdAt,
+		ActiveUntil: &activeUntil,
+		Title:       "Limited",
+	}))
+	require.NoError(t, handler.storage.SaveLink(ctx, "protected", "http://example.com/protected", ownerID, app.LinkOptions{PasswordHash: passwordHash}))
+	require.NoError(t, handler.storage.SaveLink(ctx, "deleted", "http://example.com/deleted", ownerID, app.LinkOptions{DeletedAt: &createdAt}))
+
+	request := func(method string, path string, userToken string) *http.Response {
+		resp := testRequest(testRequestArgs{t: t, ts: ts, method: method, path: path, userToken: userToken})
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	info := func(short string, userToken string) LinkInfoJSON {
+		resp := request(http.MethodGet, "/api/urls/"+short, userToken)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		info := LinkInfoJSON{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&info))
+		return info
+	}
+
+	t.Run("HEAD doesn't count as a click", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			resp := request(http.MethodHead, "/limited", "")
+			assert.Equal(t, defaultRedirectCode, resp.StatusCode)
+			assert.Equal(t, "http://example.com/limited", resp.Header.Get("Location"))
+		}
+		resp := request(http.MethodGet, "/limited", "")
+		assert.Equal(t, defaultRedirectCode, resp.StatusCode)
+		resp = request(http.MethodGet, "/limited", "")
+		assert.Equal(t, http.StatusGone, resp.StatusCode)
+		resp = request(http.MethodHead, "/limited", "")
+		assert.Equal(t, http.StatusGone, resp.StatusCode, "HEAD answers like GET once the clicks are used up")
+		assert.Empty(t, resp.Header.Get("Location"))
+	})
+
+	t.Run("public info", func(t *testing.T) {
+		assert.Equal(t, LinkInfoJSON{
+			Short:       "limited",
+			ShortURL:    defaultBaseURL + "/limited",
+			OriginalURL: "http://example.com/limited",
+			Status:      linkStatusExhausted,
+			CreatedAt:   &createdAt,
+			Title:       "Limited",
+		}, info("limited", ""))
+		assert.Equal(t, LinkInfoJSON{
+			Short:     "protected",
+			ShortURL:  defaultBaseURL + "/protected",
+			Status:    linkStatusActive,
+			Protected: true,
+		}, info("protected", genUserTokenByID(genUserID())))
+	})
+
+	t.Run("owner info", func(t *testing.T) {
+		assert.Equal(t, LinkInfoJSON{
+			Short:       "limited",
+			ShortURL:    defaultBaseURL + "/limited",
+			OriginalURL: "http://example.com/limited",
+			Status:      linkStatusExhausted,
+			CreatedAt:   &createdAt,
+			Title:       "Limited",
+			Owner:       true,
+			ActiveUntil: &activeUntil,
+			MaxClicks:   1,
+			Clicks:      &app.ClickStats{Total: 1},
+		}, info("limited", ownerToken))
+		assert.Equal(t, "http://example.com/protected", info("protected", ownerToken).OriginalURL)
+	})
+
+	t.Run("missing links", func(t *testing.T) {
+		for _, short := range []string{"unknown", "deleted"} {
+			resp := request(http.MethodGet, "/api/urls/"+short, ownerToken)
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode, short)
+		}
+		assert.Equal(t, http.StatusNotFound, request(http.MethodHead, "/unknown", "").StatusCode)
+		assert.Equal(t, http.StatusGone, request(http.MethodHead, "/deleted", "").StatusCode)
+	})
+}
+
+func TestHealth(t *testing.T) {
+	existingFileStorage := func(t *testing.T) *app.JSONFileStorage {
+		storage := &app.JSONFileStorage{Filename: filepath.Join(t.TempDir(), "links.json")}
+		require.NoError(t, storage.SaveShort(context.Background(), "loremid", "http://example.com", genUserID()))
+		return storage
+	}
+	type want struct {
+		code   int
+		health HealthJSONResponse
+	}
+	get := func(ts *httptest.Server, path string) want {
+		resp := testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: path})
+		defer resp.Body.Close()
+		health := HealthJSONResponse{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&health))
+		return want{resp.StatusCode, health}
+	}
+	ok := map[string]ComponentHealthJSON{"storage": {Status: healthStatusOK}}
+	tests := []struct {
+		name         string
+		storage      app.Storage
+		shuttingDown bool
+		want         want
+	}{
+		{
+			name:    "memory storage",
+			storage: &app.StructStorage{ShortToLong: make(map[string]string), UserIDToShort: make(map[uint32][]string)},
+			want:    want{http.StatusOK, HealthJSONResponse{Status: healthStatusOK, Components: ok}},
+		},
+		{
+			name:    "file storage",
+			storage: &app.JSONFileStorage{Filename: filepath.Join(t.TempDir(), "links.json")},
+			want:    want{http.StatusOK, HealthJSONResponse{Status: healthStatusOK, Components: ok}},
+		},
+		{
+			name:    "existing file storage",
+			storage: existingFileStorage(t),
+			want:    want{http.StatusOK, HealthJSONResponse{Status: healthStatusOK, Components: ok}},
+		},
+		{
+			name:    "unwritable file storage",
+			storage: &app.JSONFileStorage{Filename: filepath.Join(t.TempDir(), "missing", "links.json")},
+			want:    want{http.StatusServiceUnavailable, HealthJSONResponse{Status: healthStatusUnavailable}},
+		},
+		{
+			name:         "shutting down",
+			storage:      &app.StructStorage{ShortToLong: make(map[string]string), UserIDToShort: make(map[uint32][]string)},
+			shuttingDown: true,
+			want:         want{http.StatusServiceUnavailable, HealthJSONResponse{Status: healthStatusShuttingDown, Components: ok}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Handler{storage: tt.storage}
+			if tt.shuttingDown {
+				handler.beginShutdown()
+			}
+			ts := httptest.NewServer(middlewareConveyor(NewRouter(&handler), gzipHandle, userTokenCookieHandle))
+			defer ts.Close()
+
+			assert.Equal(t, want{http.StatusOK, HealthJSONResponse{Status: healthStatusOK}}, get(ts, "/healthz"))
+			ready := get(ts, "/readyz")
+			if tt.want.health.Components == nil {
+				storage := ready.health.Components["storage"]
+				assert.Equal(t, healthStatusUnavailable, storage.Status)
+				assert.NotEmpty(t, storage.Error)
+				ready.health.Components = nil
+			}
+			assert.Equal(t, tt.want, ready)
+
+			resp := testRequest(testRequestArgs{t: t, ts: ts, method: http.MethodGet, path: "/ping"})
+			resp.Body.Close()
+			if tt.want.health.Status == healthStatusUnavailable {
+				assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+			} else {
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+			}
+		})
+	}
+
+	t.Run("missing file is left missing", func(t *testing.T) {
+		storage := &app.JSONFileStorage{Filename: filepath.Join(t.TempDir(), "links.json")}
+		require.NoError(t, storage.CheckHealth(context.Background()))
+		_, err := os.Stat(storage.Filename)
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+}
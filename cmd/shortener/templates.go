@@ -0,0 +1,91 @@
+package main
+
+import "html/template"
+
+type unlockPageData struct {
+	Error string
+}
+
+var unlockPageTemplate = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Protected link</title>
+</head>
+<body>
+<h1>This link is password protected</h1>
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<form method="POST">
+<input type="password" name="password" autofocus>
+<button type="submit">Unlock</button>
+</form>
+</body>
+</html>
+`))
+
+type notYetPageData struct {
+	Message    string
+	ActiveFrom string
+}
+
+var notYetPageTemplate = template.Must(template.New("not-yet").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Link is not available yet</title>
+</head>
+<body>
+<h1>{{if .Message}}{{.Message}}{{else}}This link is not available yet{{end}}</h1>
+<p>It becomes available at {{.ActiveFrom}}.</p>
+</body>
+</html>
+`))
+
+type takedownPageData struct {
+	Status int
+	Reason string
+}
+
+var takedownPageTemplate = template.Must(template.New("takedown").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Link disabled</title>
+</head>
+<body>
+<h1>{{if eq .Status 451}}This link is unavailable for legal reasons{{else}}This link has been disabled{{end}}</h1>
+<p>It was reported and taken down by the administrators: {{.Reason}}</p>
+</body>
+</html>
+`))
+
+type previewPageData struct {
+	ShortURL     string
+	Short        string
+	Destination  string
+	Title        string
+	CreatedAt    string
+	Protected    bool
+	MayVary      bool
+	ForcePreview bool
+}
+
+var previewPageTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Title}}{{.Title}}{{else}}Link preview{{end}}</title>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}Link preview{{end}}</h1>
+<p>{{.ShortURL}} leads to:</p>
+{{if .Protected}}<p>a password protected destination</p>{{else}}<p><code>{{.Destination}}</code></p>{{end}}
+{{if .MayVary}}<p>Some visitors are sent to other destinations.</p>{{end}}
+{{if .CreatedAt}}<p>Created at {{.CreatedAt}}.</p>{{end}}
+{{if and .ForcePreview (not .Protected)}}<form method="POST" action="/{{.Short}}">
+<input type="hidden" name="confirm" value="1">
+<button type="submit">Continue</button>
+</form>{{else}}<p><a href="/{{.Short}}">Continue</a></p>{{end}}
+</body>
+</html>
+`))
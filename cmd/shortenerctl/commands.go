@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/evgenspj/url-shortener/pkg/client"
+)
+
+// importBatchSize is how many rows of an import are shortened by a request.
+const importBatchSize = 100
+
+type shortenResult struct {
+	OriginalURL string `json:"original_url"`
+	ShortURL    string `json:"short_url"`
+	Existed     bool   `json:"existed"`
+}
+
+type importResult struct {
+	CorrelationID string `json:"correlation_id"`
+	OriginalURL   string `json:"original_url"`
+	ShortURL      string `json:"short_url"`
+}
+
+// runShorten shortens the urls given as arguments, or the lines of stdin
+// without arguments. Failed urls are reported and skipped.
+func runShorten(ctx context.Context, env *cmdEnv, args []string) error {
+	urls := args
+	if len(urls) == 0 || (len(urls) == 1 && urls[0] == "-") {
+		urls = nil
+		scanner := bufio.NewScanner(env.stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); len(line) > 0 {
+				urls = append(urls, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	results := []shortenResult{}
+	rows := [][]string{}
+	failed := 0
+	for _, longURL := range urls {
+		shortURL, err := env.client.Shorten(ctx, longURL)
+		existed := errors.Is(err, client.ErrConflict)
+		if err != nil && !existed {
+			if !isRequestError(err) {
+				return err
+			}
+			fmt.Fprintf(env.stderr, "%s: %v\n", longURL, err)
+			failed++
+			continue
+		}
+		results = append(results, shortenResult{OriginalURL: longURL, ShortURL: shortURL, Existed: existed})
+		rows = append(rows, []string{shortURL, longURL})
+	}
+	if err := env.out.print(results, []string{"SHORT URL", "ORIGINAL URL"}, rows); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d urls failed", failed, len(urls))
+	}
+	return nil
+}
+
+func runList(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) > 0 {
+		return errUsage
+	}
+	urls, err := env.client.UserURLs(ctx)
+	if err != nil {
+		return err
+	}
+	if urls == nil {
+		urls = []client.UserURL{}
+	}
+	rows := make([][]string, len(urls))
+	for i, u := range urls {
+		rows[i] = []string{u.ShortURL, u.OriginalURL, u.Status}
+	}
+	return env.out.print(urls, []string{"SHORT URL", "ORIGINAL URL", "STATUS"}, rows)
+}
+
+func runDelete(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	ids := make([]string, len(args))
+	for i, arg := range args {
+		ids[i] = linkID(arg)
+	}
+	return env.client.DeleteUserURLs(ctx, ids)
+}
+
+func runStats(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	stats, err := env.client.LinkStats(ctx, linkID(args[0]))
+	if err != nil {
+		return err
+	}
+	rows := [][]string{{"total", strconv.FormatInt(stats.Total, 10)}}
+	variants := make([]string, 0, len(stats.Variants))
+	for name := range stats.Variants {
+		variants = append(variants, name)
+	}
+	sort.Strings(variants)
+	for _, name := range variants {
+		rows = append(rows, []string{name, strconv.FormatInt(stats.Variants[name], 10)})
+	}
+	return env.out.print(stats, []string{"VARIANT", "CLICKS"}, rows)
+}
+
+// runImport shortens the urls of a CSV file. The file either has a header
+// with an original_url column and an optional correlation_id one, or holds
+// the urls in its first column.
+func runImport(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	in := env.stdin
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	urlColumn, idColumn := 0, -1
+	results := []importResult{}
+	rows := [][]string{}
+	var batch []client.BatchItem
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		shortened, err := env.client.ShortenBatch(ctx, batch, nil)
+		if err != nil && !errors.Is(err, client.ErrConflict) {
+			return err
+		}
+		shortURLs := make(map[string]string, len(shortened))
+		for _, result := range shortened {
+			shortURLs[result.CorrelationID] = result.ShortURL
+		}
+		for _, item := range batch {
+			result := importResult{CorrelationID: item.CorrelationID, OriginalURL: item.OriginalURL, ShortURL: shortURLs[item.CorrelationID]}
+			results = append(results, result)
+			rows = append(rows, []string{result.ShortURL, result.OriginalURL, result.CorrelationID})
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if line == 1 {
+			if column := columnIndex(record, "original_url"); column >= 0 {
+				urlColumn, idColumn = column, columnIndex(record, "correlation_id")
+				continue
+			}
+		}
+		if urlColumn >= len(record) || len(strings.TrimSpace(record[urlColumn])) == 0 {
+			return fmt.Errorf("line %d: no url", line)
+		}
+		item := client.BatchItem{CorrelationID: strconv.Itoa(line), OriginalURL: strings.TrimSpace(record[urlColumn])}
+		if idColumn >= 0 && idColumn < len(record) && len(record[idColumn]) > 0 {
+			item.CorrelationID = record[idColumn]
+		}
+		batch = append(batch, item)
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return fmt.Errorf("rows up to line %d: %w", line, err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return env.out.print(results, []string{"SHORT URL", "ORIGINAL URL", "CORRELATION ID"}, rows)
+}
+
+// runExport writes the links of the user as CSV with a header.
+func runExport(ctx context.Context, env *cmdEnv, args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	urls, err := env.client.UserURLs(ctx)
+	if err != nil {
+		return err
+	}
+	out := env.stdout
+	var file *os.File
+	if len(args) == 1 && args[0] != "-" {
+		if file, err = os.Create(args[0]); err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"short_url", "original_url", "status"})
+	for _, u := range urls {
+		writer.Write([]string{u.ShortURL, u.OriginalURL, u.Status})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if file != nil {
+		return file.Close()
+	}
+	return nil
+}
+
+// linkID accepts both codes and short urls.
+func linkID(arg string) string {
+	if u, err := url.Parse(arg); err == nil && len(u.Scheme) > 0 && len(u.Host) > 0 {
+		return path.Base(u.Path)
+	}
+	return arg
+}
+
+func columnIndex(header []string, name string) int {
+	for i, column := range header {
+		if strings.EqualFold(strings.TrimSpace(column), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// isRequestError tells errors about a single url from the ones failing
+// every request, like an unreachable server.
+func isRequestError(err error) bool {
+	var apiErr *client.Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode < 500 && apiErr.StatusCode != 429
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const defaultServerURL = "http://localhost:8080"
+
+type EnvConfig struct {
+	ServerURL  string `env:"SHORTENER_URL"`
+	ConfigPath string `env:"SHORTENERCTL_CONFIG"`
+}
+
+// ConfigFile is the config saved between runs. The user token issued by the
+// server on the first request is kept here, so later runs act as the same
+// user and see the same links.
+type ConfigFile struct {
+	Server    string `json:"server,omitempty"`
+	UserToken string `json:"user_token,omitempty"`
+}
+
+// configStore keeps the user token in the config file at path, it is the
+// client.TokenStore of the tool. The token is saved with the server it was
+// issued by.
+type configStore struct {
+	path   string
+	server string
+}
+
+func defaultConfigPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "shortenerctl", "config.json"), nil
+}
+
+func (s configStore) Load() (ConfigFile, error) {
+	var cfg ConfigFile
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	return cfg, json.Unmarshal(data, &cfg)
+}
+
+func (s configStore) Save(cfg ConfigFile) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, append(data, '\n'), 0600)
+}
+
+// LoadToken returns the saved token if it was issued by the server of the
+// store, tokens are never sent to another server.
+func (s configStore) LoadToken() (string, error) {
+	cfg, err := s.Load()
+	if err != nil || cfg.Server != s.server {
+		return "", err
+	}
+	return cfg.UserToken, nil
+}
+
+func (s configStore) SaveToken(token string) error {
+	cfg, err := s.Load()
+	if err != nil {
+		return err
+	}
+	cfg.UserToken = token
+	if len(s.server) > 0 {
+		cfg.Server = s.server
+	}
+	return s.Save(cfg)
+}
@@ -0,0 +1,193 @@
+// Command shortenerctl shortens and manages links of the url shortener from
+// the command line.
+//
+//	shortenerctl [flags] shorten [URL...]   shorten urls, read from stdin without arguments
+//	shortenerctl [flags] list               list my links
+//	shortenerctl [flags] delete ID...       delete my links by code or short url
+//	shortenerctl [flags] stats ID           show clicks of a link
+//	shortenerctl [flags] import [FILE]      shorten the urls of a CSV file or stdin
+//	shortenerctl [flags] export [FILE]      write my links as CSV to a file or stdout
+//
+// The user token is kept in the config file, so every run acts as the same
+// user.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/caarlos0/env/v6"
+	"github.com/evgenspj/url-shortener/pkg/client"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputPlain = "plain"
+)
+
+var (
+	// errUsage is returned for wrong arguments, the usage is printed for it.
+	errUsage = errors.New("wrong usage")
+	// errBadFlags is returned for flags the flag package couldn't parse, it
+	// prints the error and the usage itself.
+	errBadFlags = errors.New("bad flags")
+)
+
+type Config struct {
+	ServerURL  string
+	ConfigPath string
+	Output     string
+}
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, env *cmdEnv, args []string) error
+}
+
+var commands = map[string]command{
+	"shorten": {"shorten [URL...]", runShorten},
+	"list":    {"list", runList},
+	"delete":  {"delete ID...", runDelete},
+	"stats":   {"stats ID", runStats},
+	"import":  {"import [FILE]", runImport},
+	"export":  {"export [FILE]", runExport},
+}
+
+// cmdEnv is what commands work with.
+type cmdEnv struct {
+	client *client.Client
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+	out    output
+}
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("shortenerctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: shortenerctl [flags] command [args]")
+		fmt.Fprintln(stderr, "\ncommands:")
+		for _, name := range []string{"shorten", "list", "delete", "stats", "import", "export"} {
+			fmt.Fprintln(stderr, "  "+commands[name].usage)
+		}
+		fmt.Fprintln(stderr, "\nflags:")
+		flags.PrintDefaults()
+	}
+	cfg, err := parseConfig(flags, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		if errors.Is(err, errBadFlags) {
+			return 2
+		}
+		if errors.Is(err, errUsage) {
+			fmt.Fprintln(stderr, err)
+			flags.Usage()
+			return 2
+		}
+		fmt.Fprintln(stderr, "shortenerctl:", err)
+		return 1
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+
+	c, err := client.New(cfg.ServerURL, client.WithTokenStore(configStore{cfg.ConfigPath, cfg.ServerURL}))
+	if err != nil {
+		fmt.Fprintln(stderr, "shortenerctl:", err)
+		return 1
+	}
+	cmdEnv := &cmdEnv{
+		client: c,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+		out:    output{format: cfg.Output, w: stdout},
+	}
+	if err := cmd.run(ctx, cmdEnv, flags.Args()[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintln(stderr, "usage: shortenerctl [flags] "+cmd.usage)
+			return 2
+		}
+		fmt.Fprintln(stderr, "shortenerctl:", err)
+		return 1
+	}
+	return 0
+}
+
+// parseConfig resolves the config: command line arguments take precedence
+// over environment variables, which take precedence over the config file and
+// the defaults.
+func parseConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	// comand line args
+	argServerURL := flags.String("s", "", "url of the shortener, e.g. "+defaultServerURL)
+	argConfigPath := flags.String("config", "", "config file keeping the server and the user token")
+	argOutput := flags.String("o", outputTable, "output format: table, json or plain")
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return Config{}, err
+		}
+		return Config{}, fmt.Errorf("%w: %v", errBadFlags, err)
+	}
+
+	// environment variables
+	var envCfg EnvConfig
+	if err := env.Parse(&envCfg); err != nil {
+		return Config{}, err
+	}
+
+	var cfg Config
+	switch {
+	case len(*argConfigPath) > 0:
+		cfg.ConfigPath = *argConfigPath
+	case len(envCfg.ConfigPath) > 0:
+		cfg.ConfigPath = envCfg.ConfigPath
+	default:
+		path, err := defaultConfigPath()
+		if err != nil {
+			return Config{}, err
+		}
+		cfg.ConfigPath = path
+	}
+
+	file, err := configStore{path: cfg.ConfigPath}.Load()
+	if err != nil {
+		return Config{}, fmt.Errorf("config %s: %w", cfg.ConfigPath, err)
+	}
+	switch {
+	case len(*argServerURL) > 0:
+		cfg.ServerURL = *argServerURL
+	case len(envCfg.ServerURL) > 0:
+		cfg.ServerURL = envCfg.ServerURL
+	case len(file.Server) > 0:
+		cfg.ServerURL = file.Server
+	default:
+		cfg.ServerURL = defaultServerURL
+	}
+
+	switch *argOutput {
+	case outputTable, outputJSON, outputPlain:
+		cfg.Output = *argOutput
+	default:
+		return Config{}, fmt.Errorf("%w: unknown output format %q", errUsage, *argOutput)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/evgenspj/url-shortener/pkg/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUserToken = "0123abcd"
+
+// fakeShortener is a minimal shortener api keeping the links of one user,
+// requests without its token get the token issued.
+type fakeShortener struct {
+	mu     sync.Mutex
+	links  []client.UserURL
+	tokens []string
+}
+
+func (f *fakeShortener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	token := ""
+	if cookie, err := r.Cookie("user_token"); err == nil {
+		token = cookie.Value
+	}
+	f.tokens = append(f.tokens, token)
+	http.SetCookie(w, &http.Cookie{Name: "user_token", Value: testUserToken})
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/":
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		longURL := body.String()
+		if !strings.HasPrefix(longURL, "http") {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		shortURL, existed := f.shorten(longURL)
+		if existed {
+			w.WriteHeader(http.StatusConflict)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+		w.Write([]byte(shortURL))
+	case r.Method == http.MethodPost && r.URL.Path == "/api/shorten/batch":
+		var items []client.BatchItem
+		json.NewDecoder(r.Body).Decode(&items)
+		results := make([]client.BatchResult, len(items))
+		// answered in reverse order, like the map iteration order of the server
+		for i, item := range items {
+			shortURL, _ := f.shorten(item.OriginalURL)
+			results[len(items)-1-i] = client.BatchResult{CorrelationID: item.CorrelationID, ShortURL: shortURL}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(results)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/user/urls":
+		if len(f.links) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.links)
+	case r.Method == http.MethodDelete && r.URL.Path == "/api/user/urls":
+		var ids []string
+		json.NewDecoder(r.Body).Decode(&ids)
+		for _, id := range ids {
+			for i, link := range f.links {
+				if link.ShortURL == "http://short/"+id {
+					f.links = append(f.links[:i], f.links[i+1:]...)
+					break
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && r.URL.Path == "/api/user/urls/1/stats":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(client.ClickStats{Total: 3, Variants: map[string]int64{"b": 1, "a": 2}})
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"code":"not_found","message":"Not found"}}`))
+	}
+}
+
+func (f *fakeShortener) shorten(longURL string) (string, bool) {
+	for _, link := range f.links {
+		if link.OriginalURL == longURL {
+			return link.ShortURL, true
+		}
+	}
+	shortURL := "http://short/" + strconv.Itoa(len(f.links)+1)
+	f.links = append(f.links, client.UserURL{ShortURL: shortURL, OriginalURL: longURL, Status: "active"})
+	return shortURL, false
+}
+
+func TestShortenerctl(t *testing.T) {
+	fake := &fakeShortener{}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	t.Setenv("SHORTENER_URL", "")
+	t.Setenv("SHORTENERCTL_CONFIG", "")
+
+	type result struct {
+		code   int
+		stdout string
+		stderr string
+	}
+	ctl := func(stdin string, args ...string) result {
+		var stdout, stderr bytes.Buffer
+		args = append([]string{"-config", configPath}, args...)
+		code := run(context.Background(), args, strings.NewReader(stdin), &stdout, &stderr)
+		return result{code, stdout.String(), stderr.String()}
+	}
+
+	t.Run("shorten", func(t *testing.T) {
+		res := ctl("", "-s", ts.URL, "-o", "plain", "shorten", "http://example.com/1")
+		require.Equal(t, 0, res.code, res.stderr)
+		assert.Equal(t, "http://short/1\thttp://example.com/1\n", res.stdout)
+
+		res = ctl("http://example.com/2\n\nnot an url\nhttp://example.com/1\n", "-o", "json", "shorten")
+		assert.Equal(t, 1, res.code)
+		assert.Contains(t, res.stderr, "not an url: ")
+		assert.Contains(t, res.stderr, "1 of 3 urls failed")
+		var results []shortenResult
+		require.NoError(t, json.Unmarshal([]byte(res.stdout), &results))
+		assert.Equal(t, []shortenResult{
+			{OriginalURL: "http://example.com/2", ShortURL: "http://short/2"},
+			{OriginalURL: "http://example.com/1", ShortURL: "http://short/1", Existed: true},
+		}, results)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		cfg, err := configStore{path: configPath}.Load()
+		require.NoError(t, err)
+		assert.Equal(t, ConfigFile{Server: ts.URL, UserToken: testUserToken}, cfg)
+		info, err := os.Stat(configPath)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		assert.Equal(t, []string{"", testUserToken}, fake.tokens[:2], "the token is sent from the second run on")
+	})
+
+	t.Run("list", func(t *testing.T) {
+		res := ctl("", "list")
+		require.Equal(t, 0, res.code, res.stderr)
+		assert.Equal(t, strings.Join([]string{
+			"SHORT URL       ORIGINAL URL          STATUS",
+			"http://short/1  http://example.com/1  active",
+			"http://short/2  http://example.com/2  active",
+			"",
+		}, "\n"), res.stdout)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		res := ctl("", "-o", "plain", "stats", "http://short/1")
+		require.Equal(t, 0, res.code, res.stderr)
+		assert.Equal(t, "total\t3\na\t2\nb\t1\n", res.stdout)
+
+		res = ctl("", "stats", "missing")
+		assert.Equal(t, 1, res.code)
+		assert.Contains(t, res.stderr, "not_found")
+	})
+
+	t.Run("import", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "links.csv")
+		require.NoError(t, os.WriteFile(file, []byte("correlation_id,original_url\na,http://example.com/3\n,http://example.com/4\n"), 0644))
+		res := ctl("", "-o", "plain", "import", file)
+		require.Equal(t, 0, res.code, res.stderr)
+		assert.Equal(t, "http://short/3\thttp://example.com/3\ta\nhttp://short/4\thttp://example.com/4\t3\n", res.stdout)
+
+		res = ctl("http://example.com/5\n", "-o", "plain", "import")
+		require.Equal(t, 0, res.code, res.stderr)
+		assert.Equal(t, "http://short/5\thttp://example.com/5\t1\n", res.stdout)
+	})
+
+	t.Run("delete and export", func(t *testing.T) {
+		res := ctl("", "delete", "2", "http://short/4")
+		require.Equal(t, 0, res.code, res.stderr)
+		file := filepath.Join(t.TempDir(), "export.csv")
+		res = ctl("", "export", file)
+		require.Equal(t, 0, res.code, res.stderr)
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Join([]string{
+			"short_url,original_url,status",
+			"http://short/1,http://example.com/1,active",
+			"http://short/3,http://example.com/3,active",
+			"http://short/5,http://example.com/5,active",
+			"",
+		}, "\n"), string(data))
+	})
+
+	t.Run("other server", func(t *testing.T) {
+		other := &fakeShortener{}
+		otherTS := httptest.NewServer(other)
+		defer otherTS.Close()
+		res := ctl("", "-s", otherTS.URL, "list")
+		require.Equal(t, 0, res.code, res.stderr)
+		assert.Equal(t, []string{""}, other.tokens, "the token of another server is not sent")
+	})
+
+	t.Run("usage", func(t *testing.T) {
+		assert.Equal(t, 2, ctl("").code)
+		assert.Equal(t, 2, ctl("", "unknown").code)
+		assert.Equal(t, 2, ctl("", "-o", "xml", "list").code)
+		assert.Equal(t, 2, ctl("", "-x", "list").code)
+		res := ctl("", "stats")
+		assert.Equal(t, 2, res.code)
+		assert.Contains(t, res.stderr, "usage: shortenerctl [flags] stats ID")
+		assert.Equal(t, 0, ctl("", "-h").code)
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// output prints command results. Tables are aligned and have a header, plain
+// output has tab separated fields and no header, for scripts. JSON output
+// prints the value itself rather than the rows.
+type output struct {
+	format string
+	w      io.Writer
+}
+
+func (o output) print(value interface{}, header []string, rows [][]string) error {
+	switch o.format {
+	case outputJSON:
+		encoder := json.NewEncoder(o.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	case outputPlain:
+		for _, row := range rows {
+			if _, err := io.WriteString(o.w, strings.Join(row, "\t")+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(o.w, 0, 0, 2, ' ', 0)
+	io.WriteString(tw, strings.Join(header, "\t")+"\n")
+	for _, row := range rows {
+		io.WriteString(tw, strings.Join(row, "\t")+"\n")
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,52 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+const maxReportReasonLength = 1000
+
+// Takedown describes why and how a link was disabled.
+type Takedown struct {
+	// Status is the response code served instead of the redirect, 410 Gone
+	// or 451 Unavailable For Legal Reasons.
+	Status int       `json:"status"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+func (t Takedown) Validate() error {
+	if t.Status != http.StatusGone && t.Status != http.StatusUnavailableForLegalReasons {
+		return errors.New("takedown status must be 410 or 451")
+	}
+	if len(t.Reason) == 0 {
+		return errors.New("takedown has no reason")
+	}
+	return nil
+}
+
+// Resolutions of abuse reports.
+const (
+	ReportDisabled  = "disabled"
+	ReportDismissed = "dismissed"
+)
+
+// AbuseReport is a complaint about a link waiting for an admin decision
+// while its Resolution is empty.
+type AbuseReport struct {
+	ID         int64     `json:"id"`
+	Short      string    `json:"short"`
+	Reason     string    `json:"reason"`
+	Reporter   string    `json:"reporter"`
+	CreatedAt  time.Time `json:"created_at"`
+	Resolution string    `json:"resolution,omitempty"`
+}
+
+func (r AbuseReport) Validate() error {
+	if len(r.Reason) > maxReportReasonLength {
+		return errors.New("report reason is too long")
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxAttempts   = 5
+	defaultAttemptWindow = 15 * time.Minute
+)
+
+// AttemptLimiter limits the number of failed attempts per key within a
+// sliding window. The zero value is ready to use with default limits.
+type AttemptLimiter struct {
+	MaxAttempts int
+	Window      time.Duration
+
+	mu       sync.Mutex
+	attempts map[string][]time.Time
+}
+
+// Acquire registers an attempt for the key. The attempt counts as failed
+// until it is released. If the limit is exhausted, Acquire returns false
+// and the time to wait before the next attempt is allowed.
+func (l *AttemptLimiter) Acquire(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.attempts == nil {
+		l.attempts = make(map[string][]time.Time)
+	}
+	now := time.Now()
+	window := l.window()
+	recent := l.attempts[key][:0]
+	for _, at := range l.attempts[key] {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= l.maxAttempts() {
+		l.attempts[key] = recent
+		return false, window - now.Sub(recent[0])
+	}
+	l.attempts[key] = append(recent, now)
+	return true, 0
+}
+
+// Release forgets the latest attempt for the key, e.g. after it succeeded.
+func (l *AttemptLimiter) Release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	attempts := l.attempts[key]
+	if len(attempts) == 0 {
+		return
+	}
+	if len(attempts) == 1 {
+		delete(l.attempts, key)
+		return
+	}
+	l.attempts[key] = attempts[:len(attempts)-1]
+}
+
+func (l *AttemptLimiter) maxAttempts() int {
+	if l.MaxAttempts > 0 {
+		return l.MaxAttempts
+	}
+	return defaultMaxAttempts
+}
+
+func (l *AttemptLimiter) window() time.Duration {
+	if l.Window > 0 {
+		return l.Window
+	}
+	return defaultAttemptWindow
+}
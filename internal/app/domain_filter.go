@@ -0,0 +1,231 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainList matches hosts against patterns, one per line:
+//
+//	example.com      the host itself
+//	*.example.com    the host and all of its subdomains
+//	/^ads[0-9]+\./   a regular expression
+//
+// Empty lines and lines starting with # are ignored.
+type DomainList struct {
+	exact    map[string]bool
+	suffixes []string
+	regexps  []*regexp.Regexp
+}
+
+func ParseDomainList(r io.Reader) (*DomainList, error) {
+	list := &DomainList{exact: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case len(line) == 0 || strings.HasPrefix(line, "#"):
+		case len(line) > 1 && strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/"):
+			re, err := regexp.Compile(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			list.regexps = append(list.regexps, re)
+		case strings.HasPrefix(line, "*."):
+			list.suffixes = append(list.suffixes, normalizeHost(line[2:]))
+		default:
+			list.exact[normalizeHost(line)] = true
+		}
+	}
+	return list, scanner.Err()
+}
+
+func LoadDomainList(filename string) (*DomainList, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseDomainList(file)
+}
+
+func (l *DomainList) Matches(host string) bool {
+	host = normalizeHost(host)
+	if l.exact[host] {
+		return true
+	}
+	for _, suffix := range l.suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	for _, re := range l.regexps {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *DomainList) Len() int {
+	return len(l.exact) + len(l.suffixes) + len(l.regexps)
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Stages at which the domain filter is consulted.
+const (
+	FilterStageShorten  = "shorten"
+	FilterStageRedirect = "redirect"
+)
+
+type BlockedDomainError struct {
+	Host string
+}
+
+func (e *BlockedDomainError) Error() string {
+	return "domain " + e.Host + " is not allowed"
+}
+
+// DomainFilter rejects hosts in the blocklist and, if an allowlist is
+// configured, hosts missing from it. The lists are loaded from files and
+// can be reloaded while the filter is in use.
+type DomainFilter struct {
+	BlocklistFile string
+	AllowlistFile string
+
+	mu         sync.RWMutex
+	blocklist  *DomainList
+	allowlist  *DomainList
+	modTimes   map[string]time.Time
+	rejections map[string]int64
+}
+
+// Reload reads both list files. On error the previously loaded lists stay
+// in use.
+func (f *DomainFilter) Reload() error {
+	modTimes := make(map[string]time.Time)
+	load := func(filename string) (*DomainList, error) {
+		if len(filename) == 0 {
+			return nil, nil
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[filename] = info.ModTime()
+		return LoadDomainList(filename)
+	}
+	blocklist, err := load(f.BlocklistFile)
+	if err != nil {
+		return err
+	}
+	allowlist, err := load(f.AllowlistFile)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blocklist = blocklist
+	f.allowlist = allowlist
+	f.modTimes = modTimes
+	return nil
+}
+
+// Watch reloads the lists every time one of the files changes until the
+// context is done.
+func (f *DomainFilter) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !f.changed() {
+				continue
+			}
+			if err := f.Reload(); err != nil {
+				log.Printf("can't reload domain lists: %v", err)
+			}
+		}
+	}
+}
+
+func (f *DomainFilter) changed() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, filename := range []string{f.BlocklistFile, f.AllowlistFile} {
+		if len(filename) == 0 {
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(f.modTimes[filename]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns a *BlockedDomainError if the host is rejected and counts
+// the rejection for the stage.
+func (f *DomainFilter) Check(host string, stage string) error {
+	f.mu.RLock()
+	var list string
+	switch {
+	case f.blocklist != nil && f.blocklist.Matches(host):
+		list = "blocklist"
+	case f.allowlist != nil && !f.allowlist.Matches(host):
+		list = "allowlist"
+	}
+	f.mu.RUnlock()
+	if len(list) == 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.rejections == nil {
+		f.rejections = make(map[string]int64)
+	}
+	f.rejections[stage+"."+list]++
+	return &BlockedDomainError{Host: host}
+}
+
+// DomainFilterStats describes the loaded lists and the rejected requests,
+// keyed by stage and list, e.g. "redirect.blocklist".
+type DomainFilterStats struct {
+	BlocklistSize int              `json:"blocklist_size"`
+	AllowlistSize int              `json:"allowlist_size"`
+	Rejections    map[string]int64 `json:"rejections"`
+}
+
+func (f *DomainFilter) Stats() DomainFilterStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	stats := DomainFilterStats{Rejections: make(map[string]int64)}
+	if f.blocklist != nil {
+		stats.BlocklistSize = f.blocklist.Len()
+	}
+	if f.allowlist != nil {
+		stats.AllowlistSize = f.allowlist.Len()
+	}
+	for key, count := range f.rejections {
+		stats.Rejections[key] = count
+	}
+	return stats
+}
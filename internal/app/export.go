@@ -0,0 +1,9 @@
+package app
+
+// ExportedLink is a link of a user as kept by the storage, with its clicks.
+type ExportedLink struct {
+	Short   string
+	LongURL string
+	Options LinkOptions
+	Clicks  ClickStats
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// HealthChecker is implemented by storages and other components that can
+// tell whether they are able to serve requests.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// CheckHealth always succeeds, the links are kept in memory.
+func (storage *StructStorage) CheckHealth(ctx context.Context) error {
+	return nil
+}
+
+// CheckHealth checks that the file can be read and written, without
+// changing or parsing it. A missing file is fine while its directory exists,
+// it is created by the first link saved.
+func (storage *JSONFileStorage) CheckHealth(ctx context.Context) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	file, err := os.OpenFile(storage.Filename, os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		dir, err := os.Stat(filepath.Dir(storage.Filename))
+		if err != nil {
+			return fmt.Errorf("can't create %s: %w", storage.Filename, err)
+		}
+		if !dir.IsDir() {
+			return fmt.Errorf("can't create %s: %s is not a directory", storage.Filename, filepath.Dir(storage.Filename))
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("can't open %s: %w", storage.Filename, err)
+	}
+	return file.Close()
+}
+
+func (storage *PostgresStorage) CheckHealth(ctx context.Context) error {
+	return storage.PingContext(ctx)
+}
+
+func (l *PostgresRateLimiter) CheckHealth(ctx context.Context) error {
+	return l.DB.PingContext(ctx)
+}
+
+func (s *PostgresIdempotencyStore) CheckHealth(ctx context.Context) error {
+	return s.DB.PingContext(ctx)
+}
@@ -0,0 +1,181 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// IdempotentResponse is a response kept to be replayed to retries of the
+// request.
+type IdempotentResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyRecord is the state of a claimed idempotency key. Response is
+// nil while the request that claimed the key is being handled.
+type IdempotencyRecord struct {
+	Fingerprint string
+	Response    *IdempotentResponse
+}
+
+// IdempotencyStore keeps the responses of requests sent with an idempotency
+// key.
+type IdempotencyStore interface {
+	// Reserve claims key for the request with fingerprint until ttl passes.
+	// If the key is claimed already, it returns false and the record of the
+	// claim.
+	Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (IdempotencyRecord, bool, error)
+	// Complete keeps the response of the request that claimed key until ttl
+	// passes.
+	Complete(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error
+	// Release forgets key, so a retry is handled again.
+	Release(ctx context.Context, key string) error
+}
+
+const idempotencyPruneEvery = 1024
+
+type idempotencyEntry struct {
+	record    IdempotencyRecord
+	expiresAt time.Time
+}
+
+// MemoryIdempotencyStore keeps responses in memory of a single server
+// instance. The zero value is ready to use.
+type MemoryIdempotencyStore struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	calls   int
+}
+
+func (s *MemoryIdempotencyStore) Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]*idempotencyEntry)
+	}
+	now := time.Now()
+	s.calls++
+	if s.calls%idempotencyPruneEvery == 0 {
+		s.prune(now)
+	}
+	if entry, exists := s.entries[key]; exists && now.Before(entry.expiresAt) {
+		return entry.record, false, nil
+	}
+	s.entries[key] = &idempotencyEntry{
+		record:    IdempotencyRecord{Fingerprint: fingerprint},
+		expiresAt: now.Add(ttl),
+	}
+	return IdempotencyRecord{}, true, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.entries[key]
+	if !exists {
+		return nil
+	}
+	entry.record.Response = &response
+	entry.expiresAt = time.Now().Add(ttl)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) prune(now time.Time) {
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// PostgresIdempotencyStore shares responses between server instances.
+type PostgresIdempotencyStore struct {
+	DB    *sql.DB
+	calls uint32
+}
+
+func (s *PostgresIdempotencyStore) Init(ctx context.Context) error {
+	_, err := s.DB.ExecContext(
+		ctx,
+		"CREATE TABLE IF NOT EXISTS idempotency_keys (key TEXT PRIMARY KEY, fingerprint TEXT NOT NULL, status INTEGER, content_type TEXT, body BYTEA, expires_at TIMESTAMPTZ NOT NULL)",
+	)
+	return err
+}
+
+func (s *PostgresIdempotencyStore) Reserve(ctx context.Context, key string, fingerprint string, ttl time.Duration) (IdempotencyRecord, bool, error) {
+	if atomic.AddUint32(&s.calls, 1)%idempotencyPruneEvery == 0 {
+		if _, err := s.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= clock_timestamp()"); err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+	}
+	for {
+		// expired claims are taken over
+		result, err := s.DB.ExecContext(
+			ctx,
+			"INSERT INTO idempotency_keys (key, fingerprint, expires_at) VALUES($1, $2, clock_timestamp() + $3 * interval '1 millisecond') "+
+				"ON CONFLICT (key) DO UPDATE SET fingerprint = excluded.fingerprint, status = NULL, content_type = NULL, body = NULL, expires_at = excluded.expires_at "+
+				"WHERE idempotency_keys.expires_at <= clock_timestamp()",
+			key,
+			fingerprint,
+			ttl.Milliseconds(),
+		)
+		if err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+		if affected, err := result.RowsAffected(); err != nil || affected > 0 {
+			return IdempotencyRecord{}, err == nil, err
+		}
+		row := s.DB.QueryRowContext(
+			ctx,
+			"SELECT fingerprint, status, content_type, body FROM idempotency_keys WHERE key = $1",
+			key,
+		)
+		var record IdempotencyRecord
+		var status sql.NullInt64
+		var contentType sql.NullString
+		var body []byte
+		err = row.Scan(&record.Fingerprint, &status, &contentType, &body)
+		if errors.Is(err, sql.ErrNoRows) {
+			// released in the meantime
+			continue
+		}
+		if err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+		if status.Valid {
+			record.Response = &IdempotentResponse{Status: int(status.Int64), ContentType: contentType.String, Body: body}
+		}
+		return record, false, nil
+	}
+}
+
+func (s *PostgresIdempotencyStore) Complete(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	_, err := s.DB.ExecContext(
+		ctx,
+		"UPDATE idempotency_keys SET status = $2, content_type = $3, body = $4, expires_at = clock_timestamp() + $5 * interval '1 millisecond' WHERE key = $1",
+		key,
+		response.Status,
+		response.ContentType,
+		response.Body,
+		ttl.Milliseconds(),
+	)
+	return err
+}
+
+func (s *PostgresIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE key = $1", key)
+	return err
+}
@@ -0,0 +1,358 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxShortCodeLength = 64
+	maxMetadataKeys    = 32
+	maxMetadataKey     = 64
+	maxMetadataValue   = 1024
+	// maxImportLineLength bounds a line of a JSONL import.
+	maxImportLineLength = 64 * 1024
+)
+
+var shortCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+var generatedCodePattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// exportOnlyColumns are columns of CSV exports about the state of the links,
+// they are skipped when an export is imported.
+var exportOnlyColumns = map[string]bool{
+	"short_url":       true,
+	"status":          true,
+	"takedown_reason": true,
+	"clicks":          true,
+}
+
+// reservedShortCodes are paths served by the shortener itself.
+var reservedShortCodes = map[string]bool{
+	"api":     true,
+	"debug":   true,
+	"ping":    true,
+	"healthz": true,
+	"readyz":  true,
+}
+
+// ImportedLink is a link saved with its own code, e.g. one moved over from
+// another shortener.
+type ImportedLink struct {
+	Short   string
+	LongURL string
+	Options LinkOptions
+}
+
+// ImportRow is a link read from an import file. Short is empty for links
+// getting a generated code.
+type ImportRow struct {
+	Line        int               `json:"-"`
+	Short       string            `json:"short,omitempty"`
+	OriginalURL string            `json:"original_url"`
+	CreatedAt   *time.Time        `json:"created_at,omitempty"`
+	Title       string            `json:"title,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// ImportRowError is a row of an import file that can't be read. Reading
+// goes on with the next row.
+type ImportRowError struct {
+	Line  int
+	Field string
+	Err   error
+}
+
+func (e *ImportRowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ImportRowError) Unwrap() error {
+	return e.Err
+}
+
+// ImportReader reads the rows of an import file. Read returns io.EOF after
+// the last row and an *ImportRowError for rows that can't be read, other
+// errors end the import.
+type ImportReader interface {
+	Read() (ImportRow, error)
+}
+
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns []string
+}
+
+// NewCSVImportReader reads CSV with a header. The original_url column is
+// required, short, created_at and title are optional and other columns are
+// kept as metadata. A metadata column holds a JSON object of more metadata,
+// like in exports, whose other columns are skipped.
+func NewCSVImportReader(r io.Reader) (ImportReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.New("csv has no header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, len(header))
+	hasURL := false
+	for i, column := range header {
+		columns[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+		hasURL = hasURL || columns[i] == "original_url"
+	}
+	if !hasURL {
+		return nil, errors.New("csv header has no original_url column")
+	}
+	return &csvImportReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvImportReader) Read() (ImportRow, error) {
+	record, err := r.reader.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return ImportRow{Line: parseErr.Line}, &ImportRowError{Line: parseErr.Line, Err: parseErr.Err}
+	}
+	if err != nil {
+		return ImportRow{}, err
+	}
+	line, _ := r.reader.FieldPos(0)
+	row := ImportRow{Line: line}
+	if len(record) != len(r.columns) {
+		return row, &ImportRowError{Line: line, Err: fmt.Errorf("row has %d fields, the header has %d", len(record), len(r.columns))}
+	}
+	for i, value := range record {
+		column := r.columns[i]
+		switch column {
+		case "original_url":
+			row.OriginalURL = strings.TrimSpace(value)
+		case "short":
+			row.Short = strings.TrimSpace(value)
+		case "title":
+			row.Title = value
+		case "created_at":
+			if len(value) == 0 {
+				continue
+			}
+			createdAt, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+			if err != nil {
+				return row, &ImportRowError{Line: line, Field: column, Err: errors.New("created_at must be an RFC 3339 time")}
+			}
+			row.CreatedAt = &createdAt
+		case "metadata":
+			if len(value) == 0 {
+				continue
+			}
+			metadata := make(map[string]string)
+			if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+				return row, &ImportRowError{Line: line, Field: column, Err: errors.New("metadata must be a JSON object of strings")}
+			}
+			for key, value := range metadata {
+				row.addMetadata(key, value)
+			}
+		default:
+			if len(value) == 0 || exportOnlyColumns[column] {
+				continue
+			}
+			row.addMetadata(column, value)
+		}
+	}
+	return row, nil
+}
+
+func (row *ImportRow) addMetadata(key string, value string) {
+	if row.Metadata == nil {
+		row.Metadata = make(map[string]string)
+	}
+	row.Metadata[key] = value
+}
+
+type jsonlImportReader struct {
+	reader *bufio.Reader
+	line   int
+}
+
+// NewJSONLImportReader reads one JSON object per line in the shape of
+// ImportRow. Empty lines are skipped.
+func NewJSONLImportReader(r io.Reader) ImportReader {
+	return &jsonlImportReader{reader: bufio.NewReaderSize(r, maxImportLineLength)}
+}
+
+func (r *jsonlImportReader) Read() (ImportRow, error) {
+	for {
+		data, err := r.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			return ImportRow{}, fmt.Errorf("line %d is longer than %d bytes", r.line+1, maxImportLineLength)
+		}
+		if err != nil && (err != io.EOF || len(data) == 0) {
+			return ImportRow{}, err
+		}
+		r.line++
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		row := ImportRow{}
+		if err := json.Unmarshal(data, &row); err != nil {
+			return ImportRow{Line: r.line}, &ImportRowError{Line: r.line, Err: err}
+		}
+		row.Line = r.line
+		return row, nil
+	}
+}
+
+// ValidateShortCode checks a code chosen for longURL. Codes looking like
+// generated ones are only allowed for the url they would be generated for,
+// so they never take the code of another url.
+func ValidateShortCode(short string, longURL string) error {
+	if len(short) > maxShortCodeLength {
+		return errors.New("short code is longer than " + strconv.Itoa(maxShortCodeLength) + " characters")
+	}
+	if !shortCodePattern.MatchString(short) {
+		return errors.New("short code may only have letters, digits, - and _")
+	}
+	if reservedShortCodes[strings.ToLower(short)] {
+		return errors.New("short code is reserved")
+	}
+	if generatedCodePattern.MatchString(short) && short != GenShort(longURL) {
+		return errors.New("short code looks like a generated one of another url")
+	}
+	return nil
+}
+
+func ValidateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return errors.New("metadata has more than " + strconv.Itoa(maxMetadataKeys) + " keys")
+	}
+	for key, value := range metadata {
+		if len(key) == 0 || len(key) > maxMetadataKey {
+			return errors.New("metadata keys must have 1 to " + strconv.Itoa(maxMetadataKey) + " bytes")
+		}
+		if len(value) > maxMetadataValue {
+			return fmt.Errorf("metadata %s is longer than %d bytes", key, maxMetadataValue)
+		}
+	}
+	return nil
+}
+
+// importLinks adds the links clashing with neither saved links nor each
+// other to the maps of a StructStorage or JSONStructure. longURLs holds the
+// urls of the saved links and is updated with the added ones. It returns the
+// codes added and the indexes of the skipped links.
+func importLinks(shortToLong map[string]string, longURLs map[string]bool, shortToOptions map[string]LinkOptions, shortToClicksLeft map[string]int, links []ImportedLink) ([]string, []int) {
+	var added []string
+	var skipped []int
+	for i, link := range links {
+		if _, exists := shortToLong[link.Short]; exists || longURLs[link.LongURL] {
+			skipped = append(skipped, i)
+			continue
+		}
+		shortToLong[link.Short] = link.LongURL
+		longURLs[link.LongURL] = true
+		if !link.Options.isZero() {
+			shortToOptions[link.Short] = link.Options
+		}
+		if link.Options.HasClickLimit() {
+			shortToClicksLeft[link.Short] = link.Options.MaxClicks
+		}
+		added = append(added, link.Short)
+	}
+	return added, skipped
+}
+
+func longURLSet(shortToLong map[string]string) map[string]bool {
+	longURLs := make(map[string]bool, len(shortToLong))
+	for _, longURL := range shortToLong {
+		longURLs[longURL] = true
+	}
+	return longURLs
+}
+
+// LinkImport saves the links of one import chunk by chunk, see
+// Storage.NewImport.
+type LinkImport interface {
+	// Add checks links like Storage.ImportLinks and returns the indexes of
+	// the skipped ones. The others are saved, or kept to be saved by Commit.
+	Add(ctx context.Context, links []ImportedLink) ([]int, error)
+	// Commit saves the links kept back. Links that clash with ones saved by
+	// other requests since they were added are not saved, their codes are
+	// returned.
+	Commit(ctx context.Context) ([]string, error)
+}
+
+// chunkImport saves every chunk right away, for storages that save a chunk
+// without going over all links.
+type chunkImport struct {
+	storage Storage
+	userID  uint32
+}
+
+func (i *chunkImport) Add(ctx context.Context, links []ImportedLink) ([]int, error) {
+	return i.storage.ImportLinks(ctx, links, i.userID)
+}
+
+func (i *chunkImport) Commit(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+// jsonFileImport keeps the links back until Commit, so the file is read
+// and written once per import rather than once per chunk.
+type jsonFileImport struct {
+	storage  *JSONFileStorage
+	userID   uint32
+	shorts   map[string]bool
+	longURLs map[string]bool
+	links    []ImportedLink
+}
+
+func (i *jsonFileImport) Add(ctx context.Context, links []ImportedLink) ([]int, error) {
+	var skipped []int
+	for n, link := range links {
+		if i.shorts[link.Short] || i.longURLs[link.LongURL] {
+			skipped = append(skipped, n)
+			continue
+		}
+		i.shorts[link.Short] = true
+		i.longURLs[link.LongURL] = true
+		i.links = append(i.links, link)
+	}
+	return skipped, nil
+}
+
+func (i *jsonFileImport) Commit(ctx context.Context) ([]string, error) {
+	if len(i.links) == 0 {
+		return nil, nil
+	}
+	storage := i.storage
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return nil, err
+	}
+	savedURLs.init()
+	added, skipped := importLinks(savedURLs.ShortToLong, longURLSet(savedURLs.ShortToLong), savedURLs.ShortToOptions, savedURLs.ShortToClicksLeft, i.links)
+	clashed := make([]string, 0, len(skipped))
+	for _, n := range skipped {
+		clashed = append(clashed, i.links[n].Short)
+	}
+	i.links = nil
+	if len(added) == 0 {
+		return clashed, nil
+	}
+	savedURLs.UserIDToShort[i.userID] = append(savedURLs.UserIDToShort[i.userID], added...)
+	return clashed, storage.write(savedURLs)
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// LinkOptions holds optional per-link settings stored next to the short url.
+type LinkOptions struct {
+	PasswordHash string `json:"password_hash,omitempty"`
+	MaxClicks    int    `json:"max_clicks,omitempty"`
+	RedirectCode int    `json:"redirect_code,omitempty"`
+	// ForwardQuery merges the query of the short url request into the
+	// destination, resolving conflicts according to QueryConflict.
+	ForwardQuery  bool   `json:"forward_query,omitempty"`
+	QueryConflict string `json:"query_conflict,omitempty"`
+	// ForwardPath appends the path after the short code to the destination.
+	ForwardPath bool `json:"forward_path,omitempty"`
+	// UTM parameters are added to the destination unless already present.
+	UTM *UTMParams `json:"utm,omitempty"`
+	// Rules are evaluated in order, the first matching rule overrides the
+	// destination of the link.
+	Rules []RedirectRule `json:"rules,omitempty"`
+	// Variants split the remaining traffic between weighted destinations.
+	Variants []Variant `json:"variants,omitempty"`
+	// ActiveFrom and ActiveUntil limit the time the link redirects to its
+	// destination. Outside the window visitors are sent to the fallback urls
+	// if set.
+	ActiveFrom    *time.Time `json:"active_from,omitempty"`
+	ActiveUntil   *time.Time `json:"active_until,omitempty"`
+	BeforeURL     string     `json:"before_url,omitempty"`
+	AfterURL      string     `json:"after_url,omitempty"`
+	NotYetMessage string     `json:"not_yet_message,omitempty"`
+	// Title is shown on the preview page of the link.
+	Title     string     `json:"title,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	// ForcePreview shows the preview page instead of redirecting right away.
+	ForcePreview bool `json:"force_preview,omitempty"`
+	// Takedown is set by admins to disable the link.
+	Takedown *Takedown `json:"takedown,omitempty"`
+	// DeletedAt is set when the owner deletes the link.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Metadata keeps fields of imported links the shortener has no use for,
+	// so they survive a move from another shortener.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// States of a link relative to its activation window.
+const (
+	WindowOpen = iota
+	WindowNotStarted
+	WindowEnded
+)
+
+func (opts LinkOptions) IsProtected() bool {
+	return len(opts.PasswordHash) > 0
+}
+
+func (opts LinkOptions) IsDisabled() bool {
+	return opts.Takedown != nil
+}
+
+func (opts LinkOptions) IsDeleted() bool {
+	return opts.DeletedAt != nil
+}
+
+func (opts LinkOptions) HasClickLimit() bool {
+	return opts.MaxClicks > 0
+}
+
+func (opts LinkOptions) WindowState(now time.Time) int {
+	switch {
+	case opts.ActiveFrom != nil && now.Before(*opts.ActiveFrom):
+		return WindowNotStarted
+	case opts.ActiveUntil != nil && !now.Before(*opts.ActiveUntil):
+		return WindowEnded
+	}
+	return WindowOpen
+}
+
+func (opts LinkOptions) ValidateWindow() error {
+	if opts.ActiveFrom != nil && opts.ActiveUntil != nil && !opts.ActiveUntil.After(*opts.ActiveFrom) {
+		return errors.New("active_until must be after active_from")
+	}
+	for _, fallbackURL := range []string{opts.BeforeURL, opts.AfterURL} {
+		if len(fallbackURL) == 0 {
+			continue
+		}
+		if _, err := url.ParseRequestURI(fallbackURL); err != nil {
+			return errors.New("invalid fallback url")
+		}
+	}
+	return nil
+}
+
+// DestinationURLs lists the urls besides the link url visitors can be sent to.
+func (opts LinkOptions) DestinationURLs() []string {
+	urls := []string{}
+	for _, rule := range opts.Rules {
+		urls = append(urls, rule.URL)
+	}
+	for _, variant := range opts.Variants {
+		urls = append(urls, variant.URL)
+	}
+	for _, fallbackURL := range []string{opts.BeforeURL, opts.AfterURL} {
+		if len(fallbackURL) > 0 {
+			urls = append(urls, fallbackURL)
+		}
+	}
+	return urls
+}
+
+const maxTitleLength = 256
+
+func (opts LinkOptions) ValidateTitle() error {
+	if len(opts.Title) > maxTitleLength {
+		return errors.New("title is longer than " + strconv.Itoa(maxTitleLength) + " bytes")
+	}
+	return nil
+}
+
+func (opts LinkOptions) isZero() bool {
+	return reflect.ValueOf(opts).IsZero()
+}
+
+func IsValidRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently,
+		http.StatusFound,
+		http.StatusSeeOther,
+		http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+func IsPermanentRedirectCode(code int) bool {
+	return code == http.StatusMovedPermanently || code == http.StatusPermanentRedirect
+}
@@ -0,0 +1,176 @@
+package app
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"strconv"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Formats of rendered QR codes.
+const (
+	QRFormatPNG = "png"
+	QRFormatSVG = "svg"
+)
+
+const (
+	defaultQRSize   = 256
+	maxQRSize       = 2048
+	defaultQRMargin = 4
+	maxQRMargin     = 32
+)
+
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// QROptions control how a QR code is rendered. Size is the width of the
+// image in pixels, Level the error correction level (L, M, Q or H) and
+// Margin the quiet zone around the code in modules. Zero Size and Level and
+// a negative Margin pick the defaults: 256 pixels, level M and 4 modules.
+type QROptions struct {
+	Size   int
+	Level  string
+	Margin int
+}
+
+// ParseQROptions reads the size, level and margin parameters of a query.
+func ParseQROptions(get func(key string) string) (QROptions, error) {
+	opts := QROptions{Level: strings.ToUpper(get("level")), Margin: -1}
+	if size := get("size"); len(size) > 0 {
+		value, err := strconv.Atoi(size)
+		if err != nil || value <= 0 || value > maxQRSize {
+			return QROptions{}, fmt.Errorf("size must be between 1 and %d", maxQRSize)
+		}
+		opts.Size = value
+	}
+	if margin := get("margin"); len(margin) > 0 {
+		value, err := strconv.Atoi(margin)
+		if err != nil || value < 0 || value > maxQRMargin {
+			return QROptions{}, fmt.Errorf("margin must be between 0 and %d", maxQRMargin)
+		}
+		opts.Margin = value
+	}
+	if _, known := qrLevels[opts.Level]; len(opts.Level) > 0 && !known {
+		return QROptions{}, errors.New("level must be one of L, M, Q, H")
+	}
+	return opts, nil
+}
+
+func (opts QROptions) withDefaults() QROptions {
+	if opts.Size == 0 {
+		opts.Size = defaultQRSize
+	}
+	if len(opts.Level) == 0 {
+		opts.Level = "M"
+	}
+	if opts.Margin < 0 {
+		opts.Margin = defaultQRMargin
+	}
+	return opts
+}
+
+// QRCode is the module matrix of an encoded text, quiet zone included.
+type QRCode struct {
+	modules [][]bool
+	size    int
+}
+
+func NewQRCode(content string, opts QROptions) (*QRCode, error) {
+	opts = opts.withDefaults()
+	level, known := qrLevels[opts.Level]
+	if !known {
+		return nil, errors.New("level must be one of L, M, Q, H")
+	}
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+	n := len(bitmap) + 2*opts.Margin
+	if opts.Size < n {
+		return nil, fmt.Errorf("size must be at least %d pixels for this code", n)
+	}
+	modules := make([][]bool, n)
+	for y := range modules {
+		modules[y] = make([]bool, n)
+		if y >= opts.Margin && y < opts.Margin+len(bitmap) {
+			copy(modules[y][opts.Margin:], bitmap[y-opts.Margin])
+		}
+	}
+	return &QRCode{modules: modules, size: opts.Size}, nil
+}
+
+// PNG draws every module as a square of whole pixels, centered in an image
+// of the requested size.
+func (q *QRCode) PNG() ([]byte, error) {
+	n := len(q.modules)
+	scale := q.size / n
+	offset := (q.size - scale*n) / 2
+	img := image.NewPaletted(image.Rect(0, 0, q.size, q.size), color.Palette{color.White, color.Black})
+	for y, row := range q.modules {
+		for x, dark := range row {
+			if !dark {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex(offset+x*scale+dx, offset+y*scale+dy, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SVG draws the code as a single path, one module per user unit.
+func (q *QRCode) SVG() []byte {
+	n := len(q.modules)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, q.size, q.size, n, n)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, n, n)
+	for y, row := range q.modules {
+		for x := 0; x < n; x++ {
+			if !row[x] {
+				continue
+			}
+			start := x
+			for x < n && row[x] {
+				x++
+			}
+			fmt.Fprintf(&buf, "M%d %dh%dv1h-%dz", start, y, x-start, x-start)
+		}
+	}
+	buf.WriteString(`"/></svg>`)
+	return buf.Bytes()
+}
+
+// DataURI renders the code in the format as a data: url.
+func (q *QRCode) DataURI(format string) (string, error) {
+	switch format {
+	case QRFormatPNG:
+		data, err := q.PNG()
+		if err != nil {
+			return "", err
+		}
+		return "data:image/png;base64," + base64.StdEncoding.EncodeToString(data), nil
+	case QRFormatSVG:
+		return "data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(q.SVG()), nil
+	}
+	return "", errors.New("qr format must be png or svg")
+}
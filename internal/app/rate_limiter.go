@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to
+// Burst tokens.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) Enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is the time until the request could be allowed.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+}
+
+// RateLimiter takes cost tokens from the bucket of the key.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string, limit RateLimit, cost int) (RateLimitResult, error)
+}
+
+// takeTokens refills a bucket holding tokens after elapsed time and tries to
+// take cost tokens from it. It returns the tokens left in the bucket.
+func takeTokens(tokens float64, elapsed time.Duration, limit RateLimit, cost int) (float64, RateLimitResult) {
+	burst := float64(limit.Burst)
+	tokens = math.Min(burst, tokens+elapsed.Seconds()*limit.Rate)
+	result := RateLimitResult{Limit: limit.Burst}
+	if tokens >= float64(cost) {
+		tokens -= float64(cost)
+		result.Allowed = true
+	} else {
+		result.RetryAfter = secondsToDuration((float64(cost) - tokens) / limit.Rate)
+	}
+	result.Remaining = int(math.Floor(tokens))
+	result.Reset = secondsToDuration((burst - tokens) / limit.Rate)
+	return tokens, result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	limit     RateLimit
+}
+
+const memoryRateLimiterPruneEvery = 1024
+
+// MemoryRateLimiter keeps buckets in memory of a single server instance.
+// The zero value is ready to use.
+type MemoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+func (l *MemoryRateLimiter) Allow(ctx context.Context, key string, limit RateLimit, cost int) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	now := time.Now()
+	l.calls++
+	if l.calls%memoryRateLimiterPruneEvery == 0 {
+		l.prune(now)
+	}
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), updatedAt: now, limit: limit}
+		l.buckets[key] = bucket
+	}
+	tokens, result := takeTokens(bucket.tokens, now.Sub(bucket.updatedAt), limit, cost)
+	bucket.tokens = tokens
+	bucket.updatedAt = now
+	bucket.limit = limit
+	return result, nil
+}
+
+// prune forgets buckets that have been refilled, they are equal to new ones.
+func (l *MemoryRateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*bucket.limit.Rate >= float64(bucket.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// PostgresRateLimiter shares buckets between server instances.
+type PostgresRateLimiter struct {
+	DB *sql.DB
+}
+
+func (l *PostgresRateLimiter) Init(ctx context.Context) error {
+	_, err := l.DB.ExecContext(
+		ctx,
+		"CREATE TABLE IF NOT EXISTS rate_limits (key TEXT PRIMARY KEY, tokens DOUBLE PRECISION NOT NULL, updated_at TIMESTAMPTZ NOT NULL)",
+	)
+	return err
+}
+
+func (l *PostgresRateLimiter) Allow(ctx context.Context, key string, limit RateLimit, cost int) (RateLimitResult, error) {
+	tx, err := l.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecContext(
+		ctx,
+		"INSERT INTO rate_limits (key, tokens, updated_at) VALUES($1, $2, clock_timestamp()) ON CONFLICT (key) DO NOTHING",
+		key,
+		float64(limit.Burst),
+	)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	// the database clock is shared by all server instances
+	row := tx.QueryRowContext(
+		ctx,
+		"SELECT tokens, updated_at, clock_timestamp() FROM rate_limits WHERE key = $1 FOR UPDATE",
+		key,
+	)
+	var tokens float64
+	var updatedAt, now time.Time
+	if err := row.Scan(&tokens, &updatedAt, &now); err != nil {
+		return RateLimitResult{}, err
+	}
+	elapsed := now.Sub(updatedAt)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tokens, result := takeTokens(tokens, elapsed, limit, cost)
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE rate_limits SET tokens = $2, updated_at = $3 WHERE key = $1",
+		key,
+		tokens,
+		now,
+	)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return result, tx.Commit()
+}
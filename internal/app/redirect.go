@@ -0,0 +1,72 @@
+package app
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Policies for query parameters present both in the destination and in the
+// short url request.
+const (
+	QueryConflictKeepLink = "link"
+	QueryConflictOverride = "request"
+	QueryConflictAppend   = "append"
+)
+
+func IsValidQueryConflict(policy string) bool {
+	switch policy {
+	case "", QueryConflictKeepLink, QueryConflictOverride, QueryConflictAppend:
+		return true
+	}
+	return false
+}
+
+// BuildDestination applies the utm template and the passthrough options of
+// a link to its destination url.
+func BuildDestination(longURL string, opts LinkOptions, extraPath string, query url.Values) (string, error) {
+	if !(opts.ForwardPath && len(extraPath) > 0) && !(opts.ForwardQuery && len(query) > 0) && opts.UTM == nil {
+		return longURL, nil
+	}
+	destination, err := url.Parse(longURL)
+	if err != nil {
+		return "", err
+	}
+	if opts.ForwardPath && len(extraPath) > 0 {
+		destination.Path = strings.TrimSuffix(destination.Path, "/") + "/" + strings.TrimPrefix(extraPath, "/")
+		destination.RawPath = ""
+	}
+	linkQuery := destination.Query()
+	if opts.UTM != nil {
+		opts.UTM.Apply(linkQuery)
+	}
+	if opts.ForwardQuery && len(query) > 0 {
+		linkQuery = MergeQuery(linkQuery, query, opts.QueryConflict)
+	}
+	if opts.UTM != nil || (opts.ForwardQuery && len(query) > 0) {
+		destination.RawQuery = linkQuery.Encode()
+	}
+	return destination.String(), nil
+}
+
+// MergeQuery adds incoming parameters to the link parameters. Parameters
+// present in both are resolved by the policy, keeping the link values by
+// default.
+func MergeQuery(linkQuery url.Values, incoming url.Values, policy string) url.Values {
+	merged := url.Values{}
+	for key, values := range linkQuery {
+		merged[key] = append([]string(nil), values...)
+	}
+	for key, values := range incoming {
+		if _, exists := merged[key]; !exists {
+			merged[key] = append([]string(nil), values...)
+			continue
+		}
+		switch policy {
+		case QueryConflictOverride:
+			merged[key] = append([]string(nil), values...)
+		case QueryConflictAppend:
+			merged[key] = append(merged[key], values...)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,159 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Device classes detected from the User-Agent header.
+const (
+	DeviceIOS     = "ios"
+	DeviceAndroid = "android"
+	DeviceMobile  = "mobile"
+	DeviceDesktop = "desktop"
+	DeviceBot     = "bot"
+)
+
+// RedirectRule sends visitors matching all of its conditions to URL.
+type RedirectRule struct {
+	Device   string       `json:"device,omitempty"`
+	Language string       `json:"language,omitempty"`
+	Header   *HeaderMatch `json:"header,omitempty"`
+	URL      string       `json:"url"`
+}
+
+// HeaderMatch matches a request header by exact value, case-insensitively.
+// An empty value only requires the header to be present.
+type HeaderMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+func (rule RedirectRule) Validate() error {
+	if len(rule.Device) == 0 && len(rule.Language) == 0 && rule.Header == nil {
+		return errors.New("rule has no conditions")
+	}
+	switch rule.Device {
+	case "", DeviceIOS, DeviceAndroid, DeviceMobile, DeviceDesktop, DeviceBot:
+	default:
+		return errors.New("unknown device " + rule.Device)
+	}
+	if rule.Header != nil && len(rule.Header.Name) == 0 {
+		return errors.New("header rule has no name")
+	}
+	if _, err := url.ParseRequestURI(rule.URL); err != nil {
+		return errors.New("invalid rule url")
+	}
+	return nil
+}
+
+func (rule RedirectRule) Matches(header http.Header) bool {
+	if len(rule.Device) > 0 && !deviceMatches(rule.Device, DeviceClass(header.Get("User-Agent"))) {
+		return false
+	}
+	if len(rule.Language) > 0 && !languageMatches(rule.Language, PreferredLanguage(header.Get("Accept-Language"))) {
+		return false
+	}
+	if rule.Header != nil {
+		values, exists := header[http.CanonicalHeaderKey(rule.Header.Name)]
+		if !exists {
+			return false
+		}
+		if len(rule.Header.Value) > 0 && !containsFold(values, rule.Header.Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// SelectRule returns the url of the first rule matching the request headers.
+func SelectRule(rules []RedirectRule, header http.Header) (string, bool) {
+	for _, rule := range rules {
+		if rule.Matches(header) {
+			return rule.URL, true
+		}
+	}
+	return "", false
+}
+
+// DeviceClass classifies a User-Agent header value.
+func DeviceClass(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case len(ua) == 0:
+		return DeviceDesktop
+	case strings.Contains(ua, "bot"), strings.Contains(ua, "crawler"), strings.Contains(ua, "spider"):
+		return DeviceBot
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ipod"):
+		return DeviceIOS
+	case strings.Contains(ua, "android"):
+		return DeviceAndroid
+	case strings.Contains(ua, "mobile"):
+		return DeviceMobile
+	}
+	return DeviceDesktop
+}
+
+func deviceMatches(ruleDevice string, device string) bool {
+	if ruleDevice == DeviceMobile {
+		return device == DeviceMobile || device == DeviceIOS || device == DeviceAndroid
+	}
+	return ruleDevice == device
+}
+
+// PreferredLanguage returns the language tag with the highest quality from
+// an Accept-Language header value.
+func PreferredLanguage(acceptLanguage string) string {
+	type weightedTag struct {
+		tag     string
+		quality float64
+	}
+	tags := []weightedTag{}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.TrimSpace(fields[0])
+		if len(tag) == 0 || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality > 0 {
+			tags = append(tags, weightedTag{tag, quality})
+		}
+	}
+	if len(tags) == 0 {
+		return ""
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].quality > tags[j].quality
+	})
+	return tags[0].tag
+}
+
+// languageMatches reports whether the rule language is the tag or its prefix,
+// so that "de" matches "de-AT".
+func languageMatches(ruleLanguage string, tag string) bool {
+	ruleLanguage = strings.ToLower(ruleLanguage)
+	tag = strings.ToLower(tag)
+	return tag == ruleLanguage || strings.HasPrefix(tag, ruleLanguage+"-")
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
@@ -4,34 +4,86 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 
 	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/stdlib"
 )
 
 type Storage interface {
 	SaveShort(ctx context.Context, short string, longURL string, userID uint32) error
+	SaveLink(ctx context.Context, short string, longURL string, userID uint32, opts LinkOptions) error
 	GetURLFromShort(ctx context.Context, short string) (string, bool)
 	GetURLsByUserID(ctx context.Context, userID uint32) []string
 	SaveShortMulti(ctx context.Context, shortToLong map[string]string, userID uint32) error
+	SaveLinkMulti(ctx context.Context, shortToLong map[string]string, userID uint32, opts LinkOptions) error
+	// ImportLinks saves links with their own codes and options. Links whose
+	// code or url is taken, by a saved link or one before them, are skipped
+	// and their indexes returned.
+	ImportLinks(ctx context.Context, links []ImportedLink, userID uint32) ([]int, error)
+	// NewImport starts an import of links of the user, which may be saved
+	// more cheaply at once than chunk by chunk with ImportLinks.
+	NewImport(ctx context.Context, userID uint32) (LinkImport, error)
+	// ExportLinks calls fn with every link of the user, deleted ones included,
+	// without holding them all in memory where the storage allows. It stops
+	// at the first error of fn and returns it.
+	ExportLinks(ctx context.Context, userID uint32, fn func(link ExportedLink) error) error
+	GetLinkOptions(ctx context.Context, short string) (LinkOptions, error)
+	// UpdateLinkOptions atomically replaces the options of an existing link
+	// with the result of update.
+	UpdateLinkOptions(ctx context.Context, short string, update func(opts *LinkOptions) error) error
+	// ConsumeClick atomically takes one click from the remaining count of a
+	// link with a click limit. It returns false once the limit is exhausted.
+	ConsumeClick(ctx context.Context, short string) (bool, error)
+	// ClicksLeft returns the remaining clicks of a link without taking one.
+	// limited is false for links without a click limit.
+	ClicksLeft(ctx context.Context, short string) (left int, limited bool, err error)
+	// RecordClick counts a redirect of the link, variant is empty for links
+	// without A/B split.
+	RecordClick(ctx context.Context, short string, variant string) error
+	GetClickStats(ctx context.Context, short string) (ClickStats, error)
+	GetUserSettings(ctx context.Context, userID uint32) (UserSettings, error)
+	SaveUserSettings(ctx context.Context, userID uint32, settings UserSettings) error
+	// SaveReport queues an abuse report and returns its id.
+	SaveReport(ctx context.Context, report AbuseReport) (int64, error)
+	GetOpenReports(ctx context.Context) ([]AbuseReport, error)
+	// ResolveReports closes all open reports of the link.
+	ResolveReports(ctx context.Context, short string, resolution string) error
 }
 
 type StructStorage struct {
-	mu            sync.Mutex
-	ShortToLong   map[string]string
-	UserIDToShort map[uint32][]string
+	mu                sync.Mutex
+	ShortToLong       map[string]string
+	UserIDToShort     map[uint32][]string
+	ShortToOptions    map[string]LinkOptions
+	ShortToClicksLeft map[string]int
+	UserIDToSettings  map[uint32]UserSettings
+	ShortToClicks     map[string]ClickStats
+	Reports           []AbuseReport
+	// longURLs indexes the urls of ShortToLong for imports, it is built on
+	// the first one.
+	longURLs map[string]bool
 }
 
 type JSONStructure struct {
-	ShortToLong   map[string]string   `json:"short_to_long,omitempty"`
-	UserIDToShort map[uint32][]string `json:"user_id_to_short,omitempty"`
+	ShortToLong       map[string]string       `json:"short_to_long,omitempty"`
+	UserIDToShort     map[uint32][]string     `json:"user_id_to_short,omitempty"`
+	ShortToOptions    map[string]LinkOptions  `json:"short_to_options,omitempty"`
+	ShortToClicksLeft map[string]int          `json:"short_to_clicks_left,omitempty"`
+	UserIDToSettings  map[uint32]UserSettings `json:"user_id_to_settings,omitempty"`
+	ShortToClicks     map[string]ClickStats   `json:"short_to_clicks,omitempty"`
+	Reports           []AbuseReport           `json:"reports,omitempty"`
 }
 
 type JSONFileStorage struct {
+	mu       sync.Mutex
 	Filename string
 }
 
@@ -39,20 +91,66 @@ type PostgresStorage struct {
 	DB *sql.DB
 }
 
+var ErrLinkNotFound = errors.New("short url not found")
+
 type DuplicateError struct{}
 
 func (e *DuplicateError) Error() string {
 	return "long url duplicate error"
 }
 
+// releaseDeleted frees the code of a deleted link to the same url for a new
+// one, its owner, options and clicks are forgotten. It returns false while
+// the code is taken by a link in use.
+func releaseDeleted(short string, longURL string, shortToLong map[string]string, userIDToShort map[uint32][]string, shortToOptions map[string]LinkOptions, shortToClicksLeft map[string]int, shortToClicks map[string]ClickStats) bool {
+	savedURL, exists := shortToLong[short]
+	if !exists {
+		return true
+	}
+	if savedURL != longURL || !shortToOptions[short].IsDeleted() {
+		return false
+	}
+	delete(shortToLong, short)
+	delete(shortToOptions, short)
+	delete(shortToClicksLeft, short)
+	delete(shortToClicks, short)
+	for userID, shorts := range userIDToShort {
+		for i, owned := range shorts {
+			if owned == short {
+				userIDToShort[userID] = append(shorts[:i:i], shorts[i+1:]...)
+				break
+			}
+		}
+	}
+	return true
+}
+
 func (storage *StructStorage) SaveShort(ctx context.Context, short string, longURL string, userID uint32) error {
+	return storage.SaveLink(ctx, short, longURL, userID, LinkOptions{})
+}
+
+func (storage *StructStorage) SaveLink(ctx context.Context, short string, longURL string, userID uint32, opts LinkOptions) error {
 	storage.mu.Lock()
 	defer storage.mu.Unlock()
-	_, exists := storage.ShortToLong[short]
-	if exists {
+	if !releaseDeleted(short, longURL, storage.ShortToLong, storage.UserIDToShort, storage.ShortToOptions, storage.ShortToClicksLeft, storage.ShortToClicks) {
 		return &DuplicateError{}
 	}
 	storage.ShortToLong[short] = longURL
+	if storage.longURLs != nil {
+		storage.longURLs[longURL] = true
+	}
+	if !opts.isZero() {
+		if storage.ShortToOptions == nil {
+			storage.ShortToOptions = make(map[string]LinkOptions)
+		}
+		storage.ShortToOptions[short] = opts
+	}
+	if opts.HasClickLimit() {
+		if storage.ShortToClicksLeft == nil {
+			storage.ShortToClicksLeft = make(map[string]int)
+		}
+		storage.ShortToClicksLeft[short] = opts.MaxClicks
+	}
 	userIDToShort, exists := storage.UserIDToShort[userID]
 	if !exists {
 		userIDToShort = make([]string, 0)
@@ -76,29 +174,216 @@ func (storage *StructStorage) GetURLsByUserID(ctx context.Context, userID uint32
 }
 
 func (storage *StructStorage) SaveShortMulti(ctx context.Context, shortToLong map[string]string, userID uint32) error {
+	return storage.SaveLinkMulti(ctx, shortToLong, userID, LinkOptions{})
+}
+
+func (storage *StructStorage) SaveLinkMulti(ctx context.Context, shortToLong map[string]string, userID uint32, opts LinkOptions) error {
 	storage.mu.Lock()
 	defer storage.mu.Unlock()
-	userIDToShort, exists := storage.UserIDToShort[userID]
-	if !exists {
-		userIDToShort = make([]string, 0)
+	if storage.ShortToOptions == nil {
+		storage.ShortToOptions = make(map[string]LinkOptions)
+	}
+	if storage.ShortToClicksLeft == nil {
+		storage.ShortToClicksLeft = make(map[string]int)
 	}
 	hasDuplicates := false
 	for short, long := range shortToLong {
-		if _, exists := storage.ShortToLong[short]; exists {
+		if !releaseDeleted(short, long, storage.ShortToLong, storage.UserIDToShort, storage.ShortToOptions, storage.ShortToClicksLeft, storage.ShortToClicks) {
 			hasDuplicates = true
 		} else {
-			userIDToShort = append(userIDToShort, short)
+			storage.UserIDToShort[userID] = append(storage.UserIDToShort[userID], short)
+			if !opts.isZero() {
+				storage.ShortToOptions[short] = opts
+			}
+			if opts.HasClickLimit() {
+				storage.ShortToClicksLeft[short] = opts.MaxClicks
+			}
 		}
 		storage.ShortToLong[short] = long
+		if storage.longURLs != nil {
+			storage.longURLs[long] = true
+		}
+	}
+	if storage.UserIDToShort[userID] == nil {
+		storage.UserIDToShort[userID] = make([]string, 0)
 	}
-	storage.UserIDToShort[userID] = userIDToShort
 	if hasDuplicates {
 		return &DuplicateError{}
 	}
 	return nil
 }
 
+func (storage *StructStorage) ImportLinks(ctx context.Context, links []ImportedLink, userID uint32) ([]int, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.ShortToOptions == nil {
+		storage.ShortToOptions = make(map[string]LinkOptions)
+	}
+	if storage.ShortToClicksLeft == nil {
+		storage.ShortToClicksLeft = make(map[string]int)
+	}
+	if storage.longURLs == nil {
+		storage.longURLs = longURLSet(storage.ShortToLong)
+	}
+	added, skipped := importLinks(storage.ShortToLong, storage.longURLs, storage.ShortToOptions, storage.ShortToClicksLeft, links)
+	storage.UserIDToShort[userID] = append(storage.UserIDToShort[userID], added...)
+	return skipped, nil
+}
+
+func (storage *StructStorage) NewImport(ctx context.Context, userID uint32) (LinkImport, error) {
+	return &chunkImport{storage: storage, userID: userID}, nil
+}
+
+func (storage *StructStorage) ExportLinks(ctx context.Context, userID uint32, fn func(link ExportedLink) error) error {
+	storage.mu.Lock()
+	shorts := append([]string(nil), storage.UserIDToShort[userID]...)
+	storage.mu.Unlock()
+	for _, short := range shorts {
+		storage.mu.Lock()
+		link := ExportedLink{
+			Short:   short,
+			LongURL: storage.ShortToLong[short],
+			Options: storage.ShortToOptions[short],
+			Clicks:  copyClickStats(storage.ShortToClicks[short]),
+		}
+		storage.mu.Unlock()
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *StructStorage) GetLinkOptions(ctx context.Context, short string) (LinkOptions, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return storage.ShortToOptions[short], nil
+}
+
+func (storage *StructStorage) UpdateLinkOptions(ctx context.Context, short string, update func(opts *LinkOptions) error) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if _, exists := storage.ShortToLong[short]; !exists {
+		return ErrLinkNotFound
+	}
+	opts := storage.ShortToOptions[short]
+	if err := update(&opts); err != nil {
+		return err
+	}
+	if storage.ShortToOptions == nil {
+		storage.ShortToOptions = make(map[string]LinkOptions)
+	}
+	storage.ShortToOptions[short] = opts
+	return nil
+}
+
+func (storage *StructStorage) ConsumeClick(ctx context.Context, short string) (bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	clicksLeft, limited := storage.ShortToClicksLeft[short]
+	if !limited {
+		return true, nil
+	}
+	if clicksLeft <= 0 {
+		return false, nil
+	}
+	storage.ShortToClicksLeft[short] = clicksLeft - 1
+	return true, nil
+}
+
+func (storage *StructStorage) ClicksLeft(ctx context.Context, short string) (int, bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	clicksLeft, limited := storage.ShortToClicksLeft[short]
+	return clicksLeft, limited, nil
+}
+
+func (storage *StructStorage) RecordClick(ctx context.Context, short string, variant string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.ShortToClicks == nil {
+		storage.ShortToClicks = make(map[string]ClickStats)
+	}
+	storage.ShortToClicks[short] = addClick(storage.ShortToClicks[short], variant)
+	return nil
+}
+
+func (storage *StructStorage) GetClickStats(ctx context.Context, short string) (ClickStats, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return copyClickStats(storage.ShortToClicks[short]), nil
+}
+
+func (storage *StructStorage) GetUserSettings(ctx context.Context, userID uint32) (UserSettings, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return storage.UserIDToSettings[userID], nil
+}
+
+func (storage *StructStorage) SaveUserSettings(ctx context.Context, userID uint32, settings UserSettings) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.UserIDToSettings == nil {
+		storage.UserIDToSettings = make(map[uint32]UserSettings)
+	}
+	storage.UserIDToSettings[userID] = settings
+	return nil
+}
+
+func (storage *StructStorage) SaveReport(ctx context.Context, report AbuseReport) (int64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	storage.Reports = appendReport(storage.Reports, &report)
+	return report.ID, nil
+}
+
+func (storage *StructStorage) GetOpenReports(ctx context.Context) ([]AbuseReport, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	return openReports(storage.Reports), nil
+}
+
+func (storage *StructStorage) ResolveReports(ctx context.Context, short string, resolution string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	resolveReports(storage.Reports, short, resolution)
+	return nil
+}
+
+// appendReport gives the report the next id.
+func appendReport(reports []AbuseReport, report *AbuseReport) []AbuseReport {
+	report.ID = 1
+	if len(reports) > 0 {
+		report.ID = reports[len(reports)-1].ID + 1
+	}
+	return append(reports, *report)
+}
+
+func openReports(reports []AbuseReport) []AbuseReport {
+	open := make([]AbuseReport, 0)
+	for _, report := range reports {
+		if len(report.Resolution) == 0 {
+			open = append(open, report)
+		}
+	}
+	return open
+}
+
+func resolveReports(reports []AbuseReport, short string, resolution string) {
+	for i := range reports {
+		if reports[i].Short == short && len(reports[i].Resolution) == 0 {
+			reports[i].Resolution = resolution
+		}
+	}
+}
+
 func (storage *JSONFileStorage) SaveShort(ctx context.Context, short string, longURL string, userID uint32) error {
+	return storage.SaveLink(ctx, short, longURL, userID, LinkOptions{})
+}
+
+func (storage *JSONFileStorage) SaveLink(ctx context.Context, short string, longURL string, userID uint32, opts LinkOptions) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
 	file, err := os.OpenFile(storage.Filename, os.O_RDWR|os.O_CREATE|os.O_SYNC, 0777)
 	if err != nil {
 		log.Fatal(err)
@@ -116,10 +401,22 @@ func (storage *JSONFileStorage) SaveShort(ctx context.Context, short string, lon
 	if savedURLs.ShortToLong == nil {
 		savedURLs.ShortToLong = make(map[string]string)
 	}
-	if _, exists := savedURLs.ShortToLong[short]; exists {
+	if !releaseDeleted(short, longURL, savedURLs.ShortToLong, savedURLs.UserIDToShort, savedURLs.ShortToOptions, savedURLs.ShortToClicksLeft, savedURLs.ShortToClicks) {
 		return &DuplicateError{}
 	}
 	savedURLs.ShortToLong[short] = longURL
+	if !opts.isZero() {
+		if savedURLs.ShortToOptions == nil {
+			savedURLs.ShortToOptions = make(map[string]LinkOptions)
+		}
+		savedURLs.ShortToOptions[short] = opts
+	}
+	if opts.HasClickLimit() {
+		if savedURLs.ShortToClicksLeft == nil {
+			savedURLs.ShortToClicksLeft = make(map[string]int)
+		}
+		savedURLs.ShortToClicksLeft[short] = opts.MaxClicks
+	}
 	if savedURLs.UserIDToShort == nil {
 		savedURLs.UserIDToShort = make(map[uint32][]string)
 	}
@@ -132,12 +429,16 @@ func (storage *JSONFileStorage) SaveShort(ctx context.Context, short string, lon
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the file shrinks when a deleted link is released
+	file.Truncate(0)
 	file.Seek(0, 0)
 	file.Write(updatedURLsJSON)
 	return nil
 }
 
 func (storage *JSONFileStorage) GetURLFromShort(ctx context.Context, short string) (longURL string, exists bool) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
 	file, err := os.OpenFile(storage.Filename, os.O_RDONLY|os.O_CREATE|os.O_SYNC, 0777)
 	if err != nil {
 		log.Fatal(err)
@@ -157,6 +458,8 @@ func (storage *JSONFileStorage) GetURLFromShort(ctx context.Context, short strin
 }
 
 func (storage *JSONFileStorage) GetURLsByUserID(ctx context.Context, userID uint32) []string {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
 	file, err := os.OpenFile(storage.Filename, os.O_RDONLY|os.O_CREATE|os.O_SYNC, 0777)
 	if err != nil {
 		log.Fatal(err)
@@ -176,6 +479,12 @@ func (storage *JSONFileStorage) GetURLsByUserID(ctx context.Context, userID uint
 }
 
 func (storage *JSONFileStorage) SaveShortMulti(ctx context.Context, shortToLong map[string]string, userID uint32) error {
+	return storage.SaveLinkMulti(ctx, shortToLong, userID, LinkOptions{})
+}
+
+func (storage *JSONFileStorage) SaveLinkMulti(ctx context.Context, shortToLong map[string]string, userID uint32, opts LinkOptions) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
 	file, err := os.OpenFile(storage.Filename, os.O_RDWR|os.O_CREATE|os.O_SYNC, 0777)
 	if err != nil {
 		log.Fatal(err)
@@ -196,24 +505,36 @@ func (storage *JSONFileStorage) SaveShortMulti(ctx context.Context, shortToLong
 	if savedURLs.UserIDToShort == nil {
 		savedURLs.UserIDToShort = make(map[uint32][]string)
 	}
-	userIDToShort, exists := savedURLs.UserIDToShort[userID]
-	if !exists {
-		userIDToShort = make([]string, 0)
+	if savedURLs.ShortToOptions == nil {
+		savedURLs.ShortToOptions = make(map[string]LinkOptions)
+	}
+	if savedURLs.ShortToClicksLeft == nil {
+		savedURLs.ShortToClicksLeft = make(map[string]int)
 	}
 	hasDuplicates := false
 	for short, long := range shortToLong {
-		if _, exists := savedURLs.ShortToLong[short]; exists {
+		if !releaseDeleted(short, long, savedURLs.ShortToLong, savedURLs.UserIDToShort, savedURLs.ShortToOptions, savedURLs.ShortToClicksLeft, savedURLs.ShortToClicks) {
 			hasDuplicates = true
 		} else {
-			userIDToShort = append(userIDToShort, short)
+			savedURLs.UserIDToShort[userID] = append(savedURLs.UserIDToShort[userID], short)
+			if !opts.isZero() {
+				savedURLs.ShortToOptions[short] = opts
+			}
+			if opts.HasClickLimit() {
+				savedURLs.ShortToClicksLeft[short] = opts.MaxClicks
+			}
 		}
 		savedURLs.ShortToLong[short] = long
 	}
-	savedURLs.UserIDToShort[userID] = userIDToShort
+	if savedURLs.UserIDToShort[userID] == nil {
+		savedURLs.UserIDToShort[userID] = make([]string, 0)
+	}
 	updatedURLsJSON, err := json.MarshalIndent(savedURLs, "", "  ")
 	if err != nil {
 		log.Fatal(err)
 	}
+	// the file shrinks when a deleted link is released
+	file.Truncate(0)
 	file.Seek(0, 0)
 	file.Write(updatedURLsJSON)
 	if hasDuplicates {
@@ -222,21 +543,311 @@ func (storage *JSONFileStorage) SaveShortMulti(ctx context.Context, shortToLong
 	return nil
 }
 
+func (storage *JSONFileStorage) ImportLinks(ctx context.Context, links []ImportedLink, userID uint32) ([]int, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return nil, err
+	}
+	savedURLs.init()
+	added, skipped := importLinks(savedURLs.ShortToLong, longURLSet(savedURLs.ShortToLong), savedURLs.ShortToOptions, savedURLs.ShortToClicksLeft, links)
+	if len(added) == 0 {
+		return skipped, nil
+	}
+	savedURLs.UserIDToShort[userID] = append(savedURLs.UserIDToShort[userID], added...)
+	return skipped, storage.write(savedURLs)
+}
+
+// NewImport reads the file once, the links are written by Commit.
+func (storage *JSONFileStorage) NewImport(ctx context.Context, userID uint32) (LinkImport, error) {
+	storage.mu.Lock()
+	savedURLs, err := storage.read()
+	storage.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	shorts := make(map[string]bool, len(savedURLs.ShortToLong))
+	for short := range savedURLs.ShortToLong {
+		shorts[short] = true
+	}
+	return &jsonFileImport{
+		storage:  storage,
+		userID:   userID,
+		shorts:   shorts,
+		longURLs: longURLSet(savedURLs.ShortToLong),
+	}, nil
+}
+
+// ExportLinks reads the file once, the links are passed on without holding
+// the lock.
+func (storage *JSONFileStorage) ExportLinks(ctx context.Context, userID uint32, fn func(link ExportedLink) error) error {
+	storage.mu.Lock()
+	savedURLs, err := storage.read()
+	storage.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for _, short := range savedURLs.UserIDToShort[userID] {
+		link := ExportedLink{
+			Short:   short,
+			LongURL: savedURLs.ShortToLong[short],
+			Options: savedURLs.ShortToOptions[short],
+			Clicks:  savedURLs.ShortToClicks[short],
+		}
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (storage *JSONFileStorage) GetLinkOptions(ctx context.Context, short string) (LinkOptions, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return LinkOptions{}, err
+	}
+	return savedURLs.ShortToOptions[short], nil
+}
+
+func (storage *JSONFileStorage) UpdateLinkOptions(ctx context.Context, short string, update func(opts *LinkOptions) error) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return err
+	}
+	if _, exists := savedURLs.ShortToLong[short]; !exists {
+		return ErrLinkNotFound
+	}
+	opts := savedURLs.ShortToOptions[short]
+	if err := update(&opts); err != nil {
+		return err
+	}
+	if savedURLs.ShortToOptions == nil {
+		savedURLs.ShortToOptions = make(map[string]LinkOptions)
+	}
+	savedURLs.ShortToOptions[short] = opts
+	return storage.write(savedURLs)
+}
+
+func (storage *JSONFileStorage) ConsumeClick(ctx context.Context, short string) (bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return false, err
+	}
+	clicksLeft, limited := savedURLs.ShortToClicksLeft[short]
+	if !limited {
+		return true, nil
+	}
+	if clicksLeft <= 0 {
+		return false, nil
+	}
+	savedURLs.ShortToClicksLeft[short] = clicksLeft - 1
+	return true, storage.write(savedURLs)
+}
+
+func (storage *JSONFileStorage) ClicksLeft(ctx context.Context, short string) (int, bool, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return 0, false, err
+	}
+	clicksLeft, limited := savedURLs.ShortToClicksLeft[short]
+	return clicksLeft, limited, nil
+}
+
+func (storage *JSONFileStorage) RecordClick(ctx context.Context, short string, variant string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return err
+	}
+	if savedURLs.ShortToClicks == nil {
+		savedURLs.ShortToClicks = make(map[string]ClickStats)
+	}
+	savedURLs.ShortToClicks[short] = addClick(savedURLs.ShortToClicks[short], variant)
+	return storage.write(savedURLs)
+}
+
+func (storage *JSONFileStorage) GetClickStats(ctx context.Context, short string) (ClickStats, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return ClickStats{}, err
+	}
+	return savedURLs.ShortToClicks[short], nil
+}
+
+func (storage *JSONFileStorage) GetUserSettings(ctx context.Context, userID uint32) (UserSettings, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return UserSettings{}, err
+	}
+	return savedURLs.UserIDToSettings[userID], nil
+}
+
+func (storage *JSONFileStorage) SaveUserSettings(ctx context.Context, userID uint32, settings UserSettings) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return err
+	}
+	if savedURLs.UserIDToSettings == nil {
+		savedURLs.UserIDToSettings = make(map[uint32]UserSettings)
+	}
+	savedURLs.UserIDToSettings[userID] = settings
+	return storage.write(savedURLs)
+}
+
+func (storage *JSONFileStorage) SaveReport(ctx context.Context, report AbuseReport) (int64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return 0, err
+	}
+	savedURLs.Reports = appendReport(savedURLs.Reports, &report)
+	return report.ID, storage.write(savedURLs)
+}
+
+func (storage *JSONFileStorage) GetOpenReports(ctx context.Context) ([]AbuseReport, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return nil, err
+	}
+	return openReports(savedURLs.Reports), nil
+}
+
+func (storage *JSONFileStorage) ResolveReports(ctx context.Context, short string, resolution string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	savedURLs, err := storage.read()
+	if err != nil {
+		return err
+	}
+	resolveReports(savedURLs.Reports, short, resolution)
+	return storage.write(savedURLs)
+}
+
+// read loads the whole file. The caller must hold storage.mu.
+func (storage *JSONFileStorage) read() (JSONStructure, error) {
+	savedURLs := JSONStructure{}
+	data, err := os.ReadFile(storage.Filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return savedURLs, nil
+	}
+	if err != nil {
+		return savedURLs, err
+	}
+	if len(data) == 0 {
+		return savedURLs, nil
+	}
+	err = json.Unmarshal(data, &savedURLs)
+	return savedURLs, err
+}
+
+// init makes the maps links are added to.
+func (savedURLs *JSONStructure) init() {
+	if savedURLs.ShortToLong == nil {
+		savedURLs.ShortToLong = make(map[string]string)
+	}
+	if savedURLs.UserIDToShort == nil {
+		savedURLs.UserIDToShort = make(map[uint32][]string)
+	}
+	if savedURLs.ShortToOptions == nil {
+		savedURLs.ShortToOptions = make(map[string]LinkOptions)
+	}
+	if savedURLs.ShortToClicksLeft == nil {
+		savedURLs.ShortToClicksLeft = make(map[string]int)
+	}
+}
+
+// write replaces the file contents. The caller must hold storage.mu.
+func (storage *JSONFileStorage) write(savedURLs JSONStructure) error {
+	data, err := json.MarshalIndent(savedURLs, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(storage.Filename, data, 0777)
+}
+
 func (storage *PostgresStorage) SaveShort(ctx context.Context, short string, longURL string, userID uint32) error {
-	_, err := storage.DB.ExecContext(
+	return storage.SaveLink(ctx, short, longURL, userID, LinkOptions{})
+}
+
+func (storage *PostgresStorage) SaveLink(ctx context.Context, short string, longURL string, userID uint32, opts LinkOptions) error {
+	optsJSON, err := marshalLinkOptions(opts)
+	if err != nil {
+		return err
+	}
+	var clicksLeft sql.NullInt64
+	if opts.HasClickLimit() {
+		clicksLeft = sql.NullInt64{Int64: int64(opts.MaxClicks), Valid: true}
+	}
+	tx, err := storage.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	reused, err := reuseDeletedLink(ctx, tx, short, longURL, userID, optsJSON, clicksLeft)
+	if err != nil {
+		return err
+	}
+	if !reused {
+		_, err = tx.ExecContext(
+			ctx,
+			"INSERT INTO short_urls (short_url, long_url, user_id, options, clicks_left) VALUES($1, $2, $3, $4, $5)",
+			short,
+			longURL,
+			userID,
+			optsJSON,
+			clicksLeft,
+		)
+		if err != nil {
+			if strings.Contains(err.Error(), pgerrcode.UniqueViolation) {
+				return &DuplicateError{}
+			}
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// reuseDeletedLink gives the row of a deleted link to the same url to a new
+// one, the clicks of the deleted link are forgotten. It returns false if
+// there is no such row.
+func reuseDeletedLink(ctx context.Context, tx *sql.Tx, short string, longURL string, userID uint32, optsJSON sql.NullString, clicksLeft sql.NullInt64) (bool, error) {
+	res, err := tx.ExecContext(
 		ctx,
-		"INSERT INTO short_urls (short_url, long_url, user_id) VALUES($1, $2, $3)",
+		"UPDATE short_urls SET user_id = $3, options = $4, clicks_left = $5 WHERE short_url = $1 AND long_url = $2 AND options->>'deleted_at' IS NOT NULL",
 		short,
 		longURL,
 		userID,
+		optsJSON,
+		clicksLeft,
 	)
 	if err != nil {
-		if strings.Contains(err.Error(), pgerrcode.UniqueViolation) {
-			return &DuplicateError{}
-		}
-		return err
+		return false, err
 	}
-	return nil
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM click_stats WHERE short_url = $1", short)
+	return err == nil, err
 }
 
 func (storage *PostgresStorage) GetURLFromShort(ctx context.Context, short string) (longURL string, exists bool) {
@@ -252,6 +863,224 @@ func (storage *PostgresStorage) GetURLFromShort(ctx context.Context, short strin
 	return longURL, true
 }
 
+func (storage *PostgresStorage) GetLinkOptions(ctx context.Context, short string) (LinkOptions, error) {
+	row := storage.DB.QueryRowContext(
+		ctx,
+		"SELECT options FROM short_urls WHERE short_url = $1",
+		short,
+	)
+	var optsJSON sql.NullString
+	err := row.Scan(&optsJSON)
+	if err == sql.ErrNoRows || (err == nil && !optsJSON.Valid) {
+		return LinkOptions{}, nil
+	}
+	if err != nil {
+		return LinkOptions{}, err
+	}
+	opts := LinkOptions{}
+	err = json.Unmarshal([]byte(optsJSON.String), &opts)
+	return opts, err
+}
+
+func (storage *PostgresStorage) UpdateLinkOptions(ctx context.Context, short string, update func(opts *LinkOptions) error) error {
+	tx, err := storage.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	row := tx.QueryRowContext(
+		ctx,
+		"SELECT options FROM short_urls WHERE short_url = $1 FOR UPDATE",
+		short,
+	)
+	var optsJSON sql.NullString
+	err = row.Scan(&optsJSON)
+	if err == sql.ErrNoRows {
+		return ErrLinkNotFound
+	}
+	if err != nil {
+		return err
+	}
+	opts := LinkOptions{}
+	if optsJSON.Valid {
+		if err := json.Unmarshal([]byte(optsJSON.String), &opts); err != nil {
+			return err
+		}
+	}
+	if err := update(&opts); err != nil {
+		return err
+	}
+	optsJSON, err = marshalLinkOptions(opts)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(
+		ctx,
+		"UPDATE short_urls SET options = $2 WHERE short_url = $1",
+		short,
+		optsJSON,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (storage *PostgresStorage) ConsumeClick(ctx context.Context, short string) (bool, error) {
+	// clicks_left stays NULL for links without a limit
+	res, err := storage.DB.ExecContext(
+		ctx,
+		"UPDATE short_urls SET clicks_left = clicks_left - 1 WHERE short_url = $1 AND (clicks_left IS NULL OR clicks_left > 0)",
+		short,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected > 0, nil
+}
+
+func marshalLinkOptions(opts LinkOptions) (sql.NullString, error) {
+	if opts.isZero() {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, nil
+}
+
+func (storage *PostgresStorage) ClicksLeft(ctx context.Context, short string) (int, bool, error) {
+	var clicksLeft sql.NullInt64
+	err := storage.DB.QueryRowContext(ctx, "SELECT clicks_left FROM short_urls WHERE short_url = $1", short).Scan(&clicksLeft)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return int(clicksLeft.Int64), clicksLeft.Valid, nil
+}
+
+func (storage *PostgresStorage) RecordClick(ctx context.Context, short string, variant string) error {
+	_, err := storage.DB.ExecContext(
+		ctx,
+		"INSERT INTO click_stats (short_url, variant, clicks) VALUES($1, $2, 1) ON CONFLICT (short_url, variant) DO UPDATE SET clicks = click_stats.clicks + 1",
+		short,
+		variant,
+	)
+	return err
+}
+
+func (storage *PostgresStorage) GetClickStats(ctx context.Context, short string) (ClickStats, error) {
+	rows, err := storage.DB.QueryContext(
+		ctx,
+		"SELECT variant, clicks FROM click_stats WHERE short_url = $1",
+		short,
+	)
+	if err != nil {
+		return ClickStats{}, err
+	}
+	defer rows.Close()
+	stats := ClickStats{}
+	for rows.Next() {
+		var variant string
+		var clicks int64
+		if err := rows.Scan(&variant, &clicks); err != nil {
+			return ClickStats{}, err
+		}
+		stats.Total += clicks
+		if len(variant) > 0 {
+			if stats.Variants == nil {
+				stats.Variants = make(map[string]int64)
+			}
+			stats.Variants[variant] = clicks
+		}
+	}
+	return stats, rows.Err()
+}
+
+func (storage *PostgresStorage) GetUserSettings(ctx context.Context, userID uint32) (UserSettings, error) {
+	row := storage.DB.QueryRowContext(
+		ctx,
+		"SELECT settings FROM user_settings WHERE user_id = $1",
+		userID,
+	)
+	var settingsJSON string
+	err := row.Scan(&settingsJSON)
+	if err == sql.ErrNoRows {
+		return UserSettings{}, nil
+	}
+	if err != nil {
+		return UserSettings{}, err
+	}
+	settings := UserSettings{}
+	err = json.Unmarshal([]byte(settingsJSON), &settings)
+	return settings, err
+}
+
+func (storage *PostgresStorage) SaveUserSettings(ctx context.Context, userID uint32, settings UserSettings) error {
+	settingsJSON, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	_, err = storage.DB.ExecContext(
+		ctx,
+		"INSERT INTO user_settings (user_id, settings) VALUES($1, $2) ON CONFLICT (user_id) DO UPDATE SET settings = EXCLUDED.settings",
+		userID,
+		string(settingsJSON),
+	)
+	return err
+}
+
+func (storage *PostgresStorage) SaveReport(ctx context.Context, report AbuseReport) (int64, error) {
+	row := storage.DB.QueryRowContext(
+		ctx,
+		"INSERT INTO abuse_reports (short_url, reason, reporter, created_at) VALUES($1, $2, $3, $4) RETURNING id",
+		report.Short,
+		report.Reason,
+		report.Reporter,
+		report.CreatedAt,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+func (storage *PostgresStorage) GetOpenReports(ctx context.Context) ([]AbuseReport, error) {
+	rows, err := storage.DB.QueryContext(
+		ctx,
+		"SELECT id, short_url, reason, reporter, created_at FROM abuse_reports WHERE resolution IS NULL ORDER BY id",
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reports := make([]AbuseReport, 0)
+	for rows.Next() {
+		var report AbuseReport
+		if err := rows.Scan(&report.ID, &report.Short, &report.Reason, &report.Reporter, &report.CreatedAt); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
+
+func (storage *PostgresStorage) ResolveReports(ctx context.Context, short string, resolution string) error {
+	_, err := storage.DB.ExecContext(
+		ctx,
+		"UPDATE abuse_reports SET resolution = $2 WHERE short_url = $1 AND resolution IS NULL",
+		short,
+		resolution,
+	)
+	return err
+}
+
 func (storage *PostgresStorage) GetURLsByUserID(ctx context.Context, userID uint32) []string {
 	rows, err := storage.DB.QueryContext(
 		ctx,
@@ -278,24 +1107,99 @@ func (storage *PostgresStorage) GetURLsByUserID(ctx context.Context, userID uint
 	return shorts
 }
 
+// ExportLinks reads the links of the user with their clicks in one query,
+// rows are passed on as they arrive. The clicks of a link are in adjacent
+// rows, one per variant.
+func (storage *PostgresStorage) ExportLinks(ctx context.Context, userID uint32, fn func(link ExportedLink) error) error {
+	rows, err := storage.DB.QueryContext(
+		ctx,
+		`SELECT s.short_url, s.long_url, s.options, c.variant, c.clicks
+		FROM short_urls s LEFT JOIN click_stats c ON c.short_url = s.short_url
+		WHERE s.user_id = $1
+		ORDER BY s.short_url`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var link *ExportedLink
+	for rows.Next() {
+		var short, longURL string
+		var optsJSON, variant sql.NullString
+		var clicks sql.NullInt64
+		if err := rows.Scan(&short, &longURL, &optsJSON, &variant, &clicks); err != nil {
+			return err
+		}
+		if link == nil || link.Short != short {
+			if link != nil {
+				if err := fn(*link); err != nil {
+					return err
+				}
+			}
+			link = &ExportedLink{Short: short, LongURL: longURL}
+			if optsJSON.Valid {
+				if err := json.Unmarshal([]byte(optsJSON.String), &link.Options); err != nil {
+					return err
+				}
+			}
+		}
+		if clicks.Valid {
+			link.Clicks.Total += clicks.Int64
+			if len(variant.String) > 0 {
+				if link.Clicks.Variants == nil {
+					link.Clicks.Variants = make(map[string]int64)
+				}
+				link.Clicks.Variants[variant.String] = clicks.Int64
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if link != nil {
+		return fn(*link)
+	}
+	return nil
+}
+
 func (storage *PostgresStorage) PingContext(ctx context.Context) error {
 	return storage.DB.PingContext(ctx)
 }
 
 func (storage *PostgresStorage) SaveShortMulti(ctx context.Context, shortToLong map[string]string, userID uint32) error {
+	return storage.SaveLinkMulti(ctx, shortToLong, userID, LinkOptions{})
+}
+
+func (storage *PostgresStorage) SaveLinkMulti(ctx context.Context, shortToLong map[string]string, userID uint32, opts LinkOptions) error {
+	optsJSON, err := marshalLinkOptions(opts)
+	if err != nil {
+		return err
+	}
+	var clicksLeft sql.NullInt64
+	if opts.HasClickLimit() {
+		clicksLeft = sql.NullInt64{Int64: int64(opts.MaxClicks), Valid: true}
+	}
 	tx, err := storage.DB.Begin()
 	if err != nil {
 		panic(err)
 	}
 	defer tx.Rollback()
-	stmt, err := tx.PrepareContext(ctx, "INSERT INTO short_urls(short_url, long_url, user_id) VALUES($1, $2, $3) ON CONFLICT (long_url) DO NOTHING")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO short_urls(short_url, long_url, user_id, options, clicks_left) VALUES($1, $2, $3, $4, $5) ON CONFLICT (long_url) DO NOTHING")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 	hasDuplicates := false
 	for short, long := range shortToLong {
-		res, err := stmt.ExecContext(ctx, short, long, userID)
+		reused, err := reuseDeletedLink(ctx, tx, short, long, userID, optsJSON, clicksLeft)
+		if err != nil {
+			panic(err)
+		}
+		if reused {
+			continue
+		}
+		res, err := stmt.ExecContext(ctx, short, long, userID, optsJSON, clicksLeft)
 		if err != nil {
 			panic(err)
 		}
@@ -317,10 +1221,116 @@ func (storage *PostgresStorage) SaveShortMulti(ctx context.Context, shortToLong
 	return nil
 }
 
-func (storage *PostgresStorage) Init(ctx context.Context) error {
-	_, err := storage.DB.ExecContext(
+// ImportLinks copies the links into a temporary table with COPY and moves
+// the ones not clashing with saved links over in one statement.
+func (storage *PostgresStorage) NewImport(ctx context.Context, userID uint32) (LinkImport, error) {
+	return &chunkImport{storage: storage, userID: userID}, nil
+}
+
+func (storage *PostgresStorage) ImportLinks(ctx context.Context, links []ImportedLink, userID uint32) ([]int, error) {
+	var skipped []int
+	rows := make([][]interface{}, 0, len(links))
+	copied := make([]int, 0, len(links))
+	shorts := make(map[string]bool, len(links))
+	longURLs := make(map[string]bool, len(links))
+	for i, link := range links {
+		if shorts[link.Short] || longURLs[link.LongURL] {
+			skipped = append(skipped, i)
+			continue
+		}
+		shorts[link.Short] = true
+		longURLs[link.LongURL] = true
+		optsJSON, err := marshalLinkOptions(link.Options)
+		if err != nil {
+			return nil, err
+		}
+		var options, clicksLeft interface{}
+		if optsJSON.Valid {
+			options = optsJSON.String
+		}
+		if link.Options.HasClickLimit() {
+			clicksLeft = int32(link.Options.MaxClicks)
+		}
+		rows = append(rows, []interface{}{link.Short, link.LongURL, int64(userID), options, clicksLeft})
+		copied = append(copied, i)
+	}
+	if len(rows) == 0 {
+		return skipped, nil
+	}
+
+	conn, err := stdlib.AcquireConn(storage.DB)
+	if err != nil {
+		return nil, err
+	}
+	defer stdlib.ReleaseConn(storage.DB, conn)
+	tx, err := conn.BeginEx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	_, err = tx.ExecEx(ctx, "CREATE TEMP TABLE imported_urls (short_url TEXT NOT NULL, long_url TEXT NOT NULL, user_id BIGINT, options TEXT, clicks_left INTEGER) ON COMMIT DROP", nil)
+	if err != nil {
+		return nil, err
+	}
+	columns := []string{"short_url", "long_url", "user_id", "options", "clicks_left"}
+	if _, err := tx.CopyFrom(pgx.Identifier{"imported_urls"}, columns, pgx.CopyFromRows(rows)); err != nil {
+		return nil, err
+	}
+	inserted, err := tx.QueryEx(
 		ctx,
-		"CREATE TABLE IF NOT EXISTS short_urls (short_url CHAR(32) NOT NULL, long_url TEXT NOT NULL UNIQUE, user_id BIGINT)",
+		"INSERT INTO short_urls (short_url, long_url, user_id, options, clicks_left) SELECT short_url, long_url, user_id, options::jsonb, clicks_left FROM imported_urls ON CONFLICT DO NOTHING RETURNING short_url",
+		nil,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	insertedShorts := make(map[string]bool, len(rows))
+	for inserted.Next() {
+		var short string
+		if err := inserted.Scan(&short); err != nil {
+			inserted.Close()
+			return nil, err
+		}
+		insertedShorts[short] = true
+	}
+	if err := inserted.Err(); err != nil {
+		return nil, err
+	}
+	if err := tx.CommitEx(ctx); err != nil {
+		return nil, err
+	}
+	for _, i := range copied {
+		if !insertedShorts[links[i].Short] {
+			skipped = append(skipped, i)
+		}
+	}
+	sort.Ints(skipped)
+	return skipped, nil
+}
+
+var postgresMigrations = []string{
+	"CREATE TABLE IF NOT EXISTS short_urls (short_url CHAR(32) NOT NULL, long_url TEXT NOT NULL UNIQUE, user_id BIGINT)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS short_urls_short_url_idx ON short_urls (short_url)",
+	"ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS options JSONB",
+	"ALTER TABLE short_urls ADD COLUMN IF NOT EXISTS clicks_left INTEGER",
+	"CREATE TABLE IF NOT EXISTS user_settings (user_id BIGINT PRIMARY KEY, settings JSONB NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS click_stats (short_url TEXT NOT NULL, variant TEXT NOT NULL, clicks BIGINT NOT NULL, PRIMARY KEY (short_url, variant))",
+	"CREATE TABLE IF NOT EXISTS abuse_reports (id BIGSERIAL PRIMARY KEY, short_url TEXT NOT NULL, reason TEXT NOT NULL, reporter TEXT NOT NULL, created_at TIMESTAMPTZ NOT NULL, resolution TEXT)",
+	"CREATE INDEX IF NOT EXISTS abuse_reports_open_idx ON abuse_reports (short_url) WHERE resolution IS NULL",
+	// imported codes are shorter than the generated ones and CHAR pads them,
+	// the column is only altered once as it locks the table
+	"DO $$ BEGIN " +
+		"IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = 'short_urls' AND column_name = 'short_url' AND data_type <> 'text') THEN " +
+		"ALTER TABLE short_urls ALTER COLUMN short_url TYPE TEXT; " +
+		"END IF; " +
+		"END $$",
+}
+
+func (storage *PostgresStorage) Init(ctx context.Context) error {
+	for _, migration := range postgresMigrations {
+		if _, err := storage.DB.ExecContext(ctx, migration); err != nil {
+			return err
+		}
+	}
+	return nil
 }
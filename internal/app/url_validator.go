@@ -0,0 +1,151 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const defaultMaxURLLength = 2048
+
+var defaultAllowedSchemes = []string{"http", "https"}
+
+// Resolver looks up the addresses of a host, *net.Resolver implements it.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// URLValidator checks destination urls before they are shortened. It only
+// allows the configured schemes and rejects urls pointing at loopback,
+// private and link-local addresses, either directly or through DNS when a
+// Resolver is set, hosts that don't resolve are rejected then too. The zero
+// value allows http and https urls up to 2048 bytes and does not resolve
+// hostnames.
+type URLValidator struct {
+	AllowedSchemes []string
+	MaxLength      int
+	// SelfHost is the host of the shortener itself, links to it are rejected.
+	SelfHost string
+	Resolver Resolver
+}
+
+type InvalidURLError struct {
+	Reason string
+}
+
+func (e *InvalidURLError) Error() string {
+	return "invalid url: " + e.Reason
+}
+
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+)
+
+func (v *URLValidator) Validate(ctx context.Context, rawURL string) (*url.URL, error) {
+	maxLength := v.MaxLength
+	if maxLength <= 0 {
+		maxLength = defaultMaxURLLength
+	}
+	if len(rawURL) > maxLength {
+		return nil, &InvalidURLError{"url is longer than " + strconv.Itoa(maxLength) + " bytes"}
+	}
+	parsedURL, err := url.ParseRequestURI(rawURL)
+	if err != nil {
+		return nil, &InvalidURLError{"can't parse url"}
+	}
+	if !v.isAllowedScheme(parsedURL.Scheme) {
+		return nil, &InvalidURLError{"scheme " + parsedURL.Scheme + " is not allowed"}
+	}
+	host := strings.TrimSuffix(strings.ToLower(parsedURL.Hostname()), ".")
+	if len(host) == 0 {
+		return nil, &InvalidURLError{"url has no host"}
+	}
+	if len(v.SelfHost) > 0 && host == strings.ToLower(v.SelfHost) {
+		return nil, &InvalidURLError{"url points at the shortener itself"}
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return nil, &InvalidURLError{"host is not allowed"}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if isBlockedIP(ip) {
+			return nil, &InvalidURLError{"address is not allowed"}
+		}
+		return parsedURL, nil
+	}
+	if isNumericHost(host) {
+		// browsers read hosts like 2130706433 or 0x7f.1 as ip addresses
+		return nil, &InvalidURLError{"ambiguous numeric host"}
+	}
+	if v.Resolver != nil {
+		addrs, err := v.Resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			// the host could later resolve to an address that is not allowed
+			return nil, &InvalidURLError{"host doesn't resolve"}
+		}
+		for _, addr := range addrs {
+			if isBlockedIP(addr.IP) {
+				return nil, &InvalidURLError{"host resolves to an address that is not allowed"}
+			}
+		}
+	}
+	return parsedURL, nil
+}
+
+func (v *URLValidator) isAllowedScheme(scheme string) bool {
+	allowedSchemes := v.AllowedSchemes
+	if len(allowedSchemes) == 0 {
+		allowedSchemes = defaultAllowedSchemes
+	}
+	for _, allowed := range allowedSchemes {
+		if strings.EqualFold(scheme, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBlockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNumericHost reports whether the last label of the host is a number,
+// which no real top-level domain is.
+func isNumericHost(host string) bool {
+	labels := strings.Split(host, ".")
+	last := labels[len(labels)-1]
+	if len(last) == 0 {
+		return false
+	}
+	if strings.HasPrefix(last, "0x") {
+		_, err := strconv.ParseUint(last[2:], 16, 64)
+		return err == nil
+	}
+	_, err := strconv.ParseUint(last, 10, 64)
+	return err == nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,39 @@
+package app
+
+import "net/url"
+
+// UTMParams is a template of utm_* query parameters added to a destination.
+type UTMParams struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// Apply sets the template parameters that are not already present in the query.
+func (p UTMParams) Apply(query url.Values) {
+	params := map[string]string{
+		"utm_source":   p.Source,
+		"utm_medium":   p.Medium,
+		"utm_campaign": p.Campaign,
+		"utm_term":     p.Term,
+		"utm_content":  p.Content,
+	}
+	for key, value := range params {
+		if len(value) == 0 {
+			continue
+		}
+		if _, exists := query[key]; !exists {
+			query.Set(key, value)
+		}
+	}
+}
+
+// UserSettings holds per-user defaults applied to the links the user creates.
+type UserSettings struct {
+	DefaultUTM *UTMParams `json:"default_utm,omitempty"`
+	// Untrusted is set by admins, links of untrusted users always show the
+	// preview page first.
+	Untrusted bool `json:"untrusted,omitempty"`
+}
@@ -0,0 +1,98 @@
+package app
+
+import (
+	"errors"
+	"math/rand"
+	"net/url"
+)
+
+// Variant is one of the weighted destinations of an A/B split link.
+type Variant struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+func ValidateVariants(variants []Variant) error {
+	names := make(map[string]bool)
+	totalWeight := 0
+	for _, variant := range variants {
+		if len(variant.Name) == 0 {
+			return errors.New("variant has no name")
+		}
+		if names[variant.Name] {
+			return errors.New("duplicate variant name " + variant.Name)
+		}
+		names[variant.Name] = true
+		if variant.Weight < 0 {
+			return errors.New("variant weight must not be negative")
+		}
+		if _, err := url.ParseRequestURI(variant.URL); err != nil {
+			return errors.New("invalid variant url")
+		}
+		totalWeight += variant.Weight
+	}
+	if len(variants) > 0 && totalWeight == 0 {
+		return errors.New("variant weights sum to zero")
+	}
+	return nil
+}
+
+// PickVariant chooses a variant with probability proportional to its weight.
+func PickVariant(variants []Variant) (Variant, bool) {
+	totalWeight := 0
+	for _, variant := range variants {
+		totalWeight += variant.Weight
+	}
+	if totalWeight <= 0 {
+		return Variant{}, false
+	}
+	n := rand.Intn(totalWeight)
+	for _, variant := range variants {
+		if n < variant.Weight {
+			return variant, true
+		}
+		n -= variant.Weight
+	}
+	return Variant{}, false
+}
+
+// FindVariant returns the variant with the name if it still receives traffic.
+func FindVariant(variants []Variant, name string) (Variant, bool) {
+	for _, variant := range variants {
+		if variant.Name == name && variant.Weight > 0 {
+			return variant, true
+		}
+	}
+	return Variant{}, false
+}
+
+// ClickStats counts redirects of a link, in total and per A/B variant.
+type ClickStats struct {
+	Total    int64            `json:"total"`
+	Variants map[string]int64 `json:"variants,omitempty"`
+}
+
+func addClick(stats ClickStats, variant string) ClickStats {
+	stats = copyClickStats(stats)
+	stats.Total++
+	if len(variant) > 0 {
+		if stats.Variants == nil {
+			stats.Variants = make(map[string]int64)
+		}
+		stats.Variants[variant]++
+	}
+	return stats
+}
+
+func copyClickStats(stats ClickStats) ClickStats {
+	if stats.Variants == nil {
+		return stats
+	}
+	variants := make(map[string]int64, len(stats.Variants))
+	for name, clicks := range stats.Variants {
+		variants[name] = clicks
+	}
+	stats.Variants = variants
+	return stats
+}
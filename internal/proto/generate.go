@@ -0,0 +1,5 @@
+// Package proto holds the gRPC service of the shortener, generated from
+// shortener.proto.
+package proto
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative shortener.proto
@@ -0,0 +1,314 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Shorten shortens a url with the plain text endpoint. If the url was
+// shortened before, the existing short url is returned together with an
+// error matching ErrConflict.
+func (c *Client) Shorten(ctx context.Context, longURL string) (string, error) {
+	resp, err := c.do(ctx, request{
+		method:         http.MethodPost,
+		path:           "/",
+		contentType:    "text/plain",
+		body:           []byte(longURL),
+		idempotencyKey: newIdempotencyKey(),
+	})
+	if err != nil {
+		return "", err
+	}
+	switch resp.status {
+	case http.StatusCreated:
+		return string(resp.body), nil
+	case http.StatusConflict:
+		return string(resp.body), newError(resp)
+	}
+	return "", newError(resp)
+}
+
+// ShortenJSON shortens a url with options. Like Shorten, it returns the
+// existing short url with an error matching ErrConflict.
+func (c *Client) ShortenJSON(ctx context.Context, shortenReq ShortenRequest) (ShortenResponse, error) {
+	req, err := c.newJSONRequest(http.MethodPost, "/api/shorten", shortenReq)
+	if err != nil {
+		return ShortenResponse{}, err
+	}
+	req.query = shortenReq.QR.query()
+	req.idempotencyKey = newIdempotencyKey()
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return ShortenResponse{}, err
+	}
+	var result ShortenResponse
+	if err := decode(resp, &result, http.StatusCreated, http.StatusConflict); err != nil {
+		return ShortenResponse{}, err
+	}
+	if resp.status == http.StatusConflict {
+		return result, newError(resp)
+	}
+	return result, nil
+}
+
+// ShortenBatch shortens many urls at once. If some of them were shortened
+// before, all results are returned with an error matching ErrConflict.
+func (c *Client) ShortenBatch(ctx context.Context, items []BatchItem, qr *QROptions) ([]BatchResult, error) {
+	req, err := c.newJSONRequest(http.MethodPost, "/api/shorten/batch", items)
+	if err != nil {
+		return nil, err
+	}
+	req.query = qr.query()
+	req.idempotencyKey = newIdempotencyKey()
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var results []BatchResult
+	if err := decode(resp, &results, http.StatusCreated, http.StatusConflict); err != nil {
+		return nil, err
+	}
+	if resp.status == http.StatusConflict {
+		return results, newError(resp)
+	}
+	return results, nil
+}
+
+func (c *Client) UserURLs(ctx context.Context) ([]UserURL, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/user/urls"})
+	if err != nil {
+		return nil, err
+	}
+	var urls []UserURL
+	return urls, decode(resp, &urls, http.StatusOK, http.StatusNoContent)
+}
+
+// DeleteUserURLs deletes links of the user by their short codes, codes of
+// other users are skipped.
+func (c *Client) DeleteUserURLs(ctx context.Context, ids []string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/user/urls", ids, nil, http.StatusNoContent)
+}
+
+// ImportUserURLs imports links from a file of the content type ImportCSV or
+// ImportJSONL. Rows failing on the server are skipped and listed in the
+// result.
+func (c *Client) ImportUserURLs(ctx context.Context, contentType string, data []byte) (ImportResult, error) {
+	resp, err := c.do(ctx, request{
+		method:      http.MethodPost,
+		path:        "/api/user/import",
+		contentType: contentType,
+		body:        data,
+	})
+	if err != nil {
+		return ImportResult{}, err
+	}
+	var result ImportResult
+	return result, decode(resp, &result, http.StatusOK)
+}
+
+func (c *Client) LinkRules(ctx context.Context, id string) ([]RedirectRule, error) {
+	var response struct {
+		Rules []RedirectRule `json:"rules"`
+	}
+	err := c.doJSON(ctx, http.MethodGet, pathf("/api/user/urls/%s/rules", id), nil, &response, http.StatusOK)
+	return response.Rules, err
+}
+
+func (c *Client) SetLinkRules(ctx context.Context, id string, rules []RedirectRule) ([]RedirectRule, error) {
+	var response struct {
+		Rules []RedirectRule `json:"rules"`
+	}
+	body := response
+	body.Rules = rules
+	err := c.doJSON(ctx, http.MethodPut, pathf("/api/user/urls/%s/rules", id), body, &response, http.StatusOK)
+	return response.Rules, err
+}
+
+func (c *Client) LinkVariants(ctx context.Context, id string) ([]Variant, error) {
+	var response struct {
+		Variants []Variant `json:"variants"`
+	}
+	err := c.doJSON(ctx, http.MethodGet, pathf("/api/user/urls/%s/variants", id), nil, &response, http.StatusOK)
+	return response.Variants, err
+}
+
+func (c *Client) SetLinkVariants(ctx context.Context, id string, variants []Variant) ([]Variant, error) {
+	var response struct {
+		Variants []Variant `json:"variants"`
+	}
+	body := response
+	body.Variants = variants
+	err := c.doJSON(ctx, http.MethodPut, pathf("/api/user/urls/%s/variants", id), body, &response, http.StatusOK)
+	return response.Variants, err
+}
+
+// LinkInfo describes any link without following it.
+func (c *Client) LinkInfo(ctx context.Context, id string) (LinkInfo, error) {
+	var info LinkInfo
+	err := c.doJSON(ctx, http.MethodGet, pathf("/api/urls/%s", id), nil, &info, http.StatusOK)
+	return info, err
+}
+
+func (c *Client) LinkStats(ctx context.Context, id string) (ClickStats, error) {
+	var stats ClickStats
+	err := c.doJSON(ctx, http.MethodGet, pathf("/api/user/urls/%s/stats", id), nil, &stats, http.StatusOK)
+	return stats, err
+}
+
+func (c *Client) UserSettings(ctx context.Context) (UserSettings, error) {
+	var settings UserSettings
+	err := c.doJSON(ctx, http.MethodGet, "/api/user/settings", nil, &settings, http.StatusOK)
+	return settings, err
+}
+
+func (c *Client) SetUserSettings(ctx context.Context, settings UserSettings) (UserSettings, error) {
+	var saved UserSettings
+	err := c.doJSON(ctx, http.MethodPut, "/api/user/settings", settings, &saved, http.StatusOK)
+	return saved, err
+}
+
+// Report reports a malicious link to the admins and returns the id of the
+// report.
+func (c *Client) Report(ctx context.Context, id string, reason string) (int64, error) {
+	var response struct {
+		ID int64 `json:"id"`
+	}
+	body := struct {
+		Reason string `json:"reason"`
+	}{reason}
+	err := c.doJSON(ctx, http.MethodPost, pathf("/api/report/%s", id), body, &response, http.StatusAccepted)
+	return response.ID, err
+}
+
+// QRCode renders the short url of the link, in PNG unless opts asks for
+// SVG.
+func (c *Client) QRCode(ctx context.Context, id string, opts QROptions) ([]byte, error) {
+	format := opts.Format
+	if len(format) == 0 {
+		format = QRFormatPNG
+	}
+	query := opts.query()
+	query.Del("qr")
+	resp, err := c.do(ctx, request{
+		method: http.MethodGet,
+		path:   pathf("/%s/qr.", id) + url.PathEscape(format),
+		query:  query,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, newError(resp)
+	}
+	return resp.body, nil
+}
+
+// OpenAPI returns the OpenAPI document of the server.
+func (c *Client) OpenAPI(ctx context.Context) ([]byte, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/api/openapi.json"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.status != http.StatusOK {
+		return nil, newError(resp)
+	}
+	return resp.body, nil
+}
+
+// Ping checks that the server can reach its storage.
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/ping"})
+	if err != nil {
+		return err
+	}
+	return decode(resp, nil, http.StatusOK)
+}
+
+// AbuseReports lists the open abuse reports. It needs the admin token.
+func (c *Client) AbuseReports(ctx context.Context) ([]AbuseReport, error) {
+	var reports []AbuseReport
+	err := c.doAdminJSON(ctx, http.MethodGet, "/api/admin/reports", nil, &reports, http.StatusOK)
+	return reports, err
+}
+
+// DisableLink takes the link down with status 410 or 451, zero picks 410.
+// It needs the admin token.
+func (c *Client) DisableLink(ctx context.Context, id string, status int, reason string) (Takedown, error) {
+	body := struct {
+		Status int    `json:"status,omitempty"`
+		Reason string `json:"reason"`
+	}{status, reason}
+	var takedown Takedown
+	err := c.doAdminJSON(ctx, http.MethodPost, pathf("/api/admin/urls/%s/disable", id), body, &takedown, http.StatusOK)
+	return takedown, err
+}
+
+// EnableLink restores a link taken down before. It needs the admin token.
+func (c *Client) EnableLink(ctx context.Context, id string) error {
+	return c.doAdminJSON(ctx, http.MethodPost, pathf("/api/admin/urls/%s/enable", id), nil, nil, http.StatusNoContent)
+}
+
+// DismissReports closes the reports of a link without taking it down. It
+// needs the admin token.
+func (c *Client) DismissReports(ctx context.Context, id string) error {
+	return c.doAdminJSON(ctx, http.MethodPost, pathf("/api/admin/urls/%s/dismiss", id), nil, nil, http.StatusNoContent)
+}
+
+// SetUserTrust marks a user as untrusted or trusted again. It needs the
+// admin token.
+func (c *Client) SetUserTrust(ctx context.Context, userID uint32, untrusted bool) error {
+	body := struct {
+		Untrusted bool `json:"untrusted"`
+	}{untrusted}
+	path := "/api/admin/users/" + strconv.FormatUint(uint64(userID), 10) + "/trust"
+	return c.doAdminJSON(ctx, http.MethodPut, path, body, nil, http.StatusOK)
+}
+
+func (c *Client) doJSON(ctx context.Context, method string, path string, body interface{}, v interface{}, statuses ...int) error {
+	return c.doJSONRequest(ctx, method, path, body, false, v, statuses...)
+}
+
+func (c *Client) doAdminJSON(ctx context.Context, method string, path string, body interface{}, v interface{}, statuses ...int) error {
+	return c.doJSONRequest(ctx, method, path, body, true, v, statuses...)
+}
+
+func (c *Client) doJSONRequest(ctx context.Context, method string, path string, body interface{}, admin bool, v interface{}, statuses ...int) error {
+	req := request{method: method, path: path}
+	if body != nil {
+		var err error
+		if req, err = c.newJSONRequest(method, path, body); err != nil {
+			return err
+		}
+	}
+	req.admin = admin
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	return decode(resp, v, statuses...)
+}
+
+func (opts *QROptions) query() url.Values {
+	query := url.Values{}
+	if opts == nil {
+		return query
+	}
+	format := opts.Format
+	if len(format) == 0 {
+		format = QRFormatPNG
+	}
+	query.Set("qr", strings.ToLower(format))
+	if opts.Size > 0 {
+		query.Set("size", strconv.Itoa(opts.Size))
+	}
+	if len(opts.Level) > 0 {
+		query.Set("level", opts.Level)
+	}
+	if opts.Margin != nil {
+		query.Set("margin", strconv.Itoa(*opts.Margin))
+	}
+	return query
+}
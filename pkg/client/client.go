@@ -0,0 +1,380 @@
+// Package client is a Go client of the shortener API.
+//
+// The client keeps the user token issued by the server and sends it with
+// every request, so links created by one call are visible to the next ones.
+// A TokenStore keeps the token across processes. Requests answered with 429
+// are retried with exponential backoff, as are 5xx answers to requests safe
+// to repeat: shortening sends an Idempotency-Key, so a retry of a request
+// that succeeded gets the original answer. Response bodies are accepted
+// gzipped and large request bodies are sent gzipped.
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	userTokenCookie      = "user_token"
+	idempotencyKeyHeader = "Idempotency-Key"
+	// errCodeIdempotencyKeyInUse answers a retry while the first attempt is
+	// still handled.
+	errCodeIdempotencyKeyInUse = "idempotency_key_in_use"
+)
+
+const (
+	defaultMaxRetries      = 3
+	defaultMinBackoff      = 100 * time.Millisecond
+	defaultMaxBackoff      = 5 * time.Second
+	defaultGzipRequestSize = 1024
+)
+
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	adminToken string
+	tokenStore TokenStore
+
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// gzipRequestSize is the body size from which requests are compressed,
+	// zero or less disables compression.
+	gzipRequestSize int
+
+	mu        sync.Mutex
+	userToken string
+}
+
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient. Redirects are never followed,
+// whatever the CheckRedirect of the client.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithUserToken acts as the user the token was issued to.
+func WithUserToken(userToken string) Option {
+	return func(c *Client) {
+		c.userToken = userToken
+	}
+}
+
+// WithTokenStore loads the user token from the store and saves tokens
+// issued by the server to it.
+func WithTokenStore(store TokenStore) Option {
+	return func(c *Client) {
+		c.tokenStore = store
+	}
+}
+
+// WithAdminToken is needed for the admin methods.
+func WithAdminToken(adminToken string) Option {
+	return func(c *Client) {
+		c.adminToken = adminToken
+	}
+}
+
+// WithRetries sets how often failed requests are retried and the bounds of
+// the backoff between attempts. A Retry-After longer than maxBackoff isn't
+// waited for, the error is returned instead.
+func WithRetries(maxRetries int, minBackoff time.Duration, maxBackoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.minBackoff = minBackoff
+		c.maxBackoff = maxBackoff
+	}
+}
+
+// WithGzipRequests compresses request bodies of at least minSize bytes, zero
+// or less disables compression.
+func WithGzipRequests(minSize int) Option {
+	return func(c *Client) {
+		c.gzipRequestSize = minSize
+	}
+}
+
+// New creates a client of the shortener at baseURL, e.g.
+// http://localhost:8080.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	parsedURL, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.Scheme != "http" && parsedURL.Scheme != "https" {
+		return nil, fmt.Errorf("client: base url must be http or https, got %q", baseURL)
+	}
+	c := &Client{
+		baseURL:         parsedURL,
+		httpClient:      http.DefaultClient,
+		maxRetries:      defaultMaxRetries,
+		minBackoff:      defaultMinBackoff,
+		maxBackoff:      defaultMaxBackoff,
+		gzipRequestSize: defaultGzipRequestSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	noRedirects := *c.httpClient
+	noRedirects.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	c.httpClient = &noRedirects
+	if c.tokenStore != nil && len(c.userToken) == 0 {
+		if c.userToken, err = c.tokenStore.LoadToken(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// UserToken returns the token of the user the client acts as, it is empty
+// until the first response if none was given.
+func (c *Client) UserToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.userToken
+}
+
+type request struct {
+	method string
+	// path is escaped already, see pathf.
+	path        string
+	query       url.Values
+	contentType string
+	body        []byte
+	admin       bool
+	// idempotencyKey makes retrying a POST safe, see newIdempotencyKey.
+	idempotencyKey string
+}
+
+// newIdempotencyKey returns a random key, sent with every attempt of a
+// request so the server handles it once.
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	if _, err := cryptorand.Read(key); err != nil {
+		// without a key the request is just not retried on server errors
+		return ""
+	}
+	return hex.EncodeToString(key)
+}
+
+// retryable tells whether resp may be retried. 429 answers were not handled,
+// 5xx ones may have been, so only requests safe to repeat are retried then.
+func (req request) retryable(resp response) bool {
+	switch {
+	case resp.status == http.StatusTooManyRequests:
+		return true
+	case resp.status >= http.StatusInternalServerError:
+		switch req.method {
+		case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions:
+			return true
+		}
+		return len(req.idempotencyKey) > 0
+	case resp.status == http.StatusConflict && len(req.idempotencyKey) > 0:
+		return newError(resp).Code == errCodeIdempotencyKeyInUse
+	}
+	return false
+}
+
+// pathf formats a request path escaping the arguments.
+func pathf(format string, args ...string) string {
+	escaped := make([]interface{}, len(args))
+	for i, arg := range args {
+		escaped[i] = url.PathEscape(arg)
+	}
+	return fmt.Sprintf(format, escaped...)
+}
+
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (c *Client) newJSONRequest(method string, path string, body interface{}) (request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return request{}, err
+	}
+	return request{method: method, path: path, contentType: "application/json", body: data}, nil
+}
+
+// do sends the request, retrying the answers request.retryable allows.
+// Other responses, errors included, are returned to the caller.
+func (c *Client) do(ctx context.Context, req request) (response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, req)
+		if err != nil {
+			return response{}, err
+		}
+		if !req.retryable(resp) {
+			return resp, nil
+		}
+		if attempt >= c.maxRetries {
+			return resp, nil
+		}
+		delay := c.backoff(attempt)
+		if retryAfter, ok := parseRetryAfter(resp.header); ok {
+			if retryAfter > c.maxBackoff {
+				return resp, nil
+			}
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return response{}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// backoff doubles the delay with every attempt and picks a random point in
+// its upper half, so clients failing together don't retry together.
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.minBackoff << uint(attempt)
+	if delay > c.maxBackoff || delay <= 0 {
+		delay = c.maxBackoff
+	}
+	if half := int64(delay / 2); half > 0 {
+		return time.Duration(half + rand.Int63n(half))
+	}
+	return delay
+}
+
+func (c *Client) send(ctx context.Context, req request) (response, error) {
+	target := *c.baseURL
+	target.RawPath = c.baseURL.EscapedPath() + req.path
+	target.Path, _ = url.PathUnescape(target.RawPath)
+	target.RawQuery = req.query.Encode()
+	var body io.Reader
+	compressed := false
+	if req.body != nil {
+		data := req.body
+		if c.gzipRequestSize > 0 && len(data) >= c.gzipRequestSize {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			if _, err := gz.Write(data); err != nil {
+				return response{}, err
+			}
+			if err := gz.Close(); err != nil {
+				return response{}, err
+			}
+			data = buf.Bytes()
+			compressed = true
+		}
+		body = bytes.NewReader(data)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, target.String(), body)
+	if err != nil {
+		return response{}, err
+	}
+	if len(req.contentType) > 0 {
+		httpReq.Header.Set("Content-Type", req.contentType)
+	}
+	if compressed {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	httpReq.Header.Set("Accept-Encoding", "gzip")
+	if userToken := c.UserToken(); len(userToken) > 0 {
+		httpReq.AddCookie(&http.Cookie{Name: userTokenCookie, Value: userToken})
+	}
+	if req.admin {
+		httpReq.Header.Set("Authorization", "Bearer "+c.adminToken)
+	}
+	if len(req.idempotencyKey) > 0 {
+		httpReq.Header.Set(idempotencyKeyHeader, req.idempotencyKey)
+	}
+
+	httpResp, err := c.httpClient.Do(httpReq)
+	if err != nil {
+		return response{}, err
+	}
+	defer httpResp.Body.Close()
+	if err := c.keepUserToken(httpResp); err != nil {
+		return response{}, err
+	}
+	var reader io.Reader = httpResp.Body
+	if strings.Contains(httpResp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(httpResp.Body)
+		if err != nil {
+			if err == io.EOF {
+				return response{status: httpResp.StatusCode, header: httpResp.Header}, nil
+			}
+			return response{}, err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return response{}, err
+	}
+	return response{status: httpResp.StatusCode, header: httpResp.Header, body: data}, nil
+}
+
+// keepUserToken remembers the token set by the server and saves it to the
+// token store if it changed.
+func (c *Client) keepUserToken(resp *http.Response) error {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name != userTokenCookie {
+			continue
+		}
+		c.mu.Lock()
+		changed := cookie.Value != c.userToken
+		c.userToken = cookie.Value
+		c.mu.Unlock()
+		if changed && c.tokenStore != nil {
+			return c.tokenStore.SaveToken(cookie.Value)
+		}
+	}
+	return nil
+}
+
+func parseRetryAfter(header http.Header) (time.Duration, bool) {
+	value := header.Get("Retry-After")
+	if len(value) == 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at), true
+	}
+	return 0, false
+}
+
+// decode unmarshals successful responses into v and turns the others into
+// errors.
+func decode(resp response, v interface{}, statuses ...int) error {
+	for _, status := range statuses {
+		if resp.status == status {
+			if v == nil || len(resp.body) == 0 {
+				return nil
+			}
+			return json.Unmarshal(resp.body, v)
+		}
+	}
+	return newError(resp)
+}
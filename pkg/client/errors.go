@@ -0,0 +1,90 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Errors matched by the *Error of a failed request with errors.Is.
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("url was shortened before")
+	ErrGone         = errors.New("link is gone")
+	ErrTooLarge     = errors.New("request too large")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrServer       = errors.New("server error")
+)
+
+// Error is returned for requests the server didn't accept. Code, Message
+// and Details come from the JSON error of the API, the plain text endpoints
+// only fill in Message.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Details    map[string]interface{}
+	// RetryAfter is how long the server asked to wait before retrying.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if len(e.Code) > 0 {
+		return fmt.Sprintf("shortener: %d %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("shortener: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrGone:
+		return e.StatusCode == http.StatusGone
+	case ErrTooLarge:
+		return e.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServer:
+		return e.StatusCode >= http.StatusInternalServerError
+	}
+	return false
+}
+
+type errorResponse struct {
+	Error struct {
+		Code    string                 `json:"code"`
+		Message string                 `json:"message"`
+		Details map[string]interface{} `json:"details"`
+	} `json:"error"`
+}
+
+func newError(resp response) *Error {
+	err := &Error{StatusCode: resp.status}
+	if retryAfter, ok := parseRetryAfter(resp.header); ok {
+		err.RetryAfter = retryAfter
+	}
+	envelope := errorResponse{}
+	if strings.HasPrefix(resp.header.Get("Content-Type"), "application/json") && json.Unmarshal(resp.body, &envelope) == nil && len(envelope.Error.Code) > 0 {
+		err.Code = envelope.Error.Code
+		err.Message = envelope.Error.Message
+		err.Details = envelope.Error.Details
+		return err
+	}
+	err.Message = strings.TrimSpace(string(resp.body))
+	if len(err.Message) == 0 {
+		err.Message = http.StatusText(resp.status)
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TokenStore keeps the user token between runs. LoadToken returns an empty
+// token if none was saved yet.
+type TokenStore interface {
+	LoadToken() (string, error)
+	SaveToken(token string) error
+}
+
+// FileTokenStore keeps the token in a file readable by the owner only.
+type FileTokenStore string
+
+func (f FileTokenStore) LoadToken() (string, error) {
+	data, err := os.ReadFile(string(f))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func (f FileTokenStore) SaveToken(token string) error {
+	if err := os.MkdirAll(filepath.Dir(string(f)), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(string(f), []byte(token+"\n"), 0600)
+}
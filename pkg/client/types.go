@@ -0,0 +1,176 @@
+package client
+
+import (
+	"time"
+)
+
+// Formats of QR codes.
+const (
+	QRFormatPNG = "png"
+	QRFormatSVG = "svg"
+)
+
+// UTMParams are the utm_* query parameters added to the destination.
+type UTMParams struct {
+	Source   string `json:"source,omitempty"`
+	Medium   string `json:"medium,omitempty"`
+	Campaign string `json:"campaign,omitempty"`
+	Term     string `json:"term,omitempty"`
+	Content  string `json:"content,omitempty"`
+}
+
+// RedirectRule sends the visitors matching all of its conditions to URL.
+type RedirectRule struct {
+	Device   string       `json:"device,omitempty"`
+	Language string       `json:"language,omitempty"`
+	Header   *HeaderMatch `json:"header,omitempty"`
+	URL      string       `json:"url"`
+}
+
+// HeaderMatch matches a request header, an empty Value matches any value.
+type HeaderMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+}
+
+// Variant is a destination of an A/B split, picked by Weight.
+type Variant struct {
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+}
+
+type ClickStats struct {
+	Total    int64            `json:"total"`
+	Variants map[string]int64 `json:"variants,omitempty"`
+}
+
+// Takedown is served instead of the redirect of a disabled link.
+type Takedown struct {
+	Status int       `json:"status"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// ImportRow is a link of an import. Short is empty for links getting a
+// generated code.
+type ImportRow struct {
+	Short       string            `json:"short,omitempty"`
+	OriginalURL string            `json:"original_url"`
+	CreatedAt   *time.Time        `json:"created_at,omitempty"`
+	Title       string            `json:"title,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// QROptions asks for a QR code of the short url. Zero values and a nil
+// Margin leave the choice to the server.
+type QROptions struct {
+	Format string
+	Size   int
+	Level  string
+	Margin *int
+}
+
+type ShortenRequest struct {
+	URL           string         `json:"url"`
+	Password      string         `json:"password,omitempty"`
+	MaxClicks     int            `json:"max_clicks,omitempty"`
+	RedirectCode  int            `json:"redirect_code,omitempty"`
+	ForwardQuery  bool           `json:"forward_query,omitempty"`
+	QueryConflict string         `json:"query_conflict,omitempty"`
+	ForwardPath   bool           `json:"forward_path,omitempty"`
+	UTM           *UTMParams     `json:"utm,omitempty"`
+	Rules         []RedirectRule `json:"rules,omitempty"`
+	Variants      []Variant      `json:"variants,omitempty"`
+	ActiveFrom    *time.Time     `json:"active_from,omitempty"`
+	ActiveUntil   *time.Time     `json:"active_until,omitempty"`
+	BeforeURL     string         `json:"before_url,omitempty"`
+	AfterURL      string         `json:"after_url,omitempty"`
+	NotYetMessage string         `json:"not_yet_message,omitempty"`
+	Title         string         `json:"title,omitempty"`
+	// QR adds a QR code data uri to the response.
+	QR *QROptions `json:"-"`
+}
+
+type ShortenResponse struct {
+	Result string `json:"result"`
+	QR     string `json:"qr,omitempty"`
+}
+
+type BatchItem struct {
+	CorrelationID string `json:"correlation_id"`
+	OriginalURL   string `json:"original_url"`
+}
+
+type BatchResult struct {
+	CorrelationID string `json:"correlation_id"`
+	ShortURL      string `json:"short_url"`
+	QR            string `json:"qr,omitempty"`
+}
+
+// LinkInfo describes a link. OriginalURL is empty for password protected
+// and disabled links of other users, the fields after Owner are only set for
+// own links.
+type LinkInfo struct {
+	Short          string     `json:"short"`
+	ShortURL       string     `json:"short_url"`
+	OriginalURL    string     `json:"original_url,omitempty"`
+	Status         string     `json:"status"`
+	TakedownReason string     `json:"takedown_reason,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	Title          string     `json:"title,omitempty"`
+	Protected      bool       `json:"protected,omitempty"`
+	Preview        bool       `json:"preview,omitempty"`
+
+	Owner       bool              `json:"owner,omitempty"`
+	ActiveFrom  *time.Time        `json:"active_from,omitempty"`
+	ActiveUntil *time.Time        `json:"active_until,omitempty"`
+	MaxClicks   int               `json:"max_clicks,omitempty"`
+	Clicks      *ClickStats       `json:"clicks,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type UserURL struct {
+	ShortURL       string `json:"short_url"`
+	OriginalURL    string `json:"original_url"`
+	Status         string `json:"status"`
+	TakedownReason string `json:"takedown_reason,omitempty"`
+}
+
+// Content types of imports.
+const (
+	ImportCSV   = "text/csv"
+	ImportJSONL = "application/x-ndjson"
+)
+
+type ImportResult struct {
+	Imported int              `json:"imported"`
+	Failed   int              `json:"failed"`
+	Errors   []ImportRowError `json:"errors"`
+	// ErrorsTruncated is set when more rows failed than errors are listed.
+	ErrorsTruncated bool `json:"errors_truncated,omitempty"`
+}
+
+// ImportRowError is a row of an import that was skipped. Code is one of the
+// codes of Error or "invalid_row" and "duplicate".
+type ImportRowError struct {
+	Line    int                    `json:"line"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type UserSettings struct {
+	DefaultUTM *UTMParams `json:"default_utm"`
+}
+
+type AbuseReport struct {
+	ID          int64     `json:"id"`
+	Short       string    `json:"short"`
+	Reason      string    `json:"reason"`
+	Reporter    string    `json:"reporter"`
+	CreatedAt   time.Time `json:"created_at"`
+	Resolution  string    `json:"resolution,omitempty"`
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+}